@@ -15,16 +15,21 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	log "github.com/golang/glog"
 	"gopkg.in/ini.v1"
 
 	"github.com/icpz/open-snell/components/snell"
+	"github.com/icpz/open-snell/components/utils"
 	"github.com/icpz/open-snell/constants"
 )
 
@@ -35,7 +40,54 @@ type Config struct {
 	ObfsHost   string
 	PSK        string
 	SnellVer   string
+	ClientID   string
+	Password   string
+	MPTCP      bool
+	Resumption bool
+	FastReply  bool
+	Datagram   bool
+	Mux        bool
+	ServerTCP  utils.TCPOptions
 	Verbose    bool
+	Reverse    []ReverseTunnel
+	// Speedtest runs a throughput test against the server instead of
+	// serving the local proxy
+	Speedtest         bool
+	SpeedtestDuration time.Duration
+}
+
+// ReverseTunnel exposes the service at Local on Port of the server.
+type ReverseTunnel struct {
+	Port  uint16
+	Local string
+}
+
+// parseReverse parses "<server port>=<local address>".
+func parseReverse(s string) (ReverseTunnel, error) {
+	port, local, ok := strings.Cut(s, "=")
+	p, err := strconv.ParseUint(strings.TrimSpace(port), 10, 16)
+	if !ok || err != nil || p == 0 {
+		return ReverseTunnel{}, fmt.Errorf("invalid reverse tunnel %s", s)
+	}
+	return ReverseTunnel{Port: uint16(p), Local: strings.TrimSpace(local)}, nil
+}
+
+// parseReverseSections loads every [reverse.<name>] section.
+func parseReverseSections(cfg *ini.File) ([]ReverseTunnel, error) {
+	var tunnels []ReverseTunnel
+	for _, sec := range cfg.Sections() {
+		name, ok := strings.CutPrefix(sec.Name(), "reverse.")
+		if !ok || name == "" {
+			continue
+		}
+		port := sec.Key("remote-port").MustUint(0)
+		local := sec.Key("local").String()
+		if port == 0 || port > 65535 || local == "" {
+			return nil, fmt.Errorf("reverse %s: remote-port and local required", name)
+		}
+		tunnels = append(tunnels, ReverseTunnel{Port: uint16(port), Local: local})
+	}
+	return tunnels, nil
 }
 
 func initLogging(verbose bool) {
@@ -62,16 +114,43 @@ func parseConfig() (*Config, error) {
 		obfsHost   string
 		psk        string
 		snellVer   string
+		clientID   string
+		password   string
+		mptcp      bool
+		resumption bool
+		fastReply  bool
+		datagram   bool
+		mux        bool
+		serverTCP  utils.TCPOptions
 		verbose    bool
+		reverse    string
+		tunnels    []ReverseTunnel
 		version    bool
+		speedtest  bool
+		duration   int
 	)
 
+	// "snell-client speedtest [flags]" runs a throughput test
+	if len(os.Args) > 1 && os.Args[1] == "speedtest" {
+		speedtest = true
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	flag.StringVar(&configFile, "c", "", "configuration file path")
 	flag.StringVar(&listenAddr, "l", "0.0.0.0:18888", "client listen address")
 	flag.StringVar(&serverAddr, "s", "", "snell server address")
 	flag.StringVar(&obfsType, "obfs", "", "obfs type")
 	flag.StringVar(&obfsHost, "obfs-host", "bing.com", "obfs host")
 	flag.StringVar(&psk, "k", "", "pre-shared key")
+	flag.StringVar(&clientID, "id", "", "client id sent to the server")
+	flag.StringVar(&password, "password", "", "password of the client id")
+	flag.BoolVar(&mptcp, "mptcp", false, "use multipath TCP to the server")
+	flag.BoolVar(&resumption, "resumption", false, "resume sessions with tickets issued by the server")
+	flag.BoolVar(&fastReply, "fast-reply", false, "answer SOCKS5 requests before the server reply")
+	flag.BoolVar(&datagram, "datagram", false, "carry UDP in datagrams to the server UDP port")
+	flag.BoolVar(&mux, "mux", false, "carry UDP over TCP as flows of one shared connection")
+	flag.StringVar(&reverse, "reverse", "", "expose a local service on a server port, <server port>=<local address>")
+	flag.IntVar(&duration, "duration", 10, "speedtest duration of each direction in seconds")
 	flag.BoolVar(&verbose, "verbose", false, "enable verbose logs (equivalent to -v=1 for glog)")
 	flag.BoolVar(&version, "version", false, "show open-snell version")
 
@@ -103,7 +182,26 @@ func parseConfig() (*Config, error) {
 		obfsHost = sec.Key("obfs-host").String()
 		psk = sec.Key("psk").String()
 		snellVer = sec.Key("version").String()
+		clientID = sec.Key("client-id").String()
+		password = sec.Key("client-password").String()
+		mptcp = sec.Key("mptcp").MustBool(false)
+		resumption = sec.Key("resumption").MustBool(false)
+		fastReply = sec.Key("fast-reply").MustBool(false)
+		datagram = sec.Key("datagram").MustBool(false)
+		mux = sec.Key("mux").MustBool(false)
+		if serverTCP, err = utils.ParseTCPOptions(cfg, "tcp.server"); err != nil {
+			return nil, err
+		}
 		verbose = sec.Key("verbose").MustBool(false)
+		if tunnels, err = parseReverseSections(cfg); err != nil {
+			return nil, err
+		}
+	} else if reverse != "" {
+		t, err := parseReverse(reverse)
+		if err != nil {
+			return nil, err
+		}
+		tunnels = append(tunnels, t)
 	}
 
 	if serverAddr == "" {
@@ -130,10 +228,33 @@ func parseConfig() (*Config, error) {
 		ObfsHost:   obfsHost,
 		PSK:        psk,
 		SnellVer:   snellVer,
+		ClientID:   clientID,
+		Password:   password,
+		MPTCP:      mptcp,
+		Resumption: resumption,
+		FastReply:  fastReply,
+		Datagram:   datagram,
+		Mux:        mux,
+		ServerTCP:  serverTCP,
 		Verbose:    verbose,
+		Reverse:    tunnels,
+
+		Speedtest:         speedtest,
+		SpeedtestDuration: time.Duration(duration) * time.Second,
 	}, nil
 }
 
+func runSpeedtest(sn *snell.SnellClient, cfg *Config) {
+	fmt.Printf("Testing %s for %v in each direction...\n", cfg.ServerAddr, cfg.SpeedtestDuration)
+	res, err := sn.Speedtest(context.Background(), cfg.SpeedtestDuration)
+	if err != nil {
+		log.Fatalf("Speedtest failed: %v\n", err)
+	}
+	fmt.Printf("RTT:      %.2f ms\n", float64(res.RTT)/float64(time.Millisecond))
+	fmt.Printf("Upload:   %.2f Mbit/s\n", res.Upload*8/1e6)
+	fmt.Printf("Download: %.2f Mbit/s\n", res.Download*8/1e6)
+}
+
 func main() {
 	defer log.Flush()
 
@@ -143,21 +264,51 @@ func main() {
 	}
 	initLogging(cfg.Verbose)
 
-	sn, err := snell.NewSnellClient(
-		cfg.ListenAddr,
+	listenAddr := cfg.ListenAddr
+	if cfg.Speedtest {
+		listenAddr = ""
+	}
+	sn, err := snell.NewSnellClientWithOptions(
+		listenAddr,
 		cfg.ServerAddr,
 		cfg.ObfsType,
 		cfg.ObfsHost,
 		cfg.PSK,
 		cfg.SnellVer == "2",
+		&snell.ClientOptions{
+			ClientID:     cfg.ClientID,
+			Password:     cfg.Password,
+			MultipathTCP: cfg.MPTCP,
+			ServerTCP:    cfg.ServerTCP,
+			Resumption:   cfg.Resumption,
+			FastReply:    cfg.FastReply,
+			Datagram:     cfg.Datagram,
+			Mux:          cfg.Mux,
+		},
 	)
 	if err != nil {
 		log.Fatalf("Failed to initialize snell client %v\n", err)
 	}
 
+	if cfg.Speedtest {
+		runSpeedtest(sn, cfg)
+		sn.Close()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, t := range cfg.Reverse {
+		go func() {
+			if err := sn.Reverse(ctx, t.Port, t.Local); err != nil && ctx.Err() == nil {
+				log.Errorf("Reverse tunnel of port %d stopped: %v\n", t.Port, err)
+			}
+		}()
+	}
+
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	<-sigCh
 
+	cancel()
 	sn.Close()
 }
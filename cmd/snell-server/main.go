@@ -15,16 +15,28 @@
 package main
 
 import (
+	"context"
+	_ "expvar"
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	log "github.com/golang/glog"
 	"gopkg.in/ini.v1"
 
+	"github.com/icpz/open-snell/components/aead"
+	"github.com/icpz/open-snell/components/dns"
+	"github.com/icpz/open-snell/components/outbound"
+	"github.com/icpz/open-snell/components/rules"
+	"github.com/icpz/open-snell/components/sip003"
 	"github.com/icpz/open-snell/components/snell"
+	"github.com/icpz/open-snell/components/utils"
 	"github.com/icpz/open-snell/constants"
 )
 
@@ -33,6 +45,12 @@ type Config struct {
 	ObfsType   string
 	PSK        string
 	Verbose    bool
+	Metrics    string
+	// Plugin, if set, is a SIP003 plugin listening at ListenAddr in
+	// front of the server, which then listens on loopback.
+	Plugin     string
+	PluginOpts string
+	Options    snell.ServerOptions
 }
 
 func initLogging(verbose bool) {
@@ -50,6 +68,276 @@ func initLogging(verbose bool) {
 	}
 }
 
+func parseBindOptions(sec *ini.Section) (*outbound.BindOptions, error) {
+	var err error
+	o := &outbound.BindOptions{
+		Interface:  sec.Key("bind-interface").String(),
+		Mark:       sec.Key("fwmark").MustInt(0),
+		PrefixMode: sec.Key("bind-ipv6-prefix-mode").MustString(outbound.PrefixModeRandom),
+	}
+	if o.Addresses, err = outbound.ParseBindAddresses(sec.Key("bind-address").String()); err != nil {
+		return nil, err
+	}
+	if prefix := sec.Key("bind-ipv6-prefix").String(); prefix != "" {
+		if o.IPv6Prefix, err = outbound.ParseIPv6Prefix(prefix); err != nil {
+			return nil, fmt.Errorf("invalid bind-ipv6-prefix %s, %v", prefix, err)
+		}
+	}
+	return o, nil
+}
+
+// parseUpstreams loads every [upstream.<name>] section, "direct" is
+// reserved for dialing targets from this host.
+func parseUpstreams(cfg *ini.File) (map[string]outbound.Outbound, error) {
+	upstreams := map[string]outbound.Outbound{
+		"direct": &outbound.Direct{},
+	}
+	for _, sec := range cfg.Sections() {
+		name, ok := strings.CutPrefix(sec.Name(), "upstream.")
+		if !ok || name == "" {
+			continue
+		}
+		if _, ok := upstreams[name]; ok {
+			return nil, fmt.Errorf("duplicated upstream %s", name)
+		}
+
+		server := sec.Key("server").String()
+		if server == "" {
+			return nil, fmt.Errorf("upstream %s: missing server", name)
+		}
+		username := sec.Key("username").String()
+		password := sec.Key("password").String()
+
+		switch typ := sec.Key("type").String(); typ {
+		case "socks5":
+			upstreams[name] = outbound.NewSocks5(server, username, password)
+		case "http":
+			upstreams[name] = outbound.NewHTTP(server, username, password)
+		case "snell":
+			obfsType := sec.Key("obfs").String()
+			if obfsType == "none" || obfsType == "off" {
+				obfsType = ""
+			}
+			u, err := snell.NewUpstream(
+				server,
+				obfsType,
+				sec.Key("obfs-host").String(),
+				sec.Key("psk").String(),
+				sec.Key("client-id").String(),
+				sec.Key("version").MustString("2") == "2",
+			)
+			if err != nil {
+				return nil, fmt.Errorf("upstream %s: %v", name, err)
+			}
+			u.Password = sec.Key("client-password").String()
+			u.Datagram = sec.Key("datagram").MustBool(false)
+			u.Mux = sec.Key("mux").MustBool(false)
+			upstreams[name] = u
+		default:
+			return nil, fmt.Errorf("upstream %s: invalid type %s", name, typ)
+		}
+	}
+	return upstreams, nil
+}
+
+func lookupUpstream(upstreams map[string]outbound.Outbound, sec *ini.Section) (outbound.Outbound, error) {
+	name := sec.Key("upstream").String()
+	if name == "" {
+		return nil, nil
+	}
+	u, ok := upstreams[name]
+	if !ok {
+		return nil, fmt.Errorf("upstream %s not found", name)
+	}
+	return u, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// parseHosts loads the static [hosts] section, each key is a domain name
+// mapped to a comma separated list of addresses.
+func parseHosts(cfg *ini.File) (map[string][]net.IP, error) {
+	hosts := make(map[string][]net.IP)
+	sec, err := cfg.GetSection("hosts")
+	if err != nil {
+		return hosts, nil
+	}
+	for _, key := range sec.Keys() {
+		var ips []net.IP
+		for _, f := range splitList(key.String()) {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, fmt.Errorf("hosts %s: invalid address %s", key.Name(), f)
+			}
+			ips = append(ips, ip)
+		}
+		hosts[key.Name()] = ips
+	}
+	return hosts, nil
+}
+
+func newResolver(sec *ini.Section, servers string, hosts map[string][]net.IP) (*dns.Resolver, error) {
+	return dns.New(dns.Options{
+		Servers:     splitList(servers),
+		Hosts:       hosts,
+		CacheSize:   sec.Key("dns-cache-size").MustInt(0),
+		NegativeTTL: time.Duration(sec.Key("dns-negative-ttl").MustInt(0)) * time.Second,
+	})
+}
+
+// parseResolvers loads the default resolver from the "dns" key of the
+// main section and every named [resolver.<name>] section.
+func parseResolvers(cfg *ini.File, main *ini.Section) (*dns.Resolver, map[string]outbound.Resolver, error) {
+	hosts, err := parseHosts(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	def, err := newResolver(main, main.Key("dns").String(), hosts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resolvers := make(map[string]outbound.Resolver)
+	for _, sec := range cfg.Sections() {
+		name, ok := strings.CutPrefix(sec.Name(), "resolver.")
+		if !ok || name == "" {
+			continue
+		}
+		r, err := newResolver(sec, sec.Key("servers").String(), hosts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("resolver %s: %v", name, err)
+		}
+		resolvers[name] = r
+	}
+	return def, resolvers, nil
+}
+
+// parseUsers loads every [user.<name>] section, the name is matched
+// against the client id sent by snell clients.
+func parseUsers(cfg *ini.File, upstreams map[string]outbound.Outbound, resolvers map[string]outbound.Resolver) ([]*snell.User, error) {
+	var users []*snell.User
+	for _, sec := range cfg.Sections() {
+		name, ok := strings.CutPrefix(sec.Name(), "user.")
+		if !ok || name == "" {
+			continue
+		}
+		u := &snell.User{Name: name}
+		if sec.HasKey("bind-address") || sec.HasKey("bind-interface") || sec.HasKey("fwmark") || sec.HasKey("bind-ipv6-prefix") {
+			bind, err := parseBindOptions(sec)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %v", name, err)
+			}
+			u.Bind = bind
+		}
+		upstream, err := lookupUpstream(upstreams, sec)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %v", name, err)
+		}
+		u.Upstream = upstream
+		if name := sec.Key("resolver").String(); name != "" {
+			if u.Resolver = resolvers[name]; u.Resolver == nil {
+				return nil, fmt.Errorf("user %s: resolver %s not found", u.Name, name)
+			}
+		}
+		if sec.HasKey("capabilities") {
+			caps, err := parseCapabilities(sec)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %v", name, err)
+			}
+			u.Capabilities = &caps
+		}
+		u.Password = sec.Key("password").String()
+		if u.ReversePorts, err = snell.ParsePortRanges(sec.Key("reverse-ports").String()); err != nil {
+			return nil, fmt.Errorf("user %s: %v", name, err)
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+// parseShadowsocks loads the [shadowsocks] section, returns nil if absent.
+func parseShadowsocks(cfg *ini.File) *snell.ShadowsocksOptions {
+	sec, err := cfg.GetSection("shadowsocks")
+	if err != nil {
+		return nil
+	}
+	return &snell.ShadowsocksOptions{
+		Listen:   sec.Key("listen").String(),
+		Method:   sec.Key("method").MustString(aead.MethodChacha20Poly1305),
+		Password: sec.Key("password").String(),
+	}
+}
+
+// parseCapabilities reads the capabilities key, 0 is returned if unset.
+func parseCapabilities(sec *ini.Section) (snell.Capability, error) {
+	if !sec.HasKey("capabilities") {
+		return 0, nil
+	}
+	return snell.ParseCapabilities(sec.Key("capabilities").String())
+}
+
+// sectionLines returns the rule lines of a raw section.
+func sectionLines(cfg *ini.File, name string) []string {
+	var lines []string
+	sec, err := cfg.GetSection(name)
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(sec.Body(), "\n") {
+		if line = rules.ParseLine(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// parseRewriter loads the raw [rewrite] section, returns nil if empty.
+func parseRewriter(cfg *ini.File) (*rules.Rewriter, error) {
+	lines := sectionLines(cfg, "rewrite")
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	return rules.NewRewriter(lines)
+}
+
+// parseRouter loads the raw [rules] section, the rules-file and
+// geoip-database keys of the main section and every [rule-set.<name>]
+// section, returns nil if no rule is configured.
+func parseRouter(cfg *ini.File, main *ini.Section, upstreams map[string]outbound.Outbound) (*rules.Router, error) {
+	rc := rules.Config{
+		RulesFile:     main.Key("rules-file").String(),
+		RuleSets:      make(map[string]string),
+		GeoIPDatabase: main.Key("geoip-database").String(),
+	}
+	rc.Rules = sectionLines(cfg, "rules")
+	if len(rc.Rules) == 0 && rc.RulesFile == "" {
+		return nil, nil
+	}
+	for _, sec := range cfg.Sections() {
+		name, ok := strings.CutPrefix(sec.Name(), "rule-set.")
+		if !ok || name == "" {
+			continue
+		}
+		path := sec.Key("path").String()
+		if path == "" {
+			return nil, fmt.Errorf("rule-set %s: missing path", name)
+		}
+		rc.RuleSets[name] = path
+	}
+	for name := range upstreams {
+		rc.Actions = append(rc.Actions, name)
+	}
+	return rules.NewRouter(rc)
+}
+
 func parseConfig() (*Config, error) {
 	var (
 		configFile string
@@ -57,13 +345,19 @@ func parseConfig() (*Config, error) {
 		obfsType   string
 		psk        string
 		verbose    bool
+		metrics    string
+		plugin     string
+		pluginOpts string
 		version    bool
+		options    = snell.ServerOptions{FastOpenQueue: snell.DefaultFastOpenQueue}
 	)
 
 	flag.StringVar(&configFile, "c", "", "configuration file path")
 	flag.StringVar(&listenAddr, "l", "0.0.0.0:18888", "server listen address")
 	flag.StringVar(&obfsType, "obfs", "", "obfs type")
 	flag.StringVar(&psk, "k", "", "pre-shared key")
+	flag.StringVar(&plugin, "plugin", "", "SIP003 plugin listening in front of the server")
+	flag.StringVar(&pluginOpts, "plugin-opts", "", "SIP003 plugin options")
 	flag.BoolVar(&verbose, "verbose", false, "enable verbose logs (equivalent to -v=1 for glog)")
 	flag.BoolVar(&version, "version", false, "show open-snell version")
 
@@ -80,7 +374,7 @@ func parseConfig() (*Config, error) {
 
 	if configFile != "" {
 		log.Infof("Configuration file specified, ignoring other flags\n")
-		cfg, err := ini.Load(configFile)
+		cfg, err := ini.LoadSources(ini.LoadOptions{UnparseableSections: []string{"rules", "rewrite"}}, configFile)
 		if err != nil {
 			return nil, fmt.Errorf("failed to load config file %s, %v", configFile, err)
 		}
@@ -93,17 +387,95 @@ func parseConfig() (*Config, error) {
 		obfsType = sec.Key("obfs").String()
 		psk = sec.Key("psk").String()
 		verbose = sec.Key("verbose").MustBool(false)
+
+		bind, err := parseBindOptions(sec)
+		if err != nil {
+			return nil, err
+		}
+		options.Bind = *bind
+		options.Strategy = outbound.DialStrategy{
+			Mode:  sec.Key("dial-strategy").String(),
+			Delay: time.Duration(sec.Key("happy-eyeballs-delay").MustInt(0)) * time.Millisecond,
+		}
+		options.DialTimeout = time.Duration(sec.Key("dial-timeout").MustInt(0)) * time.Second
+		options.FastOpenQueue = sec.Key("fastopen-queue").MustInt(snell.DefaultFastOpenQueue)
+		options.FastOpen = sec.Key("fastopen-outbound").MustBool(false)
+		options.MultipathTCP = sec.Key("mptcp").MustBool(false)
+		options.MultipathTCPOutbound = sec.Key("mptcp-outbound").MustBool(false)
+		options.Sniff = sec.Key("sniff").MustBool(false)
+		options.SniffTimeout = time.Duration(sec.Key("sniff-timeout").MustInt(0)) * time.Millisecond
+		options.SniffOverride = sec.Key("sniff-override").MustBool(false)
+		options.Speedtest = sec.Key("speedtest").MustBool(false)
+		options.Datagram = sec.Key("datagram").MustBool(false)
+		if options.Capabilities, err = parseCapabilities(sec); err != nil {
+			return nil, err
+		}
+		if options.Capabilities == 0 && sec.HasKey("capabilities") {
+			return nil, fmt.Errorf("no capability allowed")
+		}
+		metrics = sec.Key("metrics").String()
+		plugin = sec.Key("plugin").String()
+		pluginOpts = sec.Key("plugin-opts").String()
+		if sec.Key("resumption").MustBool(false) {
+			options.TicketLifetime = time.Duration(sec.Key("ticket-lifetime").MustInt(int(snell.DefaultTicketLifetime/time.Second))) * time.Second
+		}
+		if options.ClientTCP, err = utils.ParseTCPOptions(cfg, "tcp.client"); err != nil {
+			return nil, err
+		}
+		if options.TargetTCP, err = utils.ParseTCPOptions(cfg, "tcp.target"); err != nil {
+			return nil, err
+		}
+		upstreams, err := parseUpstreams(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if options.Upstream, err = lookupUpstream(upstreams, sec); err != nil {
+			return nil, err
+		}
+		if options.Router, err = parseRouter(cfg, sec, upstreams); err != nil {
+			return nil, err
+		}
+		options.Upstreams = upstreams
+		if options.Rewriter, err = parseRewriter(cfg); err != nil {
+			return nil, err
+		}
+		resolver, resolvers, err := parseResolvers(cfg, sec)
+		if err != nil {
+			return nil, err
+		}
+		options.Resolver = resolver
+		if options.Users, err = parseUsers(cfg, upstreams, resolvers); err != nil {
+			return nil, err
+		}
+		options.Shadowsocks = parseShadowsocks(cfg)
+		options.SocksListen = sec.Key("socks-listen").String()
+		options.HTTPListen = sec.Key("http-listen").String()
+		options.ReverseAddress = sec.Key("reverse-address").String()
+		options.UDP = snell.UDPOptions{
+			Filter:          sec.Key("udp-filter").String(),
+			MaxDestinations: sec.Key("udp-max-destinations").MustInt(0),
+			PacketRate:      sec.Key("udp-packet-rate").MustInt(0),
+			Timeout:         time.Duration(sec.Key("udp-timeout").MustInt(0)) * time.Second,
+		}
 	}
 
 	if obfsType == "none" || obfsType == "off" {
 		obfsType = ""
 	}
+	/* the server listens on loopback behind a plugin, which carries TCP only */
+	if plugin != "" && options.Datagram {
+		return nil, fmt.Errorf("datagram can not be used with a plugin")
+	}
 
 	return &Config{
 		ListenAddr: listenAddr,
 		ObfsType:   obfsType,
 		PSK:        psk,
 		Verbose:    verbose,
+		Metrics:    metrics,
+		Plugin:     plugin,
+		PluginOpts: pluginOpts,
+		Options:    options,
 	}, nil
 }
 
@@ -116,14 +488,55 @@ func main() {
 	}
 	initLogging(cfg.Verbose)
 
-	sn, err := snell.NewSnellServer(cfg.ListenAddr, cfg.PSK, cfg.ObfsType)
+	listenAddr := cfg.ListenAddr
+	if cfg.Plugin != "" {
+		listenAddr = "127.0.0.1:0"
+	}
+	sn, err := snell.NewSnellServerWithOptions(listenAddr, cfg.PSK, cfg.ObfsType, &cfg.Options)
 	if err != nil {
 		log.Fatalf("Failed to initialize snell server %v\n", err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	pluginDone := make(chan struct{})
+	if cfg.Plugin != "" {
+		p := &sip003.Plugin{Path: cfg.Plugin, Options: cfg.PluginOpts, Remote: cfg.ListenAddr, Local: sn.Addr().String()}
+		go func() {
+			defer close(pluginDone)
+			if err := p.Run(ctx); err != nil && ctx.Err() == nil {
+				log.Fatalf("Failed to run plugin %s: %v\n", cfg.Plugin, err)
+			}
+		}()
+	} else {
+		close(pluginDone)
+	}
+
+	if cfg.Metrics != "" {
+		go func() {
+			log.Infof("metrics listening at: %s\n", cfg.Metrics)
+			if err := http.ListenAndServe(cfg.Metrics, nil); err != nil {
+				log.Errorf("Failed to serve metrics: %v\n", err)
+			}
+		}()
+	}
+
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigCh {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if cfg.Options.Router == nil {
+			continue
+		}
+		if err := cfg.Options.Router.Reload(); err != nil {
+			log.Errorf("Failed to reload rules, keeping the previous ones: %v\n", err)
+		} else {
+			log.Infof("Rules reloaded\n")
+		}
+	}
 
+	cancel()
+	<-pluginDone
 	sn.Close()
 }
@@ -17,6 +17,8 @@ package aead
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
 
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/chacha20poly1305"
@@ -33,21 +35,44 @@ type snellCipher struct {
 	psk      []byte
 	keySize  int
 	makeAEAD func(key []byte) (cipher.AEAD, error)
+	// kdf derives the session key, snellKDF if nil
+	kdf func(psk, salt []byte, keySize int) []byte
 }
 
 func (sc *snellCipher) KeySize() int  { return sc.keySize }
 func (sc *snellCipher) SaltSize() int { return 16 }
 func (sc *snellCipher) Encrypter(salt []byte) (cipher.AEAD, error) {
-	return sc.makeAEAD(snellKDF(sc.psk, salt, sc.KeySize()))
+	return sc.makeAEAD(sc.key(salt))
 }
 func (sc *snellCipher) Decrypter(salt []byte) (cipher.AEAD, error) {
-	return sc.makeAEAD(snellKDF(sc.psk, salt, sc.KeySize()))
+	return sc.makeAEAD(sc.key(salt))
+}
+
+func (sc *snellCipher) key(salt []byte) []byte {
+	if sc.kdf != nil {
+		return sc.kdf(sc.psk, salt, sc.keySize)
+	}
+	return snellKDF(sc.psk, salt, sc.keySize)
 }
 
 func snellKDF(psk, salt []byte, keySize int) []byte {
 	return argon2.IDKey(psk, salt, 3, 8, 1, 32)[:keySize]
 }
 
+func resumptionKDF(secret, salt []byte, keySize int) []byte {
+	key, _ := hkdf.Key(sha256.New, secret, salt, "snell resumption", keySize)
+	return key
+}
+
+// Resumed returns a cipher of the same algorithm as c keyed by a
+// resumption secret, keys are derived with HKDF instead of Argon2.
+func Resumed(c Cipher, secret []byte) Cipher {
+	sc := *c.(*snellCipher)
+	sc.psk = secret
+	sc.kdf = resumptionKDF
+	return &sc
+}
+
 func aesGCM(key []byte) (cipher.AEAD, error) {
 	blk, err := aes.NewCipher(key)
 	if err != nil {
@@ -0,0 +1,57 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import "sync"
+
+// DefaultReplayFilterSize is the number of salts remembered by each of
+// the two generations of a ReplayFilter.
+const DefaultReplayFilterSize = 1 << 16
+
+// ReplayFilter remembers recent salts to reject replayed connections. It
+// keeps two generations of at most size salts, the older one is dropped
+// once the newer is full, so between size and 2*size salts are known.
+type ReplayFilter struct {
+	mu        sync.Mutex
+	size      int
+	cur, prev map[string]struct{}
+}
+
+// NewReplayFilter returns a filter with generations of size salts, 0
+// means DefaultReplayFilterSize.
+func NewReplayFilter(size int) *ReplayFilter {
+	if size <= 0 {
+		size = DefaultReplayFilterSize
+	}
+	return &ReplayFilter{size: size, cur: make(map[string]struct{})}
+}
+
+// Add records salt, it reports false if salt was seen before.
+func (f *ReplayFilter) Add(salt []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := string(salt)
+	if _, ok := f.cur[key]; ok {
+		return false
+	}
+	if _, ok := f.prev[key]; ok {
+		return false
+	}
+	if len(f.cur) >= f.size {
+		f.prev, f.cur = f.cur, make(map[string]struct{}, f.size)
+	}
+	f.cur[key] = struct{}{}
+	return true
+}
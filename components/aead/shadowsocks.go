@@ -0,0 +1,158 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Shadowsocks AEAD methods
+const (
+	MethodAES128GCM        = "aes-128-gcm"
+	MethodAES256GCM        = "aes-256-gcm"
+	MethodChacha20Poly1305 = "chacha20-ietf-poly1305"
+)
+
+var (
+	ErrNoCipher = errors.New("no cipher authenticates the data")
+	// ErrReplay is returned for a connection reusing a known salt, it
+	// wraps ErrNoCipher so that it is handled the same way.
+	ErrReplay = fmt.Errorf("%w: salt replayed", ErrNoCipher)
+)
+
+// ssCipher derives per-salt subkeys from a master key with HKDF-SHA1, as
+// specified by Shadowsocks AEAD. Salts are as long as the key.
+type ssCipher struct {
+	key      []byte
+	makeAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func (sc *ssCipher) KeySize() int  { return len(sc.key) }
+func (sc *ssCipher) SaltSize() int { return len(sc.key) }
+func (sc *ssCipher) Encrypter(salt []byte) (cipher.AEAD, error) {
+	return sc.makeAEAD(sc.subkey(salt))
+}
+func (sc *ssCipher) Decrypter(salt []byte) (cipher.AEAD, error) {
+	return sc.makeAEAD(sc.subkey(salt))
+}
+
+func (sc *ssCipher) subkey(salt []byte) []byte {
+	key, _ := hkdf.Key(sha1.New, sc.key, salt, "ss-subkey", len(sc.key))
+	return key
+}
+
+// NewShadowsocks returns the cipher of a Shadowsocks AEAD method, keyed
+// by password.
+func NewShadowsocks(method, password string) (Cipher, error) {
+	switch method {
+	case MethodAES128GCM:
+		return &ssCipher{key: passwordKey(password, 16), makeAEAD: aesGCM}, nil
+	case MethodAES256GCM:
+		return &ssCipher{key: passwordKey(password, 32), makeAEAD: aesGCM}, nil
+	case MethodChacha20Poly1305:
+		return &ssCipher{key: passwordKey(password, 32), makeAEAD: chacha20poly1305.New}, nil
+	}
+	return nil, fmt.Errorf("unsupported shadowsocks method %s", method)
+}
+
+// passwordKey is OpenSSL EVP_BytesToKey with MD5 and no salt.
+func passwordKey(password string, keySize int) []byte {
+	var key, prev []byte
+	for len(key) < keySize {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keySize]
+}
+
+// Accept reads the salt and the first chunk of a client connection, and
+// returns the connection keyed by the first of ciphers authenticating it
+// along with its index. All ciphers must share the salt size. If filter
+// is not nil, authenticated salts are recorded in it and a salt seen
+// before fails with ErrReplay.
+func Accept(c net.Conn, ciphers []Cipher, filter *ReplayFilter) (net.Conn, int, error) {
+	if len(ciphers) == 0 {
+		return nil, -1, ErrNoCipher
+	}
+	salt := make([]byte, ciphers[0].SaltSize())
+	if _, err := io.ReadFull(c, salt); err != nil {
+		return nil, -1, err
+	}
+	var head []byte
+	for i, ciph := range ciphers {
+		aead, err := ciph.Decrypter(salt)
+		if err != nil {
+			return nil, -1, err
+		}
+		if head == nil {
+			head = make([]byte, 2+aead.Overhead())
+			if _, err := io.ReadFull(c, head); err != nil {
+				return nil, -1, err
+			}
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := aead.Open(nil, nonce, head, nil); err != nil {
+			continue
+		}
+		if filter != nil && !filter.Add(salt) {
+			return nil, -1, ErrReplay
+		}
+		// the chunk is decrypted again by the reader
+		src := io.MultiReader(bytes.NewReader(head), c)
+		return &streamConn{Conn: c, Cipher: ciph, r: newReader(src, aead, nil)}, i, nil
+	}
+	return nil, -1, ErrNoCipher
+}
+
+// SealPacket appends the datagram b to dst, encrypted with a random salt
+// and a zero nonce.
+func SealPacket(dst []byte, c Cipher, b []byte) ([]byte, error) {
+	salt := make([]byte, c.SaltSize())
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := c.Encrypter(salt)
+	if err != nil {
+		return nil, err
+	}
+	dst = append(dst, salt...)
+	return aead.Seal(dst, make([]byte, aead.NonceSize()), b, nil), nil
+}
+
+// OpenPacket appends to dst the datagram sealed in pkt by SealPacket.
+func OpenPacket(dst []byte, c Cipher, pkt []byte) ([]byte, error) {
+	if len(pkt) < c.SaltSize() {
+		return nil, ErrNoCipher
+	}
+	aead, err := c.Decrypter(pkt[:c.SaltSize()])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(dst, make([]byte, aead.NonceSize()), pkt[c.SaltSize():], nil)
+}
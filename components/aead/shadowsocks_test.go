@@ -0,0 +1,119 @@
+package aead
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestShadowsocks_PasswordKey(t *testing.T) {
+	// the first block is md5("password")
+	key := passwordKey("password", 16)
+	if got := hex.EncodeToString(key); got != "5f4dcc3b5aa765d61d8327deb882cf99" {
+		t.Errorf("passwordKey = %s", got)
+	}
+	long := passwordKey("password", 32)
+	if !bytes.Equal(long[:16], key) || bytes.Equal(long[16:], key) {
+		t.Errorf("passwordKey 32 = %x", long)
+	}
+	if _, err := NewShadowsocks("rc4-md5", "password"); err == nil {
+		t.Error("stream cipher accepted")
+	}
+}
+
+func TestShadowsocks_Accept(t *testing.T) {
+	alice, _ := NewShadowsocks(MethodChacha20Poly1305, "alice")
+	bob, _ := NewShadowsocks(MethodChacha20Poly1305, "bob")
+
+	server, client := net.Pipe()
+	defer server.Close()
+	go func() {
+		c := NewConn(client, bob)
+		c.Write([]byte("hello"))
+		io.Copy(c, c)
+	}()
+
+	c, idx, err := Accept(server, []Cipher{alice, bob}, nil)
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	if idx != 1 {
+		t.Errorf("Accept index = %d, want 1", idx)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("Read = %q, %v", buf, err)
+	}
+	c.Write([]byte("echo"))
+	if _, err := io.ReadFull(c, buf[:4]); err != nil || string(buf[:4]) != "echo" {
+		t.Errorf("echo = %q, %v", buf[:4], err)
+	}
+}
+
+func TestShadowsocks_Replay(t *testing.T) {
+	alice, _ := NewShadowsocks(MethodChacha20Poly1305, "alice")
+
+	/* salt, sealed length and sealed payload of the first flight */
+	server, client := net.Pipe()
+	go NewConn(client, alice).Write([]byte("hello"))
+	flight := make([]byte, alice.SaltSize()+2+16+5+16)
+	if _, err := io.ReadFull(server, flight); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	server.Close()
+
+	filter := NewReplayFilter(0)
+	for i, want := range []error{nil, ErrReplay} {
+		server, client := net.Pipe()
+		go client.Write(flight)
+		_, _, err := Accept(server, []Cipher{alice}, filter)
+		if !errors.Is(err, want) {
+			t.Errorf("Accept #%d = %v, want %v", i, err, want)
+		}
+		if i > 0 && !errors.Is(err, ErrNoCipher) {
+			t.Errorf("replay error %v does not wrap ErrNoCipher", err)
+		}
+		server.Close()
+		client.Close()
+	}
+}
+
+func TestReplayFilter_Generations(t *testing.T) {
+	f := NewReplayFilter(2)
+	for _, salt := range []string{"a", "b", "c"} {
+		if !f.Add([]byte(salt)) {
+			t.Fatalf("fresh salt %s rejected", salt)
+		}
+	}
+	/* "a" and "b" are in the previous generation */
+	if f.Add([]byte("a")) || f.Add([]byte("c")) {
+		t.Error("known salt accepted")
+	}
+	f.Add([]byte("d"))
+	f.Add([]byte("e"))
+	if !f.Add([]byte("a")) {
+		t.Error("salt of a dropped generation rejected")
+	}
+}
+
+func TestShadowsocks_Packet(t *testing.T) {
+	ciph, _ := NewShadowsocks(MethodAES256GCM, "secret")
+	pkt, err := SealPacket(nil, ciph, []byte("datagram"))
+	if err != nil {
+		t.Fatalf("SealPacket failed: %v", err)
+	}
+	if len(pkt) != 32+len("datagram")+16 {
+		t.Errorf("packet size = %d", len(pkt))
+	}
+	b, err := OpenPacket(nil, ciph, pkt)
+	if err != nil || !bytes.Equal(b, []byte("datagram")) {
+		t.Errorf("OpenPacket = %q, %v", b, err)
+	}
+	other, _ := NewShadowsocks(MethodAES256GCM, "other")
+	if _, err := OpenPacket(nil, other, pkt); err == nil {
+		t.Error("packet opened with another key")
+	}
+}
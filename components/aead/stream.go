@@ -258,6 +258,16 @@ type streamConn struct {
 	r        *reader
 	w        *writer
 	fallback Cipher
+	// tickets, on the server, accepts resumed connections
+	tickets *TicketKeys
+	// ticket, on a resumed client connection, is sent in place of the salt
+	ticket  []byte
+	resumed bool
+	// switched is set once the fallback cipher is in use
+	switched bool
+	// salt starts the written stream, peerSalt the read one
+	salt     []byte
+	peerSalt []byte
 }
 
 func (c *streamConn) initReader() error {
@@ -265,20 +275,106 @@ func (c *streamConn) initReader() error {
 	if _, err := io.ReadFull(c.Conn, salt); err != nil {
 		return err
 	}
+
+	var src io.Reader = c.Conn
+	if c.tickets != nil {
+		/* the tag follows the prefix in the place of the first record */
+		ticket := make([]byte, ticketHeadSize, ticketSealedSize)
+		copy(ticket, salt)
+		if _, err := io.ReadFull(c.Conn, ticket[len(salt):]); err != nil {
+			return err
+		}
+		if c.tickets.hasKey(ticket) {
+			ticket = ticket[:ticketSealedSize]
+			if _, err := io.ReadFull(c.Conn, ticket[ticketHeadSize:]); err != nil {
+				return err
+			}
+			if err := c.resume(ticket); err == nil {
+				return nil
+			}
+		}
+		// a plain salt, or one colliding with a tag, replay what was read
+		src = io.MultiReader(bytes.NewReader(ticket[len(salt):]), c.Conn)
+	}
+
 	aead, err := c.Decrypter(salt)
 	if err != nil {
 		return err
 	}
+	c.peerSalt = salt
 
 	var fallback cipher.AEAD = nil
 	if c.fallback != nil {
 		fallback, _ = c.fallback.Decrypter(salt)
 	}
 
-	c.r = newReader(c.Conn, aead, fallback)
+	c.r = newReader(src, aead, fallback)
 	return nil
 }
 
+// resume switches a server connection to the cipher keyed by the sealed
+// part of a ticket, reading the padding that follows.
+func (c *streamConn) resume(ticket []byte) error {
+	secret, keySize, padding, err := c.tickets.open(ticket)
+	if err != nil {
+		return err
+	}
+	ticket = append(ticket, make([]byte, padding)...)
+	if _, err := io.ReadFull(c.Conn, ticket[ticketSealedSize:]); err != nil {
+		return err
+	}
+	base := c.Cipher
+	switched := false
+	if base.KeySize() != keySize && c.fallback != nil && c.fallback.KeySize() == keySize {
+		base, switched = c.fallback, true
+	}
+	if base.KeySize() != keySize {
+		return errTicketInvalid
+	}
+	c.switched = switched
+	c.Cipher = Resumed(base, secret)
+	c.fallback = nil
+	c.resumed = true
+
+	aead, err := c.Decrypter(ticket)
+	if err != nil {
+		return err
+	}
+	c.peerSalt = ticket
+	c.r = newReader(c.Conn, aead, nil)
+	return nil
+}
+
+// Resumed reports whether the connection skipped the key derivation with
+// a resumption ticket.
+func (c *streamConn) Resumed() bool { return c.resumed }
+
+// FallbackUsed reports whether the peer turned out to use the fallback
+// cipher, known once the first record is read.
+func (c *streamConn) FallbackUsed() bool { return c.switched }
+
+// Salt returns the salt starting the written stream, picked on first use,
+// or the ticket of a resumed client connection. Being unique to the
+// connection, it lets peers bind credentials to it.
+func (c *streamConn) Salt() ([]byte, error) {
+	if c.salt == nil {
+		if c.ticket != nil {
+			c.salt = c.ticket
+		} else {
+			salt := make([]byte, c.SaltSize())
+			if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+				return nil, err
+			}
+			c.salt = salt
+		}
+	}
+	return c.salt, nil
+}
+
+// PeerSalt returns the salt, or ticket, starting the read stream, nil
+// until the first read.
+func (c *streamConn) PeerSalt() []byte { return c.peerSalt }
+
 func (c *streamConn) Read(b []byte) (int, error) {
 	if c.r == nil {
 		if err := c.initReader(); err != nil {
@@ -288,6 +384,7 @@ func (c *streamConn) Read(b []byte) (int, error) {
 		if c.r.switched { // cipher switched
 			c.Cipher = c.fallback
 			c.fallback = nil
+			c.switched = true
 		}
 		return n, err
 	}
@@ -303,15 +400,27 @@ func (c *streamConn) WriteTo(w io.Writer) (int64, error) {
 		if c.r.switched { // cipher switched
 			c.Cipher = c.fallback
 			c.fallback = nil
+			c.switched = true
 		}
 		return n, err
 	}
 	return c.r.WriteTo(w)
 }
 
+// Buffered returns the number of decrypted bytes that can be read without
+// blocking on the underlying connection.
+func (c *streamConn) Buffered() int {
+	if c.r == nil {
+		return 0
+	}
+	c.r.mux.Lock()
+	defer c.r.mux.Unlock()
+	return len(c.r.leftover)
+}
+
 func (c *streamConn) initWriter() error {
-	salt := make([]byte, c.SaltSize())
-	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+	salt, err := c.Salt()
+	if err != nil {
 		return err
 	}
 	aead, err := c.Encrypter(salt)
@@ -354,3 +463,25 @@ func NewConnWithFallback(c net.Conn, ciph, fallback Cipher) net.Conn {
 		fallback: fallback,
 	}
 }
+
+// NewConnWithTickets is NewConnWithFallback also accepting connections
+// resumed with tickets issued by keys.
+func NewConnWithTickets(c net.Conn, ciph, fallback Cipher, keys *TicketKeys) net.Conn {
+	return &streamConn{
+		Conn:     c,
+		Cipher:   ciph,
+		fallback: fallback,
+		tickets:  keys,
+	}
+}
+
+// NewResumedConn wraps a client connection resumed with a ticket, its keys
+// are derived from the resumption secret.
+func NewResumedConn(c net.Conn, ciph Cipher, ticket, secret []byte) net.Conn {
+	return &streamConn{
+		Conn:    c,
+		Cipher:  Resumed(ciph, secret),
+		ticket:  ticket,
+		resumed: true,
+	}
+}
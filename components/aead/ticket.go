@@ -0,0 +1,205 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const (
+	// ticketPrefixSize random bytes start a ticket, taking the place of
+	// the salt, the first ticketNonceSize of them are the sealing nonce
+	ticketPrefixSize = 16
+	ticketNonceSize  = 12
+	// ticketTagSize bytes of a keyed hash of the prefix tell the key
+	ticketTagSize    = 4
+	ticketHeadSize   = ticketPrefixSize + ticketTagSize
+	ticketSecretSize = 32
+	// secret, expiry, key size of the resumed cipher and padding length
+	ticketPlainSize  = ticketSecretSize + 8 + 1 + 1
+	ticketSealedSize = ticketHeadSize + ticketPlainSize + 16
+	maxTicketPadding = 64
+
+	// MinTicketSize and MaxTicketSize bound the length of a ticket, which
+	// is padded to a random length so that resumed connections do not
+	// share a first flight size.
+	MinTicketSize = ticketSealedSize
+	MaxTicketSize = ticketSealedSize + maxTicketPadding
+)
+
+type ticketKey struct {
+	// blind keys the tag which identifies the key without revealing it
+	blind []byte
+	aead  cipher.AEAD
+}
+
+// tag computes the tag of the ticket prefix for the key.
+func (key *ticketKey) tag(prefix []byte) []byte {
+	h := hmac.New(sha256.New, key.blind)
+	h.Write(prefix[:ticketPrefixSize])
+	return h.Sum(nil)[:ticketTagSize]
+}
+
+// TicketKeys seals and opens session resumption tickets. Keys rotate
+// every lifetime and the previous key is kept for one more lifetime, so
+// that every ticket stays valid until it expires. Tickets are single use.
+type TicketKeys struct {
+	lifetime time.Duration
+
+	mu      sync.Mutex
+	keys    []*ticketKey // current key first
+	rotated time.Time
+	// used maps the nonces of redeemed tickets to their expiry
+	used map[string]time.Time
+}
+
+func NewTicketKeys(lifetime time.Duration) *TicketKeys {
+	return &TicketKeys{
+		lifetime: lifetime,
+		used:     make(map[string]time.Time),
+	}
+}
+
+func (k *TicketKeys) Lifetime() time.Duration { return k.lifetime }
+
+// rotate adds a new key when the current one is older than the lifetime
+// and purges expired replay entries, k.mu must be held.
+func (k *TicketKeys) rotate(now time.Time) error {
+	if len(k.keys) > 0 && now.Sub(k.rotated) < k.lifetime {
+		return nil
+	}
+	key := &ticketKey{blind: make([]byte, 32)}
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	if _, err := rand.Read(key.blind); err != nil {
+		return err
+	}
+	aead, err := aesGCM(secret)
+	if err != nil {
+		return err
+	}
+	key.aead = aead
+	k.keys = append([]*ticketKey{key}, k.keys...)
+	if len(k.keys) > 2 {
+		k.keys = k.keys[:2]
+	}
+	k.rotated = now
+
+	for nonce, expire := range k.used {
+		if now.After(expire) {
+			delete(k.used, nonce)
+		}
+	}
+	return nil
+}
+
+// Issue seals a new ticket along with the resumption secret it carries,
+// keySize selects the cipher of the resumed connection.
+func (k *TicketKeys) Issue(keySize int) (ticket, secret []byte, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	if err := k.rotate(now); err != nil {
+		return nil, nil, err
+	}
+	key := k.keys[0]
+
+	padding, err := rand.Int(rand.Reader, big.NewInt(maxTicketPadding+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	plain := make([]byte, ticketPlainSize)
+	if _, err := rand.Read(plain[:ticketSecretSize]); err != nil {
+		return nil, nil, err
+	}
+	binary.BigEndian.PutUint64(plain[ticketSecretSize:], uint64(now.Add(k.lifetime).Unix()))
+	plain[ticketPlainSize-2] = byte(keySize)
+	plain[ticketPlainSize-1] = byte(padding.Int64())
+
+	ticket = make([]byte, ticketPrefixSize, MaxTicketSize)
+	if _, err := rand.Read(ticket); err != nil {
+		return nil, nil, err
+	}
+	ticket = append(ticket, key.tag(ticket)...)
+	ticket = key.aead.Seal(ticket, ticket[:ticketNonceSize], plain, ticket[:ticketHeadSize])
+	pad := make([]byte, padding.Int64())
+	if _, err := rand.Read(pad); err != nil {
+		return nil, nil, err
+	}
+	return append(ticket, pad...), plain[:ticketSecretSize], nil
+}
+
+// hasKey reports whether head, the first ticketHeadSize bytes, may start
+// a ticket, that is, whether it carries the tag of a live key.
+func (k *TicketKeys) hasKey(head []byte) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.findKey(head) != nil
+}
+
+func (k *TicketKeys) findKey(head []byte) *ticketKey {
+	for _, key := range k.keys {
+		if hmac.Equal(head[ticketPrefixSize:ticketHeadSize], key.tag(head)) {
+			return key
+		}
+	}
+	return nil
+}
+
+var (
+	errTicketInvalid  = errors.New("invalid ticket")
+	errTicketExpired  = errors.New("ticket expired")
+	errTicketReplayed = errors.New("ticket replayed")
+)
+
+// open verifies the sealed part of a ticket, its first ticketSealedSize
+// bytes, and marks it used. It returns the resumption secret, the key size
+// of the resumed cipher and the length of the padding that follows.
+func (k *TicketKeys) open(ticket []byte) ([]byte, int, int, error) {
+	if len(ticket) < ticketSealedSize {
+		return nil, 0, 0, errTicketInvalid
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key := k.findKey(ticket)
+	if key == nil {
+		return nil, 0, 0, errTicketInvalid
+	}
+	nonce := ticket[:ticketNonceSize]
+	plain, err := key.aead.Open(nil, nonce, ticket[ticketHeadSize:ticketSealedSize], ticket[:ticketHeadSize])
+	if err != nil {
+		return nil, 0, 0, errTicketInvalid
+	}
+	expire := time.Unix(int64(binary.BigEndian.Uint64(plain[ticketSecretSize:])), 0)
+	if time.Now().After(expire) {
+		return nil, 0, 0, errTicketExpired
+	}
+	if _, ok := k.used[string(nonce)]; ok {
+		return nil, 0, 0, errTicketReplayed
+	}
+	k.used[string(nonce)] = expire
+	return plain[:ticketSecretSize], int(plain[ticketPlainSize-2]), int(plain[ticketPlainSize-1]), nil
+}
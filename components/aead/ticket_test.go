@@ -0,0 +1,88 @@
+package aead
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTicketKeys(t *testing.T) {
+	keys := NewTicketKeys(time.Hour)
+	ticket, secret, err := keys.Issue(16)
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	if len(ticket) < MinTicketSize || len(ticket) > MaxTicketSize {
+		t.Fatalf("ticket size %d, want within [%d, %d]", len(ticket), MinTicketSize, MaxTicketSize)
+	}
+
+	got, keySize, padding, err := keys.open(ticket)
+	if err != nil || keySize != 16 || !bytes.Equal(got, secret) {
+		t.Fatalf("open = %x %d %v, want %x 16", got, keySize, err, secret)
+	}
+	if ticketSealedSize+padding != len(ticket) {
+		t.Errorf("padding %d of a %d bytes ticket", padding, len(ticket))
+	}
+	if _, _, _, err := keys.open(ticket); err != errTicketReplayed {
+		t.Errorf("replayed ticket: %v, want %v", err, errTicketReplayed)
+	}
+
+	tampered, _, _ := keys.Issue(16)
+	tampered[ticketSealedSize-1] ^= 1
+	if _, _, _, err := keys.open(tampered); err != errTicketInvalid {
+		t.Errorf("tampered ticket: %v, want %v", err, errTicketInvalid)
+	}
+
+	/* a ticket of the previous key is accepted, older ones are not */
+	old, _, _ := keys.Issue(32)
+	keys.rotated = keys.rotated.Add(-time.Hour)
+	keys.Issue(16)
+	if _, _, _, err := keys.open(old); err != nil {
+		t.Errorf("ticket of the previous key: %v", err)
+	}
+	older, _, _ := keys.Issue(32)
+	for i := 0; i < 2; i++ {
+		keys.rotated = keys.rotated.Add(-time.Hour)
+		keys.Issue(16)
+	}
+	if _, _, _, err := keys.open(older); err != errTicketInvalid {
+		t.Errorf("ticket of a retired key: %v, want %v", err, errTicketInvalid)
+	}
+
+	expired := NewTicketKeys(-time.Second)
+	ticket, _, _ = expired.Issue(16)
+	if _, _, _, err := expired.open(ticket); err != errTicketExpired {
+		t.Errorf("expired ticket: %v, want %v", err, errTicketExpired)
+	}
+}
+
+func TestTicketKeys_Blinded(t *testing.T) {
+	keys := NewTicketKeys(time.Hour)
+	sizes := make(map[int]bool)
+	var heads [][]byte
+	for i := 0; i < 32; i++ {
+		ticket, _, err := keys.Issue(16)
+		if err != nil {
+			t.Fatalf("Issue failed: %v", err)
+		}
+		sizes[len(ticket)] = true
+		heads = append(heads, ticket[:ticketHeadSize])
+		if !keys.hasKey(ticket) {
+			t.Fatalf("ticket %d not recognized", i)
+		}
+	}
+	/* no bytes in common between tickets of one key, nor a common size */
+	for i := 1; i < len(heads); i++ {
+		if bytes.Equal(heads[i][ticketPrefixSize:], heads[0][ticketPrefixSize:]) {
+			t.Errorf("tickets 0 and %d share the tag %x", i, heads[0][ticketPrefixSize:])
+		}
+	}
+	if len(sizes) < 2 {
+		t.Errorf("all tickets have the same size %v", sizes)
+	}
+
+	salt := make([]byte, ticketHeadSize)
+	if keys.hasKey(salt) {
+		t.Error("a zero salt was taken for a ticket")
+	}
+}
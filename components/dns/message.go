@@ -0,0 +1,164 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// DNS resource record types and response codes as defined in RFC 1035
+// and RFC 3596.
+const (
+	TypeA    uint16 = 1
+	TypeSOA  uint16 = 6
+	TypeAAAA uint16 = 28
+
+	classINET uint16 = 1
+
+	RcodeSuccess  = 0
+	RcodeServFail = 2
+	RcodeNXDomain = 3
+
+	headerLen = 12
+)
+
+var errMalformed = errors.New("malformed DNS message")
+
+// Record is an address answer with its time to live in seconds.
+type Record struct {
+	IP  net.IP
+	TTL uint32
+}
+
+type response struct {
+	rcode   int
+	records []Record
+	// soaTTL is the negative caching TTL from the authority section,
+	// 0 if the response carries no SOA record.
+	soaTTL uint32
+}
+
+func buildQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	b := make([]byte, headerLen, headerLen+len(name)+6)
+	binary.BigEndian.PutUint16(b[0:], id)
+	b[2] = 0x01 // RD
+	binary.BigEndian.PutUint16(b[4:], 1)
+
+	name = strings.TrimSuffix(name, ".")
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, errors.New("invalid domain name " + name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	b = binary.BigEndian.AppendUint16(b, classINET)
+	if len(b) > 512 {
+		return nil, errors.New("domain name too long")
+	}
+	return b, nil
+}
+
+// skipName returns the offset right after the (possibly compressed) name
+// starting at off.
+func skipName(b []byte, off int) (int, error) {
+	for {
+		if off >= len(b) {
+			return 0, errMalformed
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			if off+2 > len(b) {
+				return 0, errMalformed
+			}
+			return off + 2, nil
+		case l&0xc0 != 0:
+			return 0, errMalformed
+		}
+		off += 1 + l
+	}
+}
+
+func parseResponse(b []byte, id, qtype uint16) (*response, error) {
+	if len(b) < headerLen {
+		return nil, errMalformed
+	}
+	if binary.BigEndian.Uint16(b[0:]) != id || b[2]&0x80 == 0 {
+		return nil, errors.New("unexpected DNS response")
+	}
+
+	resp := &response{rcode: int(b[3] & 0x0f)}
+	qdcount := int(binary.BigEndian.Uint16(b[4:]))
+	ancount := int(binary.BigEndian.Uint16(b[6:]))
+	nscount := int(binary.BigEndian.Uint16(b[8:]))
+
+	off := headerLen
+	var err error
+	for i := 0; i < qdcount; i++ {
+		if off, err = skipName(b, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+
+	for i := 0; i < ancount+nscount; i++ {
+		if off, err = skipName(b, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(b) {
+			return nil, errMalformed
+		}
+		typ := binary.BigEndian.Uint16(b[off:])
+		ttl := binary.BigEndian.Uint32(b[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(b[off+8:]))
+		off += 10
+		if off+rdlen > len(b) {
+			return nil, errMalformed
+		}
+		rdata := b[off : off+rdlen]
+		off += rdlen
+
+		if i >= ancount {
+			if typ == TypeSOA {
+				// the negative TTL is the lesser of the SOA TTL and MINIMUM
+				minimum := ttl
+				if rdlen >= 4 {
+					minimum = binary.BigEndian.Uint32(rdata[rdlen-4:])
+				}
+				resp.soaTTL = min(ttl, minimum)
+			}
+			continue
+		}
+		if typ != qtype {
+			continue
+		}
+		switch {
+		case typ == TypeA && rdlen == net.IPv4len, typ == TypeAAAA && rdlen == net.IPv6len:
+			resp.records = append(resp.records, Record{
+				IP:  append(net.IP{}, rdata...),
+				TTL: ttl,
+			})
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,307 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	DefaultCacheSize   = 4096
+	DefaultNegativeTTL = 30 * time.Second
+	DefaultTimeout     = 5 * time.Second
+
+	// systemTTL is used for answers of the system resolver, which does
+	// not report TTLs.
+	systemTTL = 60
+)
+
+// Options configures a Resolver.
+type Options struct {
+	// Servers are the upstream servers, tried in order. The system
+	// resolver is used when empty.
+	Servers []string
+	// Hosts are static overrides, keyed by lower-case domain name.
+	Hosts map[string][]net.IP
+	// CacheSize is the number of cached answers, 0 means default and a
+	// negative value disables caching.
+	CacheSize   int
+	NegativeTTL time.Duration
+	Timeout     time.Duration
+	// Dialer, if set, connects to the upstream servers, including the
+	// name servers of the system resolver.
+	Dialer Dialer
+}
+
+// Dialer makes the connections to the upstream servers, it is satisfied
+// by *net.Dialer and outbound.Dialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Resolver resolves domain names with a TTL-aware answer cache. It is
+// safe for concurrent use and is meant to be shared by all sessions.
+type Resolver struct {
+	servers []upstream
+	system  *net.Resolver
+	hosts   map[string][]net.IP
+	cache   *lru.Cache
+	negTTL  time.Duration
+	timeout time.Duration
+}
+
+type cacheEntry struct {
+	records []Record
+	err     error
+	expire  time.Time
+}
+
+func New(opts Options) (*Resolver, error) {
+	r := &Resolver{
+		hosts:   make(map[string][]net.IP),
+		negTTL:  opts.NegativeTTL,
+		timeout: opts.Timeout,
+	}
+	if r.negTTL <= 0 {
+		r.negTTL = DefaultNegativeTTL
+	}
+	if r.timeout <= 0 {
+		r.timeout = DefaultTimeout
+	}
+	d := opts.Dialer
+	if d == nil {
+		d = &net.Dialer{}
+		r.system = net.DefaultResolver
+	} else {
+		r.system = &net.Resolver{PreferGo: true, Dial: d.DialContext}
+	}
+	for name, ips := range opts.Hosts {
+		r.hosts[canonicalName(name)] = ips
+	}
+	for _, s := range opts.Servers {
+		u, err := parseUpstream(s, d)
+		if err != nil {
+			return nil, err
+		}
+		r.servers = append(r.servers, u)
+	}
+
+	size := opts.CacheSize
+	if size == 0 {
+		size = DefaultCacheSize
+	}
+	if size > 0 {
+		cache, err := lru.New(size)
+		if err != nil {
+			return nil, err
+		}
+		r.cache = cache
+	}
+	return r, nil
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// LookupIP looks up host for the given network ("ip", "ip4" or "ip6"),
+// it has the same signature as net.Resolver.LookupIP.
+func (r *Resolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	var qtypes []uint16
+	switch network {
+	case "ip4":
+		qtypes = []uint16{TypeA}
+	case "ip6":
+		qtypes = []uint16{TypeAAAA}
+	case "ip":
+		qtypes = []uint16{TypeA, TypeAAAA}
+	default:
+		return nil, fmt.Errorf("unsupported network %s", network)
+	}
+
+	// answers are ordered by query type, A records first
+	results := make([][]Record, len(qtypes))
+	errs := make([]error, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = r.Lookup(ctx, host, qtype)
+		}()
+	}
+	wg.Wait()
+
+	var (
+		ips      []net.IP
+		firstErr error
+	)
+	for i := range qtypes {
+		if errs[i] != nil && firstErr == nil {
+			firstErr = errs[i]
+		}
+		for _, rec := range results[i] {
+			ips = append(ips, rec.IP)
+		}
+	}
+	if len(ips) == 0 {
+		if firstErr == nil {
+			firstErr = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, firstErr
+	}
+	return ips, nil
+}
+
+// Lookup returns the A or AAAA records of name with their remaining TTLs.
+func (r *Resolver) Lookup(ctx context.Context, name string, qtype uint16) ([]Record, error) {
+	name = canonicalName(name)
+	if ips, ok := r.hosts[name]; ok {
+		var records []Record
+		for _, ip := range ips {
+			if (ip.To4() != nil) == (qtype == TypeA) {
+				records = append(records, Record{IP: ip, TTL: systemTTL})
+			}
+		}
+		return records, nil
+	}
+
+	key := fmt.Sprintf("%s/%d", name, qtype)
+	if r.cache != nil {
+		if v, ok := r.cache.Get(key); ok {
+			e := v.(*cacheEntry)
+			if remain := time.Until(e.expire); remain > 0 {
+				log.V(2).Infof("DNS cache hit: %s\n", key)
+				return withTTL(e.records, uint32(remain/time.Second)), e.err
+			}
+			r.cache.Remove(key)
+		}
+	}
+
+	records, ttl, err := r.query(ctx, name, qtype)
+	if r.cache != nil && ttl > 0 && (err == nil || isNotFound(err)) {
+		r.cache.Add(key, &cacheEntry{
+			records: records,
+			err:     err,
+			expire:  time.Now().Add(ttl),
+		})
+	}
+	return records, err
+}
+
+func withTTL(records []Record, ttl uint32) []Record {
+	out := make([]Record, len(records))
+	for i, rec := range records {
+		out[i] = Record{IP: rec.IP, TTL: min(rec.TTL, ttl)}
+	}
+	return out
+}
+
+func isNotFound(err error) bool {
+	var de *net.DNSError
+	return errors.As(err, &de) && de.IsNotFound
+}
+
+// query asks the upstream servers in order, the returned duration is how
+// long the answer may be cached.
+func (r *Resolver) query(ctx context.Context, name string, qtype uint16) ([]Record, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	if len(r.servers) == 0 {
+		return r.querySystem(ctx, name, qtype)
+	}
+
+	var idb [2]byte
+	rand.Read(idb[:])
+	id := binary.BigEndian.Uint16(idb[:])
+	query, err := buildQuery(id, name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var lastErr error
+	for _, u := range r.servers {
+		b, err := u.exchange(ctx, query)
+		if err != nil {
+			log.V(1).Infof("DNS server %s failed to resolve %s: %v\n", u, name, err)
+			lastErr = err
+			continue
+		}
+		resp, err := parseResponse(b, id, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		switch resp.rcode {
+		case RcodeSuccess:
+			if len(resp.records) == 0 {
+				return nil, r.negativeTTL(resp), &net.DNSError{Err: "no such host", Name: name, Server: u.String(), IsNotFound: true}
+			}
+			ttl := resp.records[0].TTL
+			for _, rec := range resp.records {
+				ttl = min(ttl, rec.TTL)
+			}
+			return resp.records, time.Duration(ttl) * time.Second, nil
+		case RcodeNXDomain:
+			return nil, r.negativeTTL(resp), &net.DNSError{Err: "no such host", Name: name, Server: u.String(), IsNotFound: true}
+		default:
+			lastErr = &net.DNSError{Err: fmt.Sprintf("server returned rcode %d", resp.rcode), Name: name, Server: u.String()}
+		}
+	}
+	return nil, 0, lastErr
+}
+
+func (r *Resolver) negativeTTL(resp *response) time.Duration {
+	if resp.soaTTL > 0 {
+		return min(time.Duration(resp.soaTTL)*time.Second, r.negTTL)
+	}
+	return r.negTTL
+}
+
+func (r *Resolver) querySystem(ctx context.Context, name string, qtype uint16) ([]Record, time.Duration, error) {
+	network := "ip4"
+	if qtype == TypeAAAA {
+		network = "ip6"
+	}
+	ips, err := r.system.LookupIP(ctx, network, name)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, r.negTTL, err
+		}
+		return nil, 0, err
+	}
+	records := make([]Record, len(ips))
+	for i, ip := range ips {
+		records[i] = Record{IP: ip, TTL: systemTTL}
+	}
+	return records, systemTTL * time.Second, nil
+}
@@ -0,0 +1,178 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// stubServer answers A queries for the names in records, any other name
+// gets NXDOMAIN with a SOA record in the authority section.
+type stubServer struct {
+	pc      net.PacketConn
+	records map[string]net.IP
+	queries int32
+}
+
+func startStubServer(t *testing.T, records map[string]net.IP) *stubServer {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := &stubServer{pc: pc, records: records}
+	go s.serve()
+	return s
+}
+
+func (s *stubServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.queries, 1)
+
+		q := buf[:n]
+		end, _ := skipName(q, headerLen)
+		qtype := binary.BigEndian.Uint16(q[end:])
+		name := ""
+		for off := headerLen; q[off] != 0; off += 1 + int(q[off]) {
+			if name != "" {
+				name += "."
+			}
+			name += string(q[off+1 : off+1+int(q[off])])
+		}
+
+		resp := append([]byte{}, q[:end+4]...)
+		resp[2] |= 0x80 // QR
+		ip, ok := s.records[name]
+		if !ok {
+			resp[3] = RcodeNXDomain
+			binary.BigEndian.PutUint16(resp[8:], 1)
+			// owner, SOA, IN, TTL 3600, rdata with MINIMUM 5
+			resp = append(resp, 0xc0, headerLen)
+			resp = binary.BigEndian.AppendUint16(resp, TypeSOA)
+			resp = binary.BigEndian.AppendUint16(resp, classINET)
+			resp = binary.BigEndian.AppendUint32(resp, 3600)
+			resp = binary.BigEndian.AppendUint16(resp, 2+20)
+			resp = append(resp, 0, 0)
+			resp = append(resp, make([]byte, 16)...)
+			resp = binary.BigEndian.AppendUint32(resp, 5)
+		} else if qtype == TypeA {
+			binary.BigEndian.PutUint16(resp[6:], 1)
+			resp = append(resp, 0xc0, headerLen)
+			resp = binary.BigEndian.AppendUint16(resp, TypeA)
+			resp = binary.BigEndian.AppendUint16(resp, classINET)
+			resp = binary.BigEndian.AppendUint32(resp, 300)
+			resp = binary.BigEndian.AppendUint16(resp, net.IPv4len)
+			resp = append(resp, ip.To4()...)
+		}
+		s.pc.WriteTo(resp, addr)
+	}
+}
+
+func TestResolver_Lookup(t *testing.T) {
+	stub := startStubServer(t, map[string]net.IP{
+		"example.test": net.ParseIP("192.0.2.10"),
+	})
+	defer stub.pc.Close()
+
+	r, err := New(Options{Servers: []string{stub.pc.LocalAddr().String()}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		records, err := r.Lookup(context.Background(), "Example.Test.", TypeA)
+		if err != nil {
+			t.Fatalf("Lookup failed: %v", err)
+		}
+		if len(records) != 1 || !records[0].IP.Equal(net.ParseIP("192.0.2.10")) {
+			t.Fatalf("unexpected records %v", records)
+		}
+		if records[0].TTL == 0 || records[0].TTL > 300 {
+			t.Errorf("unexpected TTL %d", records[0].TTL)
+		}
+	}
+	if q := atomic.LoadInt32(&stub.queries); q != 1 {
+		t.Errorf("expected 1 upstream query, got %d", q)
+	}
+}
+
+func TestResolver_NegativeCache(t *testing.T) {
+	stub := startStubServer(t, nil)
+	defer stub.pc.Close()
+
+	r, _ := New(Options{Servers: []string{"udp://" + stub.pc.LocalAddr().String()}})
+	for i := 0; i < 2; i++ {
+		_, err := r.LookupIP(context.Background(), "ip4", "missing.test")
+		if !isNotFound(err) {
+			t.Fatalf("expected not found error, got %v", err)
+		}
+	}
+	if q := atomic.LoadInt32(&stub.queries); q != 1 {
+		t.Errorf("expected 1 upstream query, got %d", q)
+	}
+}
+
+func TestResolver_Hosts(t *testing.T) {
+	r, _ := New(Options{
+		Servers: []string{"127.0.0.1:1"},
+		Hosts: map[string][]net.IP{
+			"Internal.Example": {net.ParseIP("10.0.0.5"), net.ParseIP("fd00::5")},
+		},
+	})
+
+	ips, err := r.LookupIP(context.Background(), "ip", "internal.example")
+	if err != nil {
+		t.Fatalf("LookupIP failed: %v", err)
+	}
+	if len(ips) != 2 {
+		t.Errorf("expected both host addresses, got %v", ips)
+	}
+
+	ips, _ = r.LookupIP(context.Background(), "ip6", "internal.example")
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("fd00::5")) {
+		t.Errorf("expected IPv6 host address, got %v", ips)
+	}
+}
+
+// stubDialer sends every connection to the stub server.
+type stubDialer struct {
+	addr  string
+	dials int32
+}
+
+func (d *stubDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	atomic.AddInt32(&d.dials, 1)
+	var nd net.Dialer
+	return nd.DialContext(ctx, "udp", d.addr)
+}
+
+func TestResolver_Dialer(t *testing.T) {
+	stub := startStubServer(t, map[string]net.IP{
+		"example.test": net.ParseIP("192.0.2.10"),
+	})
+	defer stub.pc.Close()
+
+	for _, servers := range [][]string{{"192.0.2.53"}, nil} {
+		d := &stubDialer{addr: stub.pc.LocalAddr().String()}
+		r, err := New(Options{Servers: servers, Dialer: d, CacheSize: -1})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		ips, err := r.LookupIP(context.Background(), "ip4", "example.test")
+		if err != nil {
+			t.Fatalf("LookupIP with servers %v failed: %v", servers, err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.10")) {
+			t.Errorf("unexpected addresses %v", ips)
+		}
+		if atomic.LoadInt32(&d.dials) == 0 {
+			t.Errorf("Dialer not used with servers %v", servers)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const maxMessageSize = 65535
+
+// upstream exchanges a DNS query with a remote server.
+type upstream interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+// parseUpstream parses a server address, supported forms are:
+// "1.1.1.1", "udp://1.1.1.1:53", "tcp://1.1.1.1", "tls://1.1.1.1:853"
+// and "https://dns.google/dns-query".
+func parseUpstream(s string, d Dialer) (upstream, error) {
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	withPort := func(port string) string {
+		if u.Port() != "" {
+			return u.Host
+		}
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return &udpUpstream{addr: withPort("53"), d: d}, nil
+	case "tcp":
+		return &tcpUpstream{addr: withPort("53"), d: d}, nil
+	case "tls":
+		return &tcpUpstream{
+			addr: withPort("853"),
+			tls:  &tls.Config{ServerName: u.Hostname()},
+			d:    d,
+		}, nil
+	case "https":
+		client := &http.Client{Transport: &http.Transport{
+			DialContext:       d.DialContext,
+			ForceAttemptHTTP2: true,
+		}}
+		return &httpsUpstream{url: u.String(), client: client}, nil
+	}
+	return nil, fmt.Errorf("unsupported DNS server %s", s)
+}
+
+func setDeadline(ctx context.Context, c net.Conn) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+}
+
+type udpUpstream struct {
+	addr string
+	d    Dialer
+}
+
+func (u *udpUpstream) String() string { return "udp://" + u.addr }
+
+func (u *udpUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	c, err := u.d.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	setDeadline(ctx, c)
+
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore stray datagrams not answering this query
+		if n < headerLen || !bytes.Equal(buf[:2], query[:2]) {
+			continue
+		}
+		if buf[2]&0x02 != 0 { // TC, retry over TCP
+			return (&tcpUpstream{addr: u.addr, d: u.d}).exchange(ctx, query)
+		}
+		return buf[:n], nil
+	}
+}
+
+// tcpUpstream serves both plain TCP and DNS over TLS (RFC 7858).
+type tcpUpstream struct {
+	addr string
+	tls  *tls.Config
+	d    Dialer
+}
+
+func (u *tcpUpstream) String() string {
+	if u.tls != nil {
+		return "tls://" + u.addr
+	}
+	return "tcp://" + u.addr
+}
+
+func (u *tcpUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	c, err := u.d.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	setDeadline(ctx, c)
+
+	if u.tls != nil {
+		tc := tls.Client(c, u.tls)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		c = tc
+	}
+
+	msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query)), uint16(len(query)))
+	msg = append(msg, query...)
+	if _, err := c.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var l [2]byte
+	if _, err := io.ReadFull(c, l[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// httpsUpstream implements DNS over HTTPS (RFC 8484) with POST requests.
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) String() string { return u.url }
+
+func (u *httpsUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	// RFC 8484 recommends a zero ID for better caching
+	q := append([]byte{0, 0}, query[2:]...)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(q))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server %s returned %s", u.url, resp.Status)
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) >= 2 {
+		copy(buf, query[:2])
+	}
+	return buf, nil
+}
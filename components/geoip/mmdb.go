@@ -0,0 +1,357 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package geoip looks up countries in MaxMind DB (.mmdb) files, such as
+// GeoLite2-Country, following https://maxmind.github.io/MaxMind-DB/.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+)
+
+var (
+	metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+	errInvalidDatabase = errors.New("invalid MaxMind DB")
+)
+
+const dataSectionSeparator = 16
+
+// Reader is an in-memory MaxMind DB, it is safe for concurrent use.
+type Reader struct {
+	buf        []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+}
+
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := FromBytes(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+func FromBytes(buf []byte) (*Reader, error) {
+	idx := bytes.LastIndex(buf, metadataMarker)
+	if idx < 0 {
+		return nil, errInvalidDatabase
+	}
+	meta := buf[idx+len(metadataMarker):]
+	v, _, err := (&decoder{buf: meta}).decode(0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, errInvalidDatabase
+	}
+
+	r := &Reader{
+		buf:        buf,
+		nodeCount:  toUint(m["node_count"]),
+		recordSize: toUint(m["record_size"]),
+		ipVersion:  toUint(m["ip_version"]),
+	}
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+dataSectionSeparator > uint(idx) {
+		return nil, errInvalidDatabase
+	}
+	r.data = buf[treeSize+dataSectionSeparator : idx]
+	if r.ipVersion == 6 {
+		r.ipv4Start = r.ipv4StartNode()
+	}
+	return r, nil
+}
+
+func toUint(v any) uint {
+	switch n := v.(type) {
+	case uint64:
+		return uint(n)
+	case int32:
+		return uint(n)
+	}
+	return 0
+}
+
+func (r *Reader) readNode(node, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.buf[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.buf[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.buf[node*8+bit*4:]))
+	}
+}
+
+// lookup returns the data section offset of the record for ip, or
+// ok=false when the address is not in the database.
+func (r *Reader) lookup(ip net.IP) (uint, bool) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return 0, false
+	}
+
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.readNode(node, bit)
+	}
+	if node <= r.nodeCount {
+		return 0, false
+	}
+	offset := node - r.nodeCount - dataSectionSeparator
+	return offset, offset < uint(len(r.data))
+}
+
+// ipv4StartNode walks the 96 leading zero bits of IPv4-mapped addresses
+// in an IPv6 tree.
+func (r *Reader) ipv4StartNode() uint {
+	node := uint(0)
+	for i := 0; i < 96 && node < r.nodeCount; i++ {
+		node = r.readNode(node, 0)
+	}
+	return node
+}
+
+// Lookup returns the decoded record for ip, or nil if not found.
+func (r *Reader) Lookup(ip net.IP) (any, error) {
+	offset, ok := r.lookup(ip)
+	if !ok {
+		return nil, nil
+	}
+	v, _, err := (&decoder{buf: r.data}).decode(offset)
+	return v, err
+}
+
+// Country returns the upper-case ISO 3166-1 code of the country of ip,
+// falling back to the registered country, or "" if unknown.
+func (r *Reader) Country(ip net.IP) string {
+	v, err := r.Lookup(ip)
+	if err != nil {
+		return ""
+	}
+	m, _ := v.(map[string]any)
+	for _, key := range []string{"country", "registered_country"} {
+		c, _ := m[key].(map[string]any)
+		if code, ok := c["iso_code"].(string); ok && code != "" {
+			return strings.ToUpper(code)
+		}
+	}
+	return ""
+}
+
+// decoder reads the data section format, offsets are relative to buf.
+type decoder struct {
+	buf []byte
+}
+
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+func (d *decoder) byteAt(offset uint) (byte, error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, errInvalidDatabase
+	}
+	return d.buf[offset], nil
+}
+
+func (d *decoder) slice(offset, size uint) ([]byte, error) {
+	if offset+size > uint(len(d.buf)) {
+		return nil, errInvalidDatabase
+	}
+	return d.buf[offset : offset+size], nil
+}
+
+// decode returns the value at offset and the offset following it.
+func (d *decoder) decode(offset uint) (any, uint, error) {
+	ctrl, err := d.byteAt(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+
+	typ := uint(ctrl >> 5)
+	if typ == typePointer {
+		ptr, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr)
+		return v, next, err
+	}
+	if typ == typeExtended {
+		b, err := d.byteAt(offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(b)
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 && typ != typeBool {
+		n := size - 28
+		b, err := d.slice(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		case 3:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errInvalidDatabase
+			}
+			v, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]any, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	b, err := d.slice(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch typ {
+	case typeString:
+		return string(b), offset, nil
+	case typeBytes, typeUint128:
+		return append([]byte{}, b...), offset, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errInvalidDatabase
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errInvalidDatabase
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	case typeUint16, typeUint32, typeUint64:
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case typeInt32:
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int32(n), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported MaxMind DB data type %d", typ)
+}
+
+func (d *decoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3)&0x3 + 1
+	b, err := d.slice(offset, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	vvv := uint(ctrl & 0x7)
+	var ptr uint
+	switch n {
+	case 1:
+		ptr = vvv<<8 | uint(b[0])
+	case 2:
+		ptr = (vvv<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+	case 3:
+		ptr = (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+	default:
+		ptr = uint(binary.BigEndian.Uint32(b))
+	}
+	return ptr, offset + n, nil
+}
@@ -0,0 +1,98 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// buildDatabase writes a 24-bit IPv4 MaxMind DB mapping each /8 network
+// of firstOctets to the country code of the same index.
+func buildDatabase(firstOctets []byte, countries []string) []byte {
+	type node struct{ rec [2]int }
+	const empty, dataFlag = -1, 1 << 30
+
+	var data []byte
+	nodes := []node{{rec: [2]int{empty, empty}}}
+	for i, octet := range firstOctets {
+		offset := len(data)
+		code := countries[i]
+		// {"country": {"iso_code": code}}
+		data = append(data, 0xe1, 0x47)
+		data = append(data, "country"...)
+		data = append(data, 0xe1, 0x48)
+		data = append(data, "iso_code"...)
+		data = append(data, 0x40|byte(len(code)))
+		data = append(data, code...)
+
+		cur := 0
+		for bit := 0; bit < 8; bit++ {
+			b := int(octet>>(7-bit)) & 1
+			if bit == 7 {
+				nodes[cur].rec[b] = dataFlag | offset
+				break
+			}
+			if nodes[cur].rec[b] == empty {
+				nodes = append(nodes, node{rec: [2]int{empty, empty}})
+				nodes[cur].rec[b] = len(nodes) - 1
+			}
+			cur = nodes[cur].rec[b]
+		}
+	}
+
+	count := len(nodes)
+	var buf []byte
+	for _, n := range nodes {
+		for _, r := range n.rec {
+			v := count
+			if r&dataFlag != 0 {
+				v = count + dataSectionSeparator + r&^dataFlag
+			} else if r != empty {
+				v = r
+			}
+			buf = append(buf, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	buf = append(buf, make([]byte, dataSectionSeparator)...)
+	buf = append(buf, data...)
+	buf = append(buf, metadataMarker...)
+
+	buf = append(buf, 0xe3)
+	buf = append(buf, 0x4a)
+	buf = append(buf, "node_count"...)
+	buf = append(buf, 0xc4)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(count))
+	buf = append(buf, 0x4b)
+	buf = append(buf, "record_size"...)
+	buf = append(buf, 0xa2, 0, 24)
+	buf = append(buf, 0x4a)
+	buf = append(buf, "ip_version"...)
+	buf = append(buf, 0xa2, 0, 4)
+	return buf
+}
+
+func TestReader_Country(t *testing.T) {
+	r, err := FromBytes(buildDatabase([]byte{1, 2, 200}, []string{"cn", "US", "DE"}))
+	if err != nil {
+		t.Fatalf("FromBytes failed: %v", err)
+	}
+
+	cases := map[string]string{
+		"1.2.3.4":     "CN",
+		"2.255.0.1":   "US",
+		"200.1.1.1":   "DE",
+		"3.0.0.1":     "",
+		"2001:db8::1": "",
+	}
+	for ip, want := range cases {
+		if got := r.Country(net.ParseIP(ip)); got != want {
+			t.Errorf("Country(%s): expected %q, got %q", ip, want, got)
+		}
+	}
+}
+
+func TestReader_Invalid(t *testing.T) {
+	if _, err := FromBytes([]byte("not a database")); err == nil {
+		t.Errorf("expected error for invalid database")
+	}
+}
@@ -0,0 +1,191 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package outbound
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	PrefixModeRandom = "random"
+	PrefixModeHash   = "hash"
+)
+
+// BindOptions selects the source of outbound sockets.
+type BindOptions struct {
+	// Addresses are candidate source addresses, the first one matching
+	// the family of the destination is used.
+	Addresses []net.IP
+	// Interface binds sockets to a network device (SO_BINDTODEVICE).
+	Interface string
+	// Mark sets SO_MARK for policy routing, 0 means unset.
+	Mark int
+	// IPv6Prefix, if set, overrides Addresses for IPv6 destinations with
+	// an address picked from the prefix according to PrefixMode.
+	IPv6Prefix *net.IPNet
+	PrefixMode string
+}
+
+// ParseBindAddresses parses a comma separated list of IP addresses.
+func ParseBindAddresses(s string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		ip := net.ParseIP(f)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid bind address %s", f)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// ParseIPv6Prefix parses an IPv6 CIDR used for per-connection source addresses.
+func ParseIPv6Prefix(s string) (*net.IPNet, error) {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if n.IP.To4() != nil {
+		return nil, fmt.Errorf("bind prefix %s is not IPv6", s)
+	}
+	return n, nil
+}
+
+func (o *BindOptions) IsZero() bool {
+	return o == nil || (len(o.Addresses) == 0 && o.Interface == "" && o.Mark == 0 && o.IPv6Prefix == nil)
+}
+
+func (o *BindOptions) Validate() error {
+	if o == nil {
+		return nil
+	}
+	switch o.PrefixMode {
+	case "", PrefixModeRandom, PrefixModeHash:
+	default:
+		return fmt.Errorf("invalid bind prefix mode %s", o.PrefixMode)
+	}
+	if (o.Interface != "" || o.Mark != 0) && !socketOptionsSupported {
+		return fmt.Errorf("bind interface and fwmark are not supported on this platform")
+	}
+	return nil
+}
+
+// sourceIP returns the source address for the given family, key is used to
+// derive the address when the prefix is in hash mode.
+func (o *BindOptions) sourceIP(ipv6 bool, key string) net.IP {
+	if ipv6 && o.IPv6Prefix != nil {
+		return prefixAddress(o.IPv6Prefix, o.PrefixMode, key)
+	}
+	for _, ip := range o.Addresses {
+		if (ip.To4() == nil) == ipv6 {
+			return ip
+		}
+	}
+	return nil
+}
+
+func prefixAddress(prefix *net.IPNet, mode, key string) net.IP {
+	host := make([]byte, net.IPv6len)
+	if mode == PrefixModeHash {
+		sum := sha256.Sum256([]byte(key))
+		copy(host, sum[:])
+	} else {
+		rand.Read(host)
+	}
+	ip := make(net.IP, net.IPv6len)
+	base := prefix.IP.To16()
+	for i := range ip {
+		ip[i] = (base[i] & prefix.Mask[i]) | (host[i] &^ prefix.Mask[i])
+	}
+	return ip
+}
+
+func (o *BindOptions) control(key string, bind bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		ipv6 := strings.HasSuffix(network, "6")
+		var src net.IP
+		if bind {
+			src = o.sourceIP(ipv6, key)
+		}
+		var err error
+		ctrlErr := c.Control(func(fd uintptr) {
+			err = applySocketOptions(int(fd), o, ipv6 && o.IPv6Prefix != nil)
+			if err == nil && src != nil {
+				err = bindSource(fd, src, ipv6)
+			}
+		})
+		if ctrlErr != nil {
+			return ctrlErr
+		}
+		return err
+	}
+}
+
+// Dialer returns a net.Dialer applying the bind options.
+func (o *BindOptions) Dialer(key string, timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if !o.IsZero() {
+		d.Control = o.control(key, true)
+	}
+	return d
+}
+
+// ListenPacket opens an unconnected UDP socket applying the bind options,
+// reaching both IPv4 and IPv6 destinations.
+func (o *BindOptions) ListenPacket(key string) (net.PacketConn, error) {
+	/* wildcard sockets are dual-stack with v4-mapped addresses */
+	if o.IsZero() {
+		return net.ListenPacket("udp", "0.0.0.0:0")
+	}
+	lc := &net.ListenConfig{Control: o.control(key, false)}
+	src4, src6 := o.sourceIP(false, key), o.sourceIP(true, key)
+	if src4 == nil && src6 == nil {
+		return lc.ListenPacket(context.Background(), "udp", "0.0.0.0:0")
+	}
+
+	/* a source address binds one family only, use a socket per family */
+	laddr4, laddr6 := "0.0.0.0:0", "[::]:0"
+	if src4 != nil {
+		laddr4 = net.JoinHostPort(src4.String(), "0")
+	}
+	if src6 != nil {
+		laddr6 = net.JoinHostPort(src6.String(), "0")
+	}
+	v4, err := lc.ListenPacket(context.Background(), "udp4", laddr4)
+	if err != nil {
+		return nil, err
+	}
+	v6, err := lc.ListenPacket(context.Background(), "udp6", laddr6)
+	if err != nil {
+		if src6 != nil {
+			v4.Close()
+			return nil, err
+		}
+		/* hosts without IPv6 */
+		return v4, nil
+	}
+	return newDualStackConn(v4, v6), nil
+}
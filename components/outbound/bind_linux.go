@@ -0,0 +1,47 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package outbound
+
+import (
+	"syscall"
+)
+
+const (
+	socketOptionsSupported = true
+
+	ipFreebind   = 15 // IP_FREEBIND on Linux
+	ipv6Freebind = 78 // IPV6_FREEBIND on Linux
+)
+
+func applySocketOptions(fd int, o *BindOptions, freebind bool) error {
+	if o.Interface != "" {
+		if err := syscall.BindToDevice(fd, o.Interface); err != nil {
+			return err
+		}
+	}
+	if o.Mark != 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, o.Mark); err != nil {
+			return err
+		}
+	}
+	if freebind {
+		// addresses picked from a prefix are usually not assigned to any
+		// interface, the prefix is expected to be routed locally instead
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_IPV6, ipv6Freebind, 1); err != nil {
+			return syscall.SetsockoptInt(fd, syscall.SOL_IP, ipFreebind, 1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package outbound
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPrefixAddress(t *testing.T) {
+	prefix, err := ParseIPv6Prefix("2001:db8:1:2::/64")
+	if err != nil {
+		t.Fatalf("ParseIPv6Prefix failed: %v", err)
+	}
+
+	a := prefixAddress(prefix, PrefixModeHash, "alice")
+	b := prefixAddress(prefix, PrefixModeHash, "alice")
+	c := prefixAddress(prefix, PrefixModeHash, "bob")
+	if !a.Equal(b) {
+		t.Errorf("hashed address should be stable, got %s and %s", a, b)
+	}
+	if a.Equal(c) {
+		t.Errorf("different keys should give different addresses, got %s", a)
+	}
+
+	for _, ip := range []net.IP{a, c, prefixAddress(prefix, PrefixModeRandom, "")} {
+		if !prefix.Contains(ip) {
+			t.Errorf("address %s not in prefix %s", ip, prefix)
+		}
+	}
+}
+
+func TestSourceIP(t *testing.T) {
+	addrs, err := ParseBindAddresses("192.0.2.1, 2001:db8::1")
+	if err != nil {
+		t.Fatalf("ParseBindAddresses failed: %v", err)
+	}
+	o := &BindOptions{Addresses: addrs}
+
+	if ip := o.sourceIP(false, ""); !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expected IPv4 source, got %s", ip)
+	}
+	if ip := o.sourceIP(true, ""); !ip.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("expected IPv6 source, got %s", ip)
+	}
+
+	if _, err := ParseBindAddresses("192.0.2.1,bogus"); err == nil {
+		t.Errorf("expected error for invalid address")
+	}
+}
+
+func TestBindOptions_ListenPacketDualStack(t *testing.T) {
+	var echoes []net.PacketConn
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			t.Skipf("no loopback for %s: %v", addr, err)
+		}
+		defer pc.Close()
+		go func() {
+			buf := make([]byte, 2048)
+			for {
+				n, from, err := pc.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				pc.WriteTo(buf[:n], from)
+			}
+		}()
+		echoes = append(echoes, pc)
+	}
+
+	o := &BindOptions{Addresses: []net.IP{net.ParseIP("127.0.0.1")}}
+	pc, err := o.ListenPacket("")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer pc.Close()
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	for _, echo := range echoes {
+		if _, err := pc.WriteTo([]byte("ping"), echo.LocalAddr()); err != nil {
+			t.Fatalf("WriteTo %s failed: %v", echo.LocalAddr(), err)
+		}
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != "ping" || from.String() != echo.LocalAddr().String() {
+			t.Errorf("echo from %s = %q from %v, %v", echo.LocalAddr(), buf[:n], from, err)
+		}
+	}
+}
+
+func TestBindOptions_DualStackDeadline(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	o := &BindOptions{Addresses: []net.IP{net.ParseIP("127.0.0.1")}}
+	pc, err := o.ListenPacket("")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer pc.Close()
+	if _, ok := pc.(*dualStackConn); !ok {
+		t.Skipf("no dual-stack socket, got %T", pc)
+	}
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, _, err := pc.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("ReadFrom = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	/* an extended deadline is not hit by timeouts of the earlier one */
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := pc.WriteTo([]byte("ping"), echo.LocalAddr()); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Errorf("ReadFrom after the deadline was extended = %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package outbound
+
+import (
+	"net"
+	"syscall"
+)
+
+func bindSource(fd uintptr, ip net.IP, ipv6 bool) error {
+	if ipv6 {
+		sa := &syscall.SockaddrInet6{}
+		copy(sa.Addr[:], ip.To16())
+		return syscall.Bind(int(fd), sa)
+	}
+	sa := &syscall.SockaddrInet4{}
+	copy(sa.Addr[:], ip.To4())
+	return syscall.Bind(int(fd), sa)
+}
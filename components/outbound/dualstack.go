@@ -0,0 +1,163 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package outbound
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	p "github.com/icpz/open-snell/components/utils/pool"
+)
+
+type dualPacket struct {
+	b    []byte
+	addr net.Addr
+	err  error
+}
+
+// dualStackConn sends each datagram on the socket of the destination
+// family, so that both families can be bound to their own source address.
+// The sockets are read without deadlines, the read deadline is enforced by
+// ReadFrom.
+type dualStackConn struct {
+	v4, v6 net.PacketConn
+	ch     chan dualPacket
+	done   chan struct{}
+	once   sync.Once
+
+	dmu      sync.Mutex
+	deadline time.Time
+	// changed is closed and replaced when the read deadline changes
+	changed chan struct{}
+}
+
+func newDualStackConn(v4, v6 net.PacketConn) *dualStackConn {
+	c := &dualStackConn{
+		v4:      v4,
+		v6:      v6,
+		ch:      make(chan dualPacket, 16),
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	go c.read(v4)
+	go c.read(v6)
+	return c
+}
+
+func (c *dualStackConn) read(pc net.PacketConn) {
+	buf := p.Get(p.RelayBufferSize)
+	defer p.Put(buf)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		pkt := dualPacket{addr: addr, err: err}
+		if err == nil {
+			pkt.b = append([]byte(nil), buf[:n]...)
+		}
+		select {
+		case c.ch <- pkt:
+		case <-c.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *dualStackConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		pkt, err := c.wait()
+		if err == errDeadlineChanged {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if pkt.err != nil {
+			return 0, nil, pkt.err
+		}
+		return copy(b, pkt.b), pkt.addr, nil
+	}
+}
+
+var errDeadlineChanged = errors.New("read deadline changed")
+
+// wait returns the next packet, or errDeadlineChanged if the read deadline
+// changed meanwhile.
+func (c *dualStackConn) wait() (dualPacket, error) {
+	c.dmu.Lock()
+	deadline, changed := c.deadline, c.changed
+	c.dmu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return dualPacket{}, os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case pkt := <-c.ch:
+		return pkt, nil
+	case <-c.done:
+		return dualPacket{}, net.ErrClosed
+	case <-timeout:
+		return dualPacket{}, os.ErrDeadlineExceeded
+	case <-changed:
+		return dualPacket{}, errDeadlineChanged
+	}
+}
+
+func (c *dualStackConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if ua, ok := addr.(*net.UDPAddr); ok && ua.IP.To4() == nil {
+		return c.v6.WriteTo(b, addr)
+	}
+	return c.v4.WriteTo(b, addr)
+}
+
+func (c *dualStackConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	err := c.v4.Close()
+	if err6 := c.v6.Close(); err == nil {
+		err = err6
+	}
+	return err
+}
+
+func (c *dualStackConn) LocalAddr() net.Addr { return c.v4.LocalAddr() }
+
+func (c *dualStackConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *dualStackConn) SetReadDeadline(t time.Time) error {
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	c.deadline = t
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return nil
+}
+
+func (c *dualStackConn) SetWriteDeadline(t time.Time) error {
+	c.v4.SetWriteDeadline(t)
+	return c.v6.SetWriteDeadline(t)
+}
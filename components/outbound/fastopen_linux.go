@@ -0,0 +1,87 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package outbound
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const tcpFastOpenConnect = 30 // TCP_FASTOPEN_CONNECT on Linux
+
+// TCP states reported by TCP_INFO
+const (
+	tcpSynSent = 2
+	tcpClose   = 7
+)
+
+func setFastOpenConnect(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_TCP, tcpFastOpenConnect, 1)
+}
+
+// waitFastOpen waits for the handshake of c, whose connect returned
+// before it with TCP_FASTOPEN_CONNECT, until ctx is done.
+func waitFastOpen(ctx context.Context, c net.Conn) error {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		tc.SetWriteDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { tc.SetWriteDeadline(time.Unix(1, 0)) })
+	defer func() {
+		stop()
+		tc.SetWriteDeadline(time.Time{})
+	}()
+
+	var serr error
+	err = rc.Write(func(fd uintptr) bool {
+		info, err := unix.GetsockoptTCPInfo(int(fd), unix.SOL_TCP, unix.TCP_INFO)
+		if err != nil {
+			serr = err
+			return true
+		}
+		if info.State == tcpSynSent {
+			/* writable once established, or on error */
+			return false
+		}
+		if errno, _ := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR); errno != 0 {
+			serr = syscall.Errno(errno)
+		} else if info.State == tcpClose {
+			serr = syscall.ECONNRESET
+		}
+		return true
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if serr != nil {
+		return &net.OpError{Op: "dial", Net: "tcp", Addr: c.RemoteAddr(), Err: os.NewSyscallError("connect", serr)}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+//go:build linux
+
+package outbound
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenFastOpen listens on ip with TCP Fast Open enabled.
+func listenFastOpen(t *testing.T, ip string) net.Listener {
+	t.Helper()
+	lc := &net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		c.Control(func(fd uintptr) {
+			unix.SetsockoptInt(int(fd), unix.SOL_TCP, unix.TCP_FASTOPEN, 16)
+		})
+		return nil
+	}}
+	l, err := lc.Listen(context.Background(), "tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+// warmFastOpen gets a fast open cookie of ip, so that the next SYN to it
+// carries data and connect returns before the handshake.
+func warmFastOpen(t *testing.T, ip string) {
+	t.Helper()
+	if b, _ := os.ReadFile("/proc/sys/net/ipv4/tcp_fastopen"); len(b) == 0 || (b[0]-'0')&3 != 3 {
+		t.Logf("TCP Fast Open not enabled for both sides, connect completes the handshake")
+	}
+	l := listenFastOpen(t, ip)
+	defer l.Close()
+	d := &Direct{Timeout: 5 * time.Second, Early: []byte("warm"), FastOpen: true}
+	c, err := d.DialContext(context.Background(), l.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	io.ReadFull(c, make([]byte, 4))
+	c.Close()
+}
+
+func TestDirect_FastOpen(t *testing.T) {
+	warmFastOpen(t, "127.0.0.1")
+	warmFastOpen(t, "127.0.0.2")
+	l := listenFastOpen(t, "127.0.0.1")
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	/* the first address refuses, the attempt must fail rather than
+	 * return before the handshake, so that the next one is tried */
+	d := &Direct{
+		Timeout:  5 * time.Second,
+		Resolver: stubResolver{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")},
+		Strategy: &DialStrategy{Mode: StrategyPreferIPv4},
+		Early:    []byte("hello"),
+		FastOpen: true,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := d.DialContext(ctx, net.JoinHostPort("target.test", port))
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	defer c.Close()
+	if addr := c.RemoteAddr().String(); addr != l.Addr().String() {
+		t.Errorf("connected to %s, want %s", addr, l.Addr())
+	}
+	buf := make([]byte, 5)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("target echoed %q, %v, want the early data", buf, err)
+	}
+}
+
+func TestDirect_FastOpenRefused(t *testing.T) {
+	warmFastOpen(t, "127.0.0.1")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	d := &Direct{Timeout: 5 * time.Second, Early: []byte("hello"), FastOpen: true}
+	c, err := d.DialContext(context.Background(), addr)
+	if err == nil {
+		c.Close()
+		t.Fatal("DialContext succeeded on a closed port")
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("expected ECONNREFUSED, got %v", err)
+	}
+}
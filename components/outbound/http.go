@@ -0,0 +1,100 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package outbound
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// HTTP relays TCP traffic through an HTTP proxy using CONNECT.
+type HTTP struct {
+	Server   string
+	Username string
+	Password string
+	// Dialer, if set, connects to the proxy server
+	Dialer Dialer
+}
+
+func NewHTTP(server, username, password string) *HTTP {
+	return &HTTP{Server: server, Username: username, Password: password}
+}
+
+func (h *HTTP) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	c, err := dialServer(ctx, h.Dialer, h.Server)
+	if err != nil {
+		return nil, err
+	}
+
+	var br *bufio.Reader
+	if err := handshakeWithContext(ctx, c, func() (err error) {
+		br, err = h.connect(c, address)
+		return
+	}); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("http upstream %s: %w", h.Server, err)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
+
+func (h *HTTP) connect(c net.Conn, address string) (*bufio.Reader, error) {
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if h.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(h.Username + ":" + h.Password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := c.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(c)
+	// the body of a CONNECT response is the tunnel itself, leave it unread
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT %s: %s", address, resp.Status)
+	}
+	return br, nil
+}
+
+func (h *HTTP) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	return nil, errors.New("http upstream does not support UDP")
+}
+
+// bufferedConn returns bytes read ahead by the handshake before reading
+// from the underlying connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,191 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package outbound
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/icpz/open-snell/components/utils"
+)
+
+// Outbound carries the server's egress traffic to targets.
+type Outbound interface {
+	// DialContext opens a TCP stream to address (host:port).
+	DialContext(ctx context.Context, address string) (net.Conn, error)
+	// ListenPacket opens a packet connection relaying UDP datagrams to
+	// the addresses passed to WriteTo.
+	ListenPacket(ctx context.Context) (net.PacketConn, error)
+}
+
+// Dialer makes the connections of direct egress and of upstream proxy
+// servers, e.g. on a userspace network stack, a custom tunnel or in
+// memory. Connections are made with the host network stack if nil.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error)
+}
+
+// Resolver looks up domain names, it is satisfied by both *net.Resolver
+// and *dns.Resolver.
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// Direct dials targets from this host, applying the bind options.
+// Timeout bounds each connection attempt.
+type Direct struct {
+	Bind     *BindOptions
+	Key      string
+	Timeout  time.Duration
+	Resolver Resolver
+	Strategy *DialStrategy
+	// Early, if set, is written by each connection attempt, in the SYN if
+	// FastOpen is set. Attempts still complete with the handshake, but are
+	// tried in turn rather than raced so that at most one target gets it.
+	Early []byte
+	// FastOpen enables TCP Fast Open for Early
+	FastOpen bool
+	// MultipathTCP enables MPTCP, falling back to plain TCP when either
+	// this host or the target does not support it.
+	MultipathTCP bool
+	// TCP tunes every established connection
+	TCP *utils.TCPOptions
+	// Dialer, if set, makes the connections instead of the host network
+	// stack, the socket options above do not apply then.
+	Dialer Dialer
+}
+
+func (d *Direct) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	if d.Dialer != nil {
+		return d.dial(ctx, address, func(ctx context.Context, address string) (net.Conn, error) {
+			if d.Timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+				defer cancel()
+			}
+			c, err := d.Dialer.DialContext(ctx, "tcp", address)
+			if err == nil && len(d.Early) > 0 {
+				if _, err = c.Write(d.Early); err != nil {
+					c.Close()
+					return nil, err
+				}
+			}
+			return c, err
+		})
+	}
+
+	dialer := d.Bind.Dialer(d.Key, d.Timeout)
+	dialer.SetMultipathTCP(d.MultipathTCP)
+	dialer.Control = d.TCP.Control(dialer.Control)
+	fastOpen := d.FastOpen && len(d.Early) > 0
+	if fastOpen {
+		ctrl := dialer.Control
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			if ctrl != nil {
+				if err := ctrl(network, address, c); err != nil {
+					return err
+				}
+			}
+			var err error
+			c.Control(func(fd uintptr) {
+				err = setFastOpenConnect(fd)
+			})
+			if err != nil {
+				log.V(1).Infof("failed to enable TCP fastopen to %s: %v\n", address, err)
+			}
+			return nil
+		}
+	}
+	c, err := d.dial(ctx, address, func(ctx context.Context, address string) (net.Conn, error) {
+		c, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil || len(d.Early) == 0 {
+			return c, err
+		}
+		/* with fast open, connect returned before the handshake */
+		if _, err = c.Write(d.Early); err == nil && fastOpen {
+			if d.Timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+				defer cancel()
+			}
+			err = waitFastOpen(ctx, c)
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := d.TCP.Apply(c); err != nil {
+		log.Warningf("failed to tune connection to %s: %v\n", address, err)
+	}
+	return c, nil
+}
+
+// dial resolves address and connects to it according to the strategy.
+func (d *Direct) dial(ctx context.Context, address string, dial dialFunc) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		resolver := d.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		if ips, err = resolver.LookupIP(ctx, d.Strategy.LookupNetwork(), host); err != nil {
+			return nil, err
+		}
+	}
+	return d.Strategy.dial(ctx, ips, port, dial, len(d.Early) == 0)
+}
+
+func (d *Direct) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if d.Dialer != nil {
+		return d.Dialer.ListenPacket(ctx, "udp", ":0")
+	}
+	return d.Bind.ListenPacket(d.Key)
+}
+
+// dialServer connects to an upstream proxy server.
+func dialServer(ctx context.Context, dialer Dialer, server string) (net.Conn, error) {
+	if dialer != nil {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		return dialer.DialContext(ctx, "tcp", server)
+	}
+	d := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+	return d.DialContext(ctx, "tcp", server)
+}
+
+// listenPacket opens an unconnected UDP socket.
+func listenPacket(ctx context.Context, dialer Dialer) (net.PacketConn, error) {
+	if dialer != nil {
+		return dialer.ListenPacket(ctx, "udp", ":0")
+	}
+	return net.ListenPacket("udp", "")
+}
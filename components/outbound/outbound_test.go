@@ -0,0 +1,61 @@
+package outbound
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/icpz/open-snell/components/utils"
+)
+
+/* mptcpEnabled reports whether the kernel hands out MPTCP sockets, false
+ * where the fallback to plain TCP is the only path */
+func mptcpEnabled() bool {
+	b, err := os.ReadFile("/proc/sys/net/mptcp/enabled")
+	return err == nil && strings.TrimSpace(string(b)) == "1"
+}
+
+func TestDirect_MultipathTCP(t *testing.T) {
+	for _, peer := range []bool{false, true} {
+		lc := &net.ListenConfig{}
+		lc.SetMultipathTCP(peer)
+		l, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.Copy(c, c)
+			c.Close()
+		}()
+
+		d := &Direct{
+			Resolver:     stubResolver{net.ParseIP("127.0.0.1")},
+			Strategy:     &DialStrategy{},
+			Timeout:      time.Second,
+			MultipathTCP: true,
+		}
+		c, err := d.DialContext(context.Background(), l.Addr().String())
+		if err != nil {
+			t.Fatalf("DialContext with MPTCP peer %v failed: %v", peer, err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte("hello"))
+		if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+			t.Errorf("echo with MPTCP peer %v failed: %v", peer, err)
+		}
+		/* a plain TCP peer, or a host without MPTCP, falls back */
+		if used, want := utils.MultipathTCPUsed(c), peer && mptcpEnabled(); used != want {
+			t.Errorf("MPTCP peer %v: MultipathTCPUsed = %v, want %v", peer, used, want)
+		}
+		c.Close()
+		l.Close()
+	}
+}
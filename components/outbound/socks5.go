@@ -0,0 +1,153 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/icpz/open-snell/components/socks5"
+)
+
+// Socks5 relays traffic through a SOCKS5 proxy.
+type Socks5 struct {
+	Server string
+	User   *socks5.User
+	// Dialer, if set, connects to the proxy server
+	Dialer Dialer
+}
+
+func NewSocks5(server, username, password string) *Socks5 {
+	s := &Socks5{Server: server}
+	if username != "" {
+		s.User = &socks5.User{Username: username, Password: password}
+	}
+	return s
+}
+
+func (s *Socks5) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	addr := socks5.ParseAddr(address)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid target address %s", address)
+	}
+
+	c, err := dialServer(ctx, s.Dialer, s.Server)
+	if err != nil {
+		return nil, err
+	}
+	if err := handshakeWithContext(ctx, c, func() error {
+		_, err := socks5.ClientHandshake(c, addr, socks5.CmdConnect, s.User)
+		return err
+	}); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("socks5 upstream %s: %w", s.Server, err)
+	}
+	return c, nil
+}
+
+func (s *Socks5) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	c, err := dialServer(ctx, s.Dialer, s.Server)
+	if err != nil {
+		return nil, err
+	}
+
+	var bind socks5.Addr
+	if err := handshakeWithContext(ctx, c, func() error {
+		// the client address is unknown before the socket is bound
+		bind, err = socks5.ClientHandshake(c, socks5.ParseAddr("0.0.0.0:0"), socks5.CmdUDPAssociate, s.User)
+		return err
+	}); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("socks5 upstream %s: %w", s.Server, err)
+	}
+
+	relay := bind.UDPAddr()
+	if relay == nil {
+		c.Close()
+		return nil, errors.New("socks5 upstream returned an unsupported relay address")
+	}
+	if relay.IP.IsUnspecified() {
+		// relay on the same host as the proxy
+		host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+		relay.IP = net.ParseIP(host)
+	}
+
+	pc, err := listenPacket(ctx, s.Dialer)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	go func() {
+		// the association lives as long as the control connection
+		io.Copy(io.Discard, c)
+		pc.Close()
+	}()
+
+	return &socks5PacketConn{PacketConn: pc, ctrl: c, relay: relay}, nil
+}
+
+type socks5PacketConn struct {
+	net.PacketConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+}
+
+func (pc *socks5PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	packet, err := socks5.EncodeUDPPacket(socks5.ParseAddrToSocksAddr(addr), b)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := pc.PacketConn.WriteTo(packet, pc.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (pc *socks5PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, _, err := pc.PacketConn.ReadFrom(b)
+		if err != nil {
+			return 0, nil, err
+		}
+		addr, payload, err := socks5.DecodeUDPPacket(b[:n])
+		if err != nil {
+			continue
+		}
+		from := addr.UDPAddr()
+		if from == nil {
+			continue
+		}
+		return copy(b, payload), from, nil
+	}
+}
+
+func (pc *socks5PacketConn) Close() error {
+	pc.ctrl.Close()
+	return pc.PacketConn.Close()
+}
+
+// handshakeWithContext runs fn with the connection deadline bound to ctx.
+func handshakeWithContext(ctx context.Context, c net.Conn, fn func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+		defer c.SetDeadline(time.Time{})
+	}
+	return fn()
+}
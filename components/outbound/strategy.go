@@ -0,0 +1,210 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	StrategyIPv4Only      = "ipv4-only"
+	StrategyIPv6Only      = "ipv6-only"
+	StrategyPreferIPv4    = "prefer-v4"
+	StrategyPreferIPv6    = "prefer-v6"
+	StrategyHappyEyeballs = "happy-eyeballs"
+
+	// DefaultAttemptDelay is the Connection Attempt Delay recommended by
+	// RFC 8305 section 5.
+	DefaultAttemptDelay = 250 * time.Millisecond
+)
+
+var ErrNoAddress = errors.New("no address matches the dial strategy")
+
+// DialStrategy decides which resolved addresses are tried, in which
+// order, and whether attempts race each other.
+type DialStrategy struct {
+	Mode string
+	// Delay between two racing attempts in happy eyeballs mode.
+	Delay time.Duration
+}
+
+func (s *DialStrategy) Validate() error {
+	if s == nil {
+		return nil
+	}
+	switch s.Mode {
+	case "", StrategyIPv4Only, StrategyIPv6Only, StrategyPreferIPv4, StrategyPreferIPv6, StrategyHappyEyeballs:
+		return nil
+	}
+	return fmt.Errorf("invalid dial strategy %s", s.Mode)
+}
+
+func (s *DialStrategy) mode() string {
+	if s == nil || s.Mode == "" {
+		return StrategyHappyEyeballs
+	}
+	return s.Mode
+}
+
+// LookupNetwork is the network to pass to Resolver.LookupIP.
+func (s *DialStrategy) LookupNetwork() string {
+	switch s.mode() {
+	case StrategyIPv4Only:
+		return "ip4"
+	case StrategyIPv6Only:
+		return "ip6"
+	}
+	return "ip"
+}
+
+// Order filters and sorts addresses in the order they should be tried.
+// Happy eyeballs interleaves the families starting with IPv6 as
+// described in RFC 8305 section 4.
+func (s *DialStrategy) Order(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	switch s.mode() {
+	case StrategyIPv4Only:
+		return v4
+	case StrategyIPv6Only:
+		return v6
+	case StrategyPreferIPv4:
+		return append(v4, v6...)
+	case StrategyPreferIPv6:
+		return append(v6, v4...)
+	}
+
+	out := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+	return out
+}
+
+func (s *DialStrategy) delay() time.Duration {
+	if s == nil || s.Delay <= 0 {
+		return DefaultAttemptDelay
+	}
+	return s.Delay
+}
+
+type dialFunc func(ctx context.Context, address string) (net.Conn, error)
+
+// Dial connects to one of ips, each attempt is bounded by dial itself.
+func (s *DialStrategy) Dial(ctx context.Context, ips []net.IP, port string, dial dialFunc) (net.Conn, error) {
+	return s.dial(ctx, ips, port, dial, true)
+}
+
+// dial connects to one of ips, trying them in turn unless race is set and
+// the strategy races attempts.
+func (s *DialStrategy) dial(ctx context.Context, ips []net.IP, port string, dial dialFunc, race bool) (net.Conn, error) {
+	ips = s.Order(ips)
+	if len(ips) == 0 {
+		return nil, ErrNoAddress
+	}
+	if race && s.mode() == StrategyHappyEyeballs && len(ips) > 1 {
+		return s.race(ctx, ips, port, dial)
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		c, err := dial(ctx, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return c, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// race starts a new attempt every delay, or as soon as the previous one
+// fails, and returns the first established connection.
+func (s *DialStrategy) race(ctx context.Context, ips []net.IP, port string, dial dialFunc) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	results := make(chan result, len(ips))
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	// close connections established by attempts still in flight
+	drain := func(n int) {
+		for ; n > 0; n-- {
+			if r := <-results; r.c != nil {
+				r.c.Close()
+			}
+		}
+	}
+
+	next, pending := 0, 0
+	var lastErr error
+	for {
+		select {
+		case <-timer.C:
+			if next < len(ips) {
+				addr := net.JoinHostPort(ips[next].String(), port)
+				next++
+				pending++
+				go func() {
+					c, err := dial(ctx, addr)
+					results <- result{c, err}
+				}()
+				timer.Reset(s.delay())
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go drain(pending)
+				return r.c, nil
+			}
+			lastErr = r.err
+			if next < len(ips) {
+				// a failed attempt starts the next one right away
+				timer.Reset(0)
+			} else if pending == 0 {
+				return nil, lastErr
+			}
+		case <-ctx.Done():
+			go drain(pending)
+			if lastErr == nil {
+				lastErr = ctx.Err()
+			}
+			return nil, lastErr
+		}
+	}
+}
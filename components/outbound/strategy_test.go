@@ -0,0 +1,127 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDialStrategy_Order(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("192.0.2.2"),
+		net.ParseIP("2001:db8::1"),
+	}
+
+	cases := []struct {
+		mode string
+		want []string
+	}{
+		{StrategyIPv4Only, []string{"192.0.2.1", "192.0.2.2"}},
+		{StrategyIPv6Only, []string{"2001:db8::1"}},
+		{StrategyPreferIPv4, []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}},
+		{StrategyPreferIPv6, []string{"2001:db8::1", "192.0.2.1", "192.0.2.2"}},
+		{StrategyHappyEyeballs, []string{"2001:db8::1", "192.0.2.1", "192.0.2.2"}},
+	}
+	for _, c := range cases {
+		s := &DialStrategy{Mode: c.mode}
+		var got []string
+		for _, ip := range s.Order(ips) {
+			got = append(got, ip.String())
+		}
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("%s: expected %v, got %v", c.mode, c.want, got)
+		}
+	}
+}
+
+func TestDialStrategy_HappyEyeballs(t *testing.T) {
+	s := &DialStrategy{Mode: StrategyHappyEyeballs, Delay: 20 * time.Millisecond}
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}
+
+	server, client := net.Pipe()
+	defer server.Close()
+
+	dial := func(ctx context.Context, address string) (net.Conn, error) {
+		if strings.HasPrefix(address, "[2001:db8::1]") {
+			// a black-holed IPv6 path
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return client, nil
+	}
+
+	start := time.Now()
+	c, err := s.Dial(context.Background(), ips, "443", dial)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if c != client {
+		t.Errorf("expected the IPv4 connection")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("happy eyeballs took too long: %v", elapsed)
+	}
+}
+
+func TestDialStrategy_AllFail(t *testing.T) {
+	s := &DialStrategy{Mode: StrategyHappyEyeballs, Delay: time.Second}
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}
+	errRefused := errors.New("refused")
+
+	_, err := s.Dial(context.Background(), ips, "80", func(ctx context.Context, address string) (net.Conn, error) {
+		return nil, errRefused
+	})
+	if err != errRefused {
+		t.Errorf("expected refused error, got %v", err)
+	}
+
+	_, err = (&DialStrategy{Mode: StrategyIPv6Only}).Dial(context.Background(), ips[1:], "80", nil)
+	if err != ErrNoAddress {
+		t.Errorf("expected ErrNoAddress, got %v", err)
+	}
+}
+
+type stubResolver []net.IP
+
+func (r stubResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	return r, nil
+}
+
+type recordDialer struct {
+	addrs []string
+}
+
+func (d *recordDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.addrs = append(d.addrs, network+" "+address)
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func (d *recordDialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	return nil, errors.New("no UDP")
+}
+
+func TestDirect_Dialer(t *testing.T) {
+	dialer := &recordDialer{}
+	d := &Direct{
+		Resolver: stubResolver{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")},
+		Strategy: &DialStrategy{Mode: StrategyIPv4Only},
+		Timeout:  time.Second,
+		Dialer:   dialer,
+	}
+	c, err := d.DialContext(context.Background(), "example.test:443")
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	c.Close()
+	if len(dialer.addrs) != 1 || dialer.addrs[0] != "tcp 192.0.2.1:443" {
+		t.Errorf("dialed %v", dialer.addrs)
+	}
+	if _, err := d.ListenPacket(context.Background()); err == nil {
+		t.Error("ListenPacket did not use the dialer")
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rules
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Target is the destination of a rewrite rule, an empty Host or a zero
+// Port keeps the requested one.
+type Target struct {
+	Host string
+	Port uint16
+}
+
+// ParseTarget parses "host:port", "host" or ":port".
+func ParseTarget(s string) (Target, error) {
+	var t Target
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		// a bare host, possibly an IPv6 address
+		host, port = strings.Trim(s, "[]"), ""
+	}
+	if port != "" {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || p == 0 {
+			return t, fmt.Errorf("invalid rewrite target %s", s)
+		}
+		t.Port = uint16(p)
+	}
+	t.Host = host
+	if t.Host == "" && t.Port == 0 {
+		return t, fmt.Errorf("invalid rewrite target %s", s)
+	}
+	return t, nil
+}
+
+func (t Target) apply(host string, port uint16) (string, uint16) {
+	if t.Host != "" {
+		host = t.Host
+	}
+	if t.Port != 0 {
+		port = t.Port
+	}
+	return host, port
+}
+
+type rewriteEntry struct {
+	rule   rule
+	target Target
+}
+
+// Rewriter maps requested destinations to other ones before dialing,
+// rules are lines like "DOMAIN,internal.example,10.0.0.5:8080" where
+// the last field is the new target.
+type Rewriter struct {
+	entries []rewriteEntry
+	table   *table
+}
+
+func NewRewriter(lines []string) (*Rewriter, error) {
+	rw := &Rewriter{table: &table{}}
+	for _, line := range lines {
+		rule, rest, err := parseRule(strings.Split(line, ","))
+		if err == nil {
+			switch rule.(type) {
+			case ruleSetRule, geoipRule:
+				err = fmt.Errorf("not supported in rewrite rules")
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rewrite %q: %w", line, err)
+		}
+		if len(rest) == 0 {
+			return nil, fmt.Errorf("rewrite %q: missing target", line)
+		}
+		target, err := ParseTarget(strings.TrimSpace(rest[0]))
+		if err != nil {
+			return nil, fmt.Errorf("rewrite %q: %w", line, err)
+		}
+		rw.entries = append(rw.entries, rewriteEntry{rule, target})
+	}
+	return rw, nil
+}
+
+// Rewrite returns the destination of the first matching rule, ok is false
+// if none matches.
+func (rw *Rewriter) Rewrite(m *Metadata) (host string, port uint16, ok bool) {
+	for _, e := range rw.entries {
+		if e.rule.match(m, rw.table) {
+			host, port = e.target.apply(m.Host, m.Port)
+			return host, port, true
+		}
+	}
+	return m.Host, m.Port, false
+}
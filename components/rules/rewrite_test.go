@@ -0,0 +1,40 @@
+package rules
+
+import "testing"
+
+func TestRewriter_Rewrite(t *testing.T) {
+	rw, err := NewRewriter([]string{
+		"DOMAIN-SUFFIX,internal.example,10.0.0.5",
+		"DST-PORT,53,[2001:db8::53]:5353",
+		"USER,bob,127.0.0.1:22",
+		"IP-CIDR,198.51.100.0/24,:8080",
+	})
+	if err != nil {
+		t.Fatalf("NewRewriter failed: %v", err)
+	}
+
+	cases := []struct {
+		meta Metadata
+		host string
+		port uint16
+		ok   bool
+	}{
+		{Metadata{Host: "git.internal.example", Port: 443}, "10.0.0.5", 443, true},
+		{Metadata{Host: "1.1.1.1", Port: 53}, "2001:db8::53", 5353, true},
+		{Metadata{Host: "example.com", Port: 443, User: "bob"}, "127.0.0.1", 22, true},
+		{Metadata{Host: "198.51.100.7", Port: 80}, "198.51.100.7", 8080, true},
+		{Metadata{Host: "example.com", Port: 443}, "example.com", 443, false},
+	}
+	for _, c := range cases {
+		host, port, ok := rw.Rewrite(&c.meta)
+		if host != c.host || port != c.port || ok != c.ok {
+			t.Errorf("Rewrite(%s:%d) = %s:%d %v, want %s:%d %v", c.meta.Host, c.meta.Port, host, port, ok, c.host, c.port, c.ok)
+		}
+	}
+
+	for _, line := range []string{"DOMAIN,a.test", "DOMAIN,a.test,:0", "GEOIP,CN,1.1.1.1", "RULE-SET,x,1.1.1.1"} {
+		if _, err := NewRewriter([]string{line}); err == nil {
+			t.Errorf("rewrite %q accepted", line)
+		}
+	}
+}
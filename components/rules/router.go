@@ -0,0 +1,250 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/icpz/open-snell/components/geoip"
+)
+
+// Config holds the sources of a routing table.
+type Config struct {
+	// Rules are inline rule lines, "TYPE,payload,action[,no-resolve]",
+	// evaluated before the ones in RulesFile.
+	Rules     []string
+	RulesFile string
+	// RuleSets maps rule-set names to files holding rule lines without
+	// actions, referenced by "RULE-SET,name,action".
+	RuleSets      map[string]string
+	GeoIPDatabase string
+	// Actions lists the valid actions besides "direct" and "reject",
+	// usually the upstream names.
+	Actions []string
+}
+
+type entry struct {
+	rule   rule
+	action string
+}
+
+// ruleSet is a list of rules sharing an action, exact and suffix domains
+// are kept in maps for large lists.
+type ruleSet struct {
+	domains  map[string]struct{}
+	suffixes map[string]struct{}
+	rules    []rule
+}
+
+func (s *ruleSet) match(m *Metadata, t *table) bool {
+	if m.matchDomain(s.matchDomain) {
+		return true
+	}
+	for _, r := range s.rules {
+		if _, ok := r.(ruleSetRule); ok {
+			continue
+		}
+		if r.match(m, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ruleSet) matchDomain(h string) bool {
+	if _, ok := s.domains[h]; ok {
+		return true
+	}
+	for i := 0; i < len(h); i++ {
+		if i == 0 || h[i-1] == '.' {
+			if _, ok := s.suffixes[h[i:]]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type table struct {
+	entries []entry
+	sets    map[string]*ruleSet
+	geoip   *geoip.Reader
+}
+
+// Router matches connections against a rule table, the table can be
+// reloaded from its sources at runtime.
+type Router struct {
+	cfg   Config
+	table atomic.Pointer[table]
+}
+
+func NewRouter(cfg Config) (*Router, error) {
+	r := &Router{cfg: cfg}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload rebuilds the table from the configured files, the previous table
+// is kept on error.
+func (r *Router) Reload() error {
+	t := &table{sets: make(map[string]*ruleSet)}
+
+	lines := r.cfg.Rules
+	if r.cfg.RulesFile != "" {
+		fileLines, err := readLines(r.cfg.RulesFile)
+		if err != nil {
+			return err
+		}
+		lines = append(append([]string{}, lines...), fileLines...)
+	}
+	for _, line := range lines {
+		e, err := parseEntry(line)
+		if err != nil {
+			return err
+		}
+		if !r.validAction(e.action) {
+			return fmt.Errorf("rule %q: unknown action %s", line, e.action)
+		}
+		if name, ok := e.rule.(ruleSetRule); ok {
+			if _, ok := r.cfg.RuleSets[string(name)]; !ok {
+				return fmt.Errorf("unknown rule-set %s", name)
+			}
+		}
+		if _, ok := e.rule.(geoipRule); ok && r.cfg.GeoIPDatabase == "" {
+			return fmt.Errorf("rule %q requires a GeoIP database", line)
+		}
+		t.entries = append(t.entries, e)
+	}
+
+	for name, path := range r.cfg.RuleSets {
+		set, err := loadRuleSet(path, r.cfg.GeoIPDatabase != "")
+		if err != nil {
+			return fmt.Errorf("rule-set %s: %w", name, err)
+		}
+		t.sets[name] = set
+	}
+
+	if r.cfg.GeoIPDatabase != "" {
+		db, err := geoip.Open(r.cfg.GeoIPDatabase)
+		if err != nil {
+			return err
+		}
+		t.geoip = db
+	}
+
+	r.table.Store(t)
+	return nil
+}
+
+// Match returns the action of the first matching rule, or "" if none
+// matches.
+func (r *Router) Match(m *Metadata) string {
+	t := r.table.Load()
+	for _, e := range t.entries {
+		if e.rule.match(m, t) {
+			return e.action
+		}
+	}
+	return ""
+}
+
+func (r *Router) validAction(action string) bool {
+	if action == ActionDirect || action == ActionReject {
+		return true
+	}
+	for _, a := range r.cfg.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+func parseEntry(line string) (entry, error) {
+	rule, rest, err := parseRule(strings.Split(line, ","))
+	if err != nil {
+		return entry{}, fmt.Errorf("rule %q: %w", line, err)
+	}
+	if len(rest) == 0 || strings.TrimSpace(rest[0]) == "" {
+		return entry{}, fmt.Errorf("rule %q: missing action", line)
+	}
+	action := strings.TrimSpace(rest[0])
+	if strings.EqualFold(action, ActionDirect) || strings.EqualFold(action, ActionReject) {
+		action = strings.ToLower(action)
+	}
+	return entry{rule, action}, nil
+}
+
+func loadRuleSet(path string, hasGeoIP bool) (*ruleSet, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+	set := &ruleSet{
+		domains:  make(map[string]struct{}),
+		suffixes: make(map[string]struct{}),
+	}
+	for _, line := range lines {
+		r, _, err := parseRule(strings.Split(line, ","))
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", line, err)
+		}
+		if _, ok := r.(geoipRule); ok && !hasGeoIP {
+			return nil, fmt.Errorf("rule %q requires a GeoIP database", line)
+		}
+		switch r := r.(type) {
+		case domainRule:
+			set.domains[string(r)] = struct{}{}
+		case suffixRule:
+			set.suffixes[string(r)] = struct{}{}
+		default:
+			set.rules = append(set.rules, r)
+		}
+	}
+	return set, nil
+}
+
+// readLines returns the non-empty lines of a file, skipping comments.
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := ParseLine(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// ParseLine trims a rule line, returns "" for blank lines and comments.
+func ParseLine(line string) string {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == ';' || strings.HasPrefix(line, "//") {
+		return ""
+	}
+	return line
+}
@@ -0,0 +1,123 @@
+package rules
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRouter_Match(t *testing.T) {
+	dir := t.TempDir()
+	setPath := filepath.Join(dir, "ads.list")
+	if err := os.WriteFile(setPath, []byte("# ads\nDOMAIN-SUFFIX,ads.example\nDOMAIN,tracker.test\nIP-CIDR,10.9.0.0/16\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved := 0
+	r, err := NewRouter(Config{
+		Rules: []string{
+			"RULE-SET,ads,REJECT",
+			"PROTOCOL,BitTorrent,reject",
+			"USER,alice,proxy",
+			"DOMAIN-KEYWORD,google,proxy",
+			"DOMAIN-REGEX,^cdn[0-9]+\\.,direct",
+			"NETWORK,udp,reject",
+			"DST-PORT,6881-6889,reject",
+			"IP-CIDR,192.168.0.0/16,direct,no-resolve",
+			"IP-CIDR,203.0.113.0/24,proxy",
+		},
+		RuleSets: map[string]string{"ads": setPath},
+		Actions:  []string{"proxy"},
+	})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+
+	cases := []struct {
+		meta   Metadata
+		action string
+	}{
+		{Metadata{Network: "tcp", Host: "x.ads.example", Port: 443}, ActionReject},
+		{Metadata{Network: "tcp", Host: "tracker.test.", Port: 443}, ActionReject},
+		{Metadata{Network: "tcp", Host: "10.9.1.1", Port: 443}, ActionReject},
+		{Metadata{Network: "tcp", Host: "example.com", Port: 443, User: "alice"}, "proxy"},
+		{Metadata{Network: "tcp", Host: "www.Google.com", Port: 443}, "proxy"},
+		{Metadata{Network: "tcp", Host: "192.0.2.1", Port: 443, Protocol: "tls", Domain: "mail.google.com"}, "proxy"},
+		{Metadata{Network: "tcp", Host: "192.0.2.1", Port: 443, Protocol: "tls", Domain: "ads.example"}, ActionReject},
+		{Metadata{Network: "tcp", Host: "192.0.2.1", Port: 51413, Protocol: "bittorrent"}, ActionReject},
+		{Metadata{Network: "tcp", Host: "cdn12.example.com", Port: 443}, ActionDirect},
+		{Metadata{Network: "udp", Host: "example.com", Port: 53}, ActionReject},
+		{Metadata{Network: "tcp", Host: "example.com", Port: 6885}, ActionReject},
+		{Metadata{Network: "tcp", Host: "192.168.1.1", Port: 80}, ActionDirect},
+		{Metadata{Network: "tcp", Host: "example.net", Port: 80, Resolve: func() net.IP {
+			resolved++
+			return net.ParseIP("203.0.113.7")
+		}}, "proxy"},
+		{Metadata{Network: "tcp", Host: "example.org", Port: 80}, ""},
+	}
+	for _, c := range cases {
+		if action := r.Match(&c.meta); action != c.action {
+			t.Errorf("Match(%s:%d) = %q, want %q", c.meta.Host, c.meta.Port, action, c.action)
+		}
+	}
+	if resolved != 1 {
+		t.Errorf("resolved %d times, want 1", resolved)
+	}
+}
+
+func TestRouter_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.conf")
+	os.WriteFile(path, []byte("DOMAIN,example.com,reject\n"), 0o644)
+
+	r, err := NewRouter(Config{RulesFile: path})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	meta := &Metadata{Network: "tcp", Host: "example.com", Port: 443}
+	if action := r.Match(meta); action != ActionReject {
+		t.Fatalf("Match = %q, want reject", action)
+	}
+
+	os.WriteFile(path, []byte("DOMAIN,example.com,proxy\n"), 0o644)
+	if err := r.Reload(); err == nil {
+		t.Fatalf("Reload accepted an unknown action")
+	}
+	if action := r.Match(meta); action != ActionReject {
+		t.Fatalf("Match after failed reload = %q, want reject", action)
+	}
+
+	os.WriteFile(path, []byte("MATCH,direct\n"), 0o644)
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if action := r.Match(meta); action != ActionDirect {
+		t.Fatalf("Match after reload = %q, want direct", action)
+	}
+}
+
+func TestParseRule_Invalid(t *testing.T) {
+	for _, line := range []string{
+		"DOMAIN,example.com",
+		"IP-CIDR,10.0.0.0/33,direct",
+		"DST-PORT,90-80,direct",
+		"NETWORK,icmp,direct",
+		"UNKNOWN,x,direct",
+		"GEOIP,CN,direct",
+		"RULE-SET,missing,direct",
+	} {
+		if _, err := NewRouter(Config{Rules: []string{line}}); err == nil {
+			t.Errorf("rule %q accepted", line)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "set.list")
+	os.WriteFile(path, []byte("DOMAIN,example.com\nGEOIP,CN\n"), 0o644)
+	cfg := Config{
+		Rules:    []string{"RULE-SET,set,direct"},
+		RuleSets: map[string]string{"set": path},
+	}
+	if _, err := NewRouter(cfg); err == nil {
+		t.Errorf("rule-set member GEOIP,CN accepted without a GeoIP database")
+	}
+}
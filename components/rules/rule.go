@@ -0,0 +1,219 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rules
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	ActionDirect = "direct"
+	ActionReject = "reject"
+)
+
+// Metadata describes a connection or UDP packet being routed.
+type Metadata struct {
+	Network string // "tcp" or "udp"
+	Host    string
+	Port    uint16
+	User    string
+	// Protocol and Domain are sniffed from the payload, domain rules
+	// match either Host or Domain.
+	Protocol string
+	Domain   string
+	// Resolve returns the address of domain targets, it is called at most
+	// once, when the first IP based rule is evaluated.
+	Resolve func() net.IP
+
+	ip       net.IP
+	resolved bool
+}
+
+// IP returns the destination address, resolving domains when resolve is
+// set, or nil if unknown.
+func (m *Metadata) IP(resolve bool) net.IP {
+	if m.ip == nil && !m.resolved {
+		if ip := net.ParseIP(m.Host); ip != nil {
+			m.ip = ip
+		} else if resolve && m.Resolve != nil {
+			m.ip = m.Resolve()
+			m.resolved = true
+		}
+	}
+	return m.ip
+}
+
+func (m *Metadata) host() string {
+	return strings.ToLower(strings.TrimSuffix(m.Host, "."))
+}
+
+// matchDomain calls match with the requested host and the sniffed domain.
+func (m *Metadata) matchDomain(match func(host string) bool) bool {
+	return match(m.host()) || (m.Domain != "" && match(strings.ToLower(strings.TrimSuffix(m.Domain, "."))))
+}
+
+// rule matches a connection, rules are built from lines like
+// "DOMAIN-SUFFIX,example.com".
+type rule interface {
+	match(m *Metadata, t *table) bool
+}
+
+type domainRule string
+
+func (r domainRule) match(m *Metadata, t *table) bool {
+	return m.matchDomain(func(h string) bool { return h == string(r) })
+}
+
+type suffixRule string
+
+func (r suffixRule) match(m *Metadata, t *table) bool {
+	return m.matchDomain(func(h string) bool {
+		return h == string(r) || strings.HasSuffix(h, "."+string(r))
+	})
+}
+
+type keywordRule string
+
+func (r keywordRule) match(m *Metadata, t *table) bool {
+	return m.matchDomain(func(h string) bool { return strings.Contains(h, string(r)) })
+}
+
+type regexRule struct{ *regexp.Regexp }
+
+func (r regexRule) match(m *Metadata, t *table) bool { return m.matchDomain(r.MatchString) }
+
+type cidrRule struct {
+	*net.IPNet
+	noResolve bool
+}
+
+func (r cidrRule) match(m *Metadata, t *table) bool {
+	ip := m.IP(!r.noResolve)
+	return ip != nil && r.Contains(ip)
+}
+
+type geoipRule struct {
+	country   string
+	noResolve bool
+}
+
+func (r geoipRule) match(m *Metadata, t *table) bool {
+	if t.geoip == nil {
+		return false
+	}
+	ip := m.IP(!r.noResolve)
+	return ip != nil && t.geoip.Country(ip) == r.country
+}
+
+type portRule struct{ lo, hi uint16 }
+
+func (r portRule) match(m *Metadata, t *table) bool { return m.Port >= r.lo && m.Port <= r.hi }
+
+type userRule string
+
+func (r userRule) match(m *Metadata, t *table) bool { return m.User == string(r) }
+
+type networkRule string
+
+func (r networkRule) match(m *Metadata, t *table) bool { return m.Network == string(r) }
+
+type protocolRule string
+
+func (r protocolRule) match(m *Metadata, t *table) bool { return m.Protocol == string(r) }
+
+type ruleSetRule string
+
+func (r ruleSetRule) match(m *Metadata, t *table) bool {
+	set, ok := t.sets[string(r)]
+	return ok && set.match(m, t)
+}
+
+type matchRule struct{}
+
+func (matchRule) match(m *Metadata, t *table) bool { return true }
+
+// parseRule parses the type and payload fields of a rule line, the
+// remaining fields are returned as they may carry the action and flags.
+func parseRule(fields []string) (rule, []string, error) {
+	typ := strings.ToUpper(strings.TrimSpace(fields[0]))
+	if typ == "MATCH" || typ == "FINAL" {
+		return matchRule{}, fields[1:], nil
+	}
+	if len(fields) < 2 {
+		return nil, nil, fmt.Errorf("missing payload of rule %s", typ)
+	}
+	payload := strings.TrimSpace(fields[1])
+	rest := fields[2:]
+	noResolve := false
+	for _, f := range rest {
+		if strings.TrimSpace(f) == "no-resolve" {
+			noResolve = true
+		}
+	}
+
+	switch typ {
+	case "DOMAIN":
+		return domainRule(strings.ToLower(payload)), rest, nil
+	case "DOMAIN-SUFFIX":
+		return suffixRule(strings.ToLower(strings.TrimPrefix(payload, "."))), rest, nil
+	case "DOMAIN-KEYWORD":
+		return keywordRule(strings.ToLower(payload)), rest, nil
+	case "DOMAIN-REGEX":
+		re, err := regexp.Compile(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		return regexRule{re}, rest, nil
+	case "IP-CIDR", "IP-CIDR6":
+		_, n, err := net.ParseCIDR(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cidrRule{n, noResolve}, rest, nil
+	case "GEOIP":
+		return geoipRule{strings.ToUpper(payload), noResolve}, rest, nil
+	case "DST-PORT":
+		lo, hi, _ := strings.Cut(payload, "-")
+		if hi == "" {
+			hi = lo
+		}
+		l, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid port %s", payload)
+		}
+		h, err := strconv.ParseUint(hi, 10, 16)
+		if err != nil || h < l {
+			return nil, nil, fmt.Errorf("invalid port %s", payload)
+		}
+		return portRule{uint16(l), uint16(h)}, rest, nil
+	case "USER":
+		return userRule(payload), rest, nil
+	case "NETWORK":
+		network := strings.ToLower(payload)
+		if network != "tcp" && network != "udp" {
+			return nil, nil, fmt.Errorf("invalid network %s", payload)
+		}
+		return networkRule(network), rest, nil
+	case "PROTOCOL":
+		return protocolRule(strings.ToLower(payload)), rest, nil
+	case "RULE-SET":
+		return ruleSetRule(payload), rest, nil
+	}
+	return nil, nil, fmt.Errorf("unknown rule type %s", typ)
+}
@@ -0,0 +1,116 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package sip003 runs SIP003 plugins on the server side: the plugin owns
+// the public address and forwards to the server listening on loopback.
+package sip003
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	// restartDelay is the initial delay before restarting an exited
+	// plugin, doubled up to restartDelayMax while it keeps failing.
+	restartDelay    = time.Second
+	restartDelayMax = 30 * time.Second
+	// stopTimeout is the grace period between SIGTERM and killing
+	stopTimeout = 5 * time.Second
+)
+
+// Plugin is a SIP003 plugin binary.
+type Plugin struct {
+	// Path is the plugin executable, looked up in PATH if not a path
+	Path    string
+	Options string
+	// Remote is the public address the plugin listens on, Local the
+	// address of the server it forwards to.
+	Remote string
+	Local  string
+}
+
+// Env returns the SIP003 environment variables of the plugin.
+func (p *Plugin) Env() ([]string, error) {
+	rhost, rport, err := net.SplitHostPort(p.Remote)
+	if err != nil {
+		return nil, err
+	}
+	lhost, lport, err := net.SplitHostPort(p.Local)
+	if err != nil {
+		return nil, err
+	}
+	return []string{
+		"SS_REMOTE_HOST=" + rhost,
+		"SS_REMOTE_PORT=" + rport,
+		"SS_LOCAL_HOST=" + lhost,
+		"SS_LOCAL_PORT=" + lport,
+		"SS_PLUGIN_OPTIONS=" + p.Options,
+	}, nil
+}
+
+// Run starts the plugin and restarts it whenever it exits, until ctx is
+// done. The plugin is then terminated and ctx.Err() returned.
+func (p *Plugin) Run(ctx context.Context) error {
+	env, err := p.Env()
+	if err != nil {
+		return err
+	}
+	delay := restartDelay
+	for {
+		start := time.Now()
+		err := p.run(ctx, env)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var execErr *exec.Error
+		if errors.As(err, &execErr) {
+			return err
+		}
+		/* a plugin that ran for a while is restarted quickly */
+		if time.Since(start) > restartDelayMax {
+			delay = restartDelay
+		}
+		log.Warningf("Plugin %s exited: %v, restarting in %v\n", p.Path, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if delay *= 2; delay > restartDelayMax {
+			delay = restartDelayMax
+		}
+	}
+}
+
+func (p *Plugin) run(ctx context.Context, env []string) error {
+	cmd := exec.CommandContext(ctx, p.Path)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = stopTimeout
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Infof("Plugin %s started at %s, forwarding to %s\n", p.Path, p.Remote, p.Local)
+	return cmd.Wait()
+}
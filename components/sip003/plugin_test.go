@@ -0,0 +1,67 @@
+package sip003
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain lets the test binary act as a plugin, which records its SIP003
+// environment and exits at once, so that it gets restarted.
+func TestMain(m *testing.M) {
+	if out := os.Getenv("SIP003_TEST_OUT"); out != "" && os.Getenv("SS_REMOTE_HOST") != "" {
+		f, err := os.OpenFile(out, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			os.Exit(2)
+		}
+		fmt.Fprintf(f, "%s:%s %s:%s %s\n", os.Getenv("SS_REMOTE_HOST"), os.Getenv("SS_REMOTE_PORT"),
+			os.Getenv("SS_LOCAL_HOST"), os.Getenv("SS_LOCAL_PORT"), os.Getenv("SS_PLUGIN_OPTIONS"))
+		f.Close()
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func TestPlugin_Run(t *testing.T) {
+	restartDelay = 10 * time.Millisecond
+	out := filepath.Join(t.TempDir(), "runs")
+	t.Setenv("SIP003_TEST_OUT", out)
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Executable failed: %v", err)
+	}
+
+	p := &Plugin{Path: exe, Options: "tls;host=example.com", Remote: "[::]:8388", Local: "127.0.0.1:40000"}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.Run(ctx) }()
+
+	var lines []string
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		b, _ := os.ReadFile(out)
+		if lines = strings.Split(strings.TrimSpace(string(b)), "\n"); len(lines) >= 2 {
+			break
+		}
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run = %v, want context.Canceled", err)
+	}
+	if len(lines) < 2 {
+		t.Fatalf("plugin ran %d times, want a restart", len(lines))
+	}
+	if want := ":::8388 127.0.0.1:40000 tls;host=example.com"; lines[0] != want {
+		t.Errorf("plugin environment = %q, want %q", lines[0], want)
+	}
+}
+
+func TestPlugin_NotFound(t *testing.T) {
+	p := &Plugin{Path: "sip003-plugin-does-not-exist", Remote: "0.0.0.0:8388", Local: "127.0.0.1:40000"}
+	if err := p.Run(context.Background()); err == nil {
+		t.Error("Run succeeded without a plugin binary")
+	}
+}
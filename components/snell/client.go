@@ -16,11 +16,13 @@ package snell
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"strconv"
 	"sync"
 	"time"
@@ -47,43 +49,85 @@ type clientSession struct {
 	net.Conn
 	buffer [1]byte
 	reply  bool
+	// err is the reply error read ahead of the caller, returned once
+	err error
+	// tickets, if set, receives the ticket requested with the session
+	tickets *ticketStore
 }
 
 func (s *clientSession) Read(b []byte) (int, error) {
+	if !s.reply || s.err != nil {
+		if err := s.readResponse(); err != nil {
+			return 0, err
+		}
+	}
+	return s.Conn.Read(b)
+}
+
+// readResponse reads the reply of the tunnel request, or returns the
+// error reported by the server.
+func (s *clientSession) readResponse() error {
 	if s.reply {
-		return s.Conn.Read(b)
+		err := s.err
+		s.err = nil
+		return err
+	}
+	if s.tickets != nil {
+		tickets := s.tickets
+		s.tickets = nil
+		if err := tickets.readTicket(s.Conn); err != nil {
+			var appErr *AppError
+			if !errors.As(err, &appErr) {
+				return err
+			}
+			log.V(1).Infof("Server declined session ticket: %v\n", err)
+		}
 	}
 
 	s.reply = true
 	if _, err := io.ReadFull(s.Conn, s.buffer[:]); err != nil {
-		return 0, err
+		return err
 	}
 
 	if s.buffer[0] == ResponseTunnel {
-		return s.Conn.Read(b)
+		return nil
 	} else if s.buffer[0] != ResponseError {
-		return 0, errors.New("Command not support")
+		return errors.New("Command not support")
 	}
 
 	// ResponseError
 	if _, err := io.ReadFull(s.Conn, s.buffer[:]); err != nil {
-		return 0, err
+		return err
 	}
+	code := s.buffer[0]
 	if _, err := io.ReadFull(s.Conn, s.buffer[:]); err != nil {
-		return 0, err
+		return err
 	}
 
 	length := int(s.buffer[0])
 	msg := make([]byte, length)
 
 	if _, err := io.ReadFull(s.Conn, msg); err != nil {
-		return 0, err
+		return err
 	}
 
-	return 0, NewAppError(0, string(msg))
+	return NewAppError(code, string(msg))
+}
+
+// resuming reports whether the session was resumed with a ticket and no
+// reply came yet.
+func (s *clientSession) resuming() bool {
+	r, ok := s.Conn.(interface{ Resumed() bool })
+	return ok && r.Resumed() && s.tickets != nil
 }
 
 func WriteHeader(conn net.Conn, host string, port uint, v2 bool) error {
+	return writeHeader(conn, "", host, port, v2, nil)
+}
+
+// writeHeader sends a connect request, along with early in the same
+// record so that the server gets the first payload with the request.
+func writeHeader(conn net.Conn, id, host string, port uint, v2 bool, early []byte) error {
 	buf := bufferPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer bufferPool.Put(buf)
@@ -95,12 +139,14 @@ func WriteHeader(conn net.Conn, host string, port uint, v2 bool) error {
 	}
 
 	// clientID length & id
-	buf.WriteByte(0)
+	buf.WriteByte(uint8(len(id)))
+	buf.WriteString(id)
 
 	// host & port
 	buf.WriteByte(uint8(len(host)))
 	buf.WriteString(host)
 	binary.Write(buf, binary.BigEndian, uint16(port))
+	buf.Write(early)
 
 	if _, err := conn.Write(buf.Bytes()); err != nil {
 		return err
@@ -116,53 +162,203 @@ type SnellClient struct {
 	cipher   aead.Cipher
 	socks5   *socks5.SockListener
 	isV2     bool
+	opts     ClientOptions
 	pool     *snellPool
+	tickets  *ticketStore
+	// udp carries the UDP associations of SOCKS5 clients
+	udp *Upstream
+}
+
+// earlyDataTimeout bounds the wait for the first payload of a fast reply
+// connection, which is sent along with the request.
+const earlyDataTimeout = 50 * time.Millisecond
+
+// readEarlyData returns what the client sends within earlyDataTimeout,
+// nothing for server first protocols.
+func readEarlyData(c net.Conn) ([]byte, error) {
+	buf := p.Get(p.RelayBufferSize)
+	defer p.Put(buf)
+	c.SetReadDeadline(time.Now().Add(earlyDataTimeout))
+	n, err := c.Read(buf)
+	c.SetReadDeadline(time.Time{})
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, buf[:n]...), nil
+}
+
+// ClientOptions holds optional settings of a snell client.
+type ClientOptions struct {
+	// ClientID is sent in every handshake, allowing the server to apply
+	// per-user settings.
+	ClientID string
+	// Password proves the client to be the user ClientID, servers require
+	// it for users with a password.
+	Password string
+	// MultipathTCP enables MPTCP on sessions to the server, falling back
+	// to plain TCP when unsupported.
+	MultipathTCP bool
+	// ServerTCP tunes the connections to the server
+	ServerTCP utils.TCPOptions
+	// Resumption requests a ticket on every session, so that the next
+	// one skips the Argon2 key derivation.
+	Resumption bool
+	// FastReply answers SOCKS5 requests before the server reply, saving a
+	// round trip and sending the first payload, if any within 50ms, in the
+	// same record as the request.
+	// Failures are then reported by closing the connection instead of a
+	// SOCKS5 error reply.
+	FastReply bool
+	// Datagram carries UDP associations in datagrams to the server UDP
+	// port, see Upstream.Datagram.
+	Datagram bool
+	// Mux carries UDP associations as flows of one shared connection,
+	// see Upstream.Mux.
+	Mux bool
 }
 
 func (s *SnellClient) StreamConn(c net.Conn, target string) (net.Conn, error) {
+	return s.streamConn(c, target, nil)
+}
+
+func (s *SnellClient) streamConn(c net.Conn, target string, early []byte) (net.Conn, error) {
 	host, port, _ := net.SplitHostPort(target)
 	iport, _ := strconv.Atoi(port)
-	err := WriteHeader(c, host, uint(iport), s.isV2)
+	id, err := s.clientID(c)
+	if err != nil {
+		return c, err
+	}
+	err = writeHeader(c, id, host, uint(iport), s.isV2, early)
 	return c, err
 }
 
+// clientID returns the client id to send on c, along with the password
+// proof if any.
+func (s *SnellClient) clientID(c net.Conn) (string, error) {
+	if sess, ok := c.(*snellPoolConn); ok {
+		c = sess.Conn.(*clientSession).Conn
+	}
+	return credential(c, s.opts.ClientID, s.opts.Password)
+}
+
 func (s *SnellClient) newSession() (net.Conn, error) {
-	c, err := net.Dial("tcp", s.server)
+	var t *ticket
+	if s.tickets != nil {
+		t = s.tickets.get()
+	}
+	c, err := s.dialServer(context.Background(), t)
 	if err != nil {
 		return nil, err
 	}
-
-	if tc, ok := c.(*net.TCPConn); ok {
-		tc.SetKeepAlive(true)
+	if s.tickets == nil {
+		return &clientSession{Conn: c}, nil
 	}
+	/* the reply is read along with the one of the first request */
+	id, err := s.clientID(c)
+	if err == nil {
+		err = writeTicketRequest(c, id)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &clientSession{Conn: c, tickets: s.tickets}, nil
+}
 
-	_, port, _ := net.SplitHostPort(s.server)
-	c, _ = obfs.NewObfsClient(c, s.obfsHost, port, s.obfs)
+// serverDialer connects to the server with the TCP settings of a client,
+// for the pooled sessions as well as the UDP associations.
+type serverDialer struct {
+	opts *ClientOptions
+}
 
-	c = &clientSession{
-		Conn: aead.NewConn(c, s.cipher),
+func (d *serverDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		var nd net.Dialer
+		return nd.DialContext(ctx, network, address)
+	}
+	nd := &net.Dialer{Control: d.opts.ServerTCP.Control(nil)}
+	nd.SetMultipathTCP(d.opts.MultipathTCP)
+	c, err := nd.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if d.opts.MultipathTCP {
+		log.V(1).Infof("Session to %s using MPTCP: %v\n", address, utils.MultipathTCPUsed(c))
 	}
 
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+	}
+	if err := d.opts.ServerTCP.Apply(c); err != nil {
+		log.Warningf("Failed to tune connection to %s: %v\n", address, err)
+	}
 	return c, nil
 }
 
-func (s *SnellClient) GetSession(target string) (net.Conn, error) {
-	c, err := s.pool.Get()
+func (d *serverDialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	return lc.ListenPacket(ctx, network, address)
+}
+
+// dialServer opens an encrypted connection to the server, resumed with t
+// if not nil.
+func (s *SnellClient) dialServer(ctx context.Context, t *ticket) (net.Conn, error) {
+	c, err := s.udp.Dialer.DialContext(ctx, "tcp", s.server)
 	if err != nil {
 		return nil, err
 	}
-	log.V(1).Infof("Using conn %s\n", c.LocalAddr().String())
-	c, err = s.StreamConn(c, target)
-	if err != nil {
-		s.DropSession(c)
-		return nil, err
+
+	_, port, _ := net.SplitHostPort(s.server)
+	c, _ = obfs.NewObfsClient(c, s.obfsHost, port, s.obfs)
+	if t != nil {
+		return aead.NewResumedConn(c, s.cipher, t.ticket, t.secret), nil
+	}
+	return aead.NewConn(c, s.cipher), nil
+}
+
+func (s *SnellClient) GetSession(target string) (net.Conn, error) {
+	return s.getSession(target, nil)
+}
+
+// getSession sends a connect request on a pooled session, carrying early
+// as the first payload.
+func (s *SnellClient) getSession(target string, early []byte) (net.Conn, error) {
+	for retry := true; ; retry = false {
+		c, err := s.pool.Get()
+		if err != nil {
+			return nil, err
+		}
+		log.V(1).Infof("Using conn %s\n", c.LocalAddr().String())
+		c, err = s.streamConn(c, target, early)
+		if err != nil {
+			s.DropSession(c)
+			return nil, err
+		}
+
+		/* a server which lost its ticket keys, e.g. on restart, drops
+		 * a resumed session before replying, retry with a full handshake */
+		sess := c.(*snellPoolConn).Conn.(*clientSession)
+		if !retry || !sess.resuming() {
+			return c, nil
+		}
+		var appErr *AppError
+		if err = sess.readResponse(); err != nil && !errors.As(err, &appErr) {
+			log.Warningf("Resumed session to %s failed, retrying: %v\n", s.server, err)
+			s.DropSession(c)
+			continue
+		}
+		sess.err = err
+		return c, nil
 	}
-	return c, nil
 }
 
 func (s *SnellClient) PutSession(c net.Conn) {
 	if pc, ok := c.(*snellPoolConn); ok {
-		pc.Conn.(*clientSession).reply = false
+		sess := pc.Conn.(*clientSession)
+		sess.reply, sess.err = false, nil
 	} else {
 		log.Fatalf("Invalid session type!")
 	}
@@ -184,12 +380,42 @@ func (s *SnellClient) DropSession(c net.Conn) {
 	}
 }
 
+// ListenPacket opens a UDP session through the server, carried as set by
+// ClientOptions.Datagram and ClientOptions.Mux.
+func (s *SnellClient) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	return s.udp.ListenPacket(ctx)
+}
+
 func (s *SnellClient) Close() {
-	s.socks5.Close()
+	if s.socks5 != nil {
+		s.socks5.Close()
+	}
 	s.pool.Close()
+	s.udp.mu.Lock()
+	if s.udp.mux != nil {
+		s.udp.mux.Close()
+	}
+	s.udp.mu.Unlock()
 }
 
 func NewSnellClient(listen, server, obfs, obfsHost, psk string, isV2 bool) (*SnellClient, error) {
+	return NewSnellClientWithOptions(listen, server, obfs, obfsHost, psk, isV2, nil)
+}
+
+// NewSnellClientWithOptions creates a client serving a local SOCKS5 proxy
+// at listen, an empty listen address only allows direct API use such as
+// Resolve and Speedtest.
+func NewSnellClientWithOptions(listen, server, obfs, obfsHost, psk string, isV2 bool, opts *ClientOptions) (*SnellClient, error) {
+	if opts == nil {
+		opts = &ClientOptions{}
+	}
+	if len(opts.ClientID) > 255 || (opts.Password != "" && len(opts.ClientID) > maxClientIDSize) {
+		return nil, fmt.Errorf("client id too long")
+	}
+	if opts.Password != "" && opts.ClientID == "" {
+		return nil, fmt.Errorf("password without a client id")
+	}
+
 	if obfs != "tls" && obfs != "http" && obfs != "" {
 		return nil, fmt.Errorf("invalid snell obfs type %s", obfs)
 	}
@@ -210,7 +436,16 @@ func NewSnellClient(listen, server, obfs, obfsHost, psk string, isV2 bool) (*Sne
 		obfsHost: obfsHost,
 		cipher:   cipher,
 		isV2:     isV2,
+		opts:     *opts,
 	}
+	if opts.Resumption {
+		sc.tickets = &ticketStore{}
+	}
+	sc.udp, _ = NewUpstream(server, obfs, obfsHost, psk, opts.ClientID, isV2)
+	sc.udp.Password = opts.Password
+	sc.udp.Dialer = &serverDialer{opts: &sc.opts}
+	sc.udp.Datagram = opts.Datagram
+	sc.udp.Mux = opts.Mux
 
 	p, err := newSnellPool(MaxPoolCap, PoolTimeoutMS, sc.newSession)
 	if err != nil {
@@ -218,7 +453,10 @@ func NewSnellClient(listen, server, obfs, obfsHost, psk string, isV2 bool) (*Sne
 	}
 	sc.pool = p
 
-	sl, err := socks5.NewSocksProxy(listen, sc.handleSnell)
+	if listen == "" {
+		return sc, nil
+	}
+	sl, err := socks5.NewSocksProxyWithUDP(listen, sc.handleSnell, sc.openUDP)
 	if err != nil {
 		return nil, err
 	}
@@ -227,16 +465,52 @@ func NewSnellClient(listen, server, obfs, obfsHost, psk string, isV2 bool) (*Sne
 	return sc, nil
 }
 
+// openUDP opens the session of a SOCKS5 UDP association.
+func (s *SnellClient) openUDP() (net.PacketConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	return s.ListenPacket(ctx)
+}
+
 func (s *SnellClient) handleSnell(client net.Conn, addr socks5.Addr) {
-	target, err := s.GetSession(addr.String())
 	log.Infof("New target from %s to %s\n", client.RemoteAddr().String(), addr.String())
+	var early []byte
+	if s.opts.FastReply {
+		if err := socks5.WriteReply(client, nil); err != nil {
+			client.Close()
+			return
+		}
+		var err error
+		if early, err = readEarlyData(client); err != nil {
+			log.V(1).Infof("Client %s closed before sending data: %v\n", client.RemoteAddr().String(), err)
+			client.Close()
+			return
+		}
+	}
+
+	target, err := s.getSession(addr.String(), early)
 	if err != nil {
 		log.Warningf("Failed to connect to target %s, error %v\n", addr.String(), err)
+		if !s.opts.FastReply {
+			socks5.WriteReply(client, socks5.ErrGeneralFailure)
+		}
 		client.Close()
 		return
 	}
 
-	_, er := utils.Relay(client, target)
+	var er error
+	if !s.opts.FastReply {
+		er = target.(*snellPoolConn).Conn.(*clientSession).readResponse()
+		if er != nil {
+			log.Warningf("Failed to connect to target %s, error %v\n", addr.String(), er)
+			socks5.WriteReply(client, socksError(er))
+		} else {
+			er = socks5.WriteReply(client, nil)
+		}
+	}
+	if er == nil {
+		_, er = utils.Relay(client, target)
+	}
 
 	client.Close()
 	if s.isV2 {
@@ -247,15 +521,13 @@ func (s *SnellClient) handleSnell(client net.Conn, addr socks5.Addr) {
 			s.DropSession(target)
 			return
 		}
-		switch e := er.(type) {
-		case *net.OpError:
-			if e.Op == "write" {
-				log.V(1).Infof("Ignored write error %v\n", e)
-				er = nil
-			} else if ae, ok := e.Unwrap().(*AppError); ok {
-				log.Errorf("Server reported error: %v\n", ae)
-				er = nil
-			}
+		var ae *AppError
+		if errors.As(er, &ae) {
+			log.Errorf("Server reported error: %v\n", ae)
+			er = nil
+		} else if e, ok := er.(*net.OpError); ok && e.Op == "write" {
+			log.V(1).Infof("Ignored write error %v\n", e)
+			er = nil
 		}
 		buf := p.Get(p.RelayBufferSize)
 		for er == nil {
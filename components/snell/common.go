@@ -19,13 +19,34 @@ const (
 	CommandConnect   byte = 1
 	CommandConnectV2 byte = 5
 	CommandUDP       byte = 6
+	CommandResolve   byte = 7
+	CommandSpeedtest byte = 8
+	CommandTicket    byte = 9
+	// CommandBind registers a reverse tunnel, CommandBindAccept carries
+	// one of its connections back to the client.
+	CommandBind       byte = 10
+	CommandBindAccept byte = 11
+	// CommandUDPDatagram sets up a UDP session carried by datagrams to
+	// the server UDP port instead of the connection.
+	CommandUDPDatagram byte = 12
+	// CommandUDPMux sets up a session carrying many UDP flows, each
+	// frame of which is prefixed by the flow id.
+	CommandUDPMux byte = 13
 
 	CommandUDPForward byte = 1
+	// CommandUDPClose tears down a flow of a CommandUDPMux session, it is
+	// sent by either side.
+	CommandUDPClose byte = 2
 
-	ResponseTunnel byte = 0
-	ResponseReady  byte = 0
-	ResponsePong   byte = 1
-	ResponseError  byte = 2
+	SpeedtestUpload   byte = 1
+	SpeedtestDownload byte = 2
+
+	ResponseTunnel  byte = 0
+	ResponseReady   byte = 0
+	ResponseRecords byte = 0
+	ResponseTicket  byte = 0
+	ResponsePong    byte = 1
+	ResponseError   byte = 2
 
 	Version byte = 1
 )
@@ -39,6 +60,11 @@ func (e *AppError) Error() string {
 	return e.msg
 }
 
+// Code returns the error code reported by the server.
+func (e *AppError) Code() byte {
+	return e.code
+}
+
 func NewAppError(code byte, msg string) error {
 	return &AppError{
 		code: code,
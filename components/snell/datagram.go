@@ -0,0 +1,332 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/golang/glog"
+
+	"github.com/icpz/open-snell/components/aead"
+	p "github.com/icpz/open-snell/components/utils/pool"
+)
+
+// Native UDP sessions are set up by CommandUDPDatagram on a snell
+// connection, answered with ResponseReady, a session id and a session
+// secret. The client then exchanges datagrams with the UDP port of the
+// server, each sealed with a fresh salt by the cipher of the connection
+// keyed by the secret:
+//
+//	client: id | salt | AEAD(sequence | CommandUDPForward request)
+//	server: id | salt | AEAD(UDP reply)
+//
+// Replies go to the address of the latest packet of the session, so that
+// it survives NAT rebinding of the client. The session ends along with
+// the snell connection.
+const (
+	datagramIDSize     = 8
+	datagramSecretSize = 32
+	// datagramSeqSize is the size of the sequence number of client
+	// packets, which must increase to rebind the session address
+	datagramSeqSize = 8
+	// replayWindow is the number of sequence numbers below the highest
+	// one that are still accepted once
+	replayWindow = 64
+)
+
+var errReplayed = errors.New("replayed packet")
+
+// datagramSession is the server side of a native UDP session.
+type datagramSession struct {
+	id     string
+	cipher aead.Cipher
+	conn   net.Conn
+	relay  *udpRelay
+	/* packets waiting for the relay, see serveQueue */
+	queue chan udpPacket
+
+	mu sync.Mutex
+	/* where replies are sent to, set by the latest packet */
+	pc   net.PacketConn
+	addr net.Addr
+	/* highest sequence number, and a bitmap of the ones below it */
+	seq  uint64
+	seen uint64
+}
+
+// check accepts the sequence number of a packet from addr received on pc,
+// the reply address follows the highest sequence number.
+func (d *datagramSession) check(pc net.PacketConn, addr net.Addr, seq uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case d.addr == nil || seq > d.seq:
+		shift := seq - d.seq
+		if d.addr == nil || shift >= replayWindow {
+			d.seen = 0
+		} else {
+			d.seen <<= shift
+		}
+		d.seen |= 1
+		d.seq = seq
+		if d.addr != nil && d.addr.String() != addr.String() {
+			log.V(1).Infof("UDP datagram session rebound from %s to %s\n", d.addr.String(), addr.String())
+		}
+		d.pc, d.addr = pc, addr
+	case d.seq-seq >= replayWindow:
+		return errReplayed
+	default:
+		bit := uint64(1) << (d.seq - seq)
+		if d.seen&bit != 0 {
+			return errReplayed
+		}
+		d.seen |= bit
+	}
+	return nil
+}
+
+func (d *datagramSession) reply(src *net.UDPAddr, b []byte) error {
+	d.mu.Lock()
+	pc, addr := d.pc, d.addr
+	d.mu.Unlock()
+	if addr == nil {
+		return nil
+	}
+	pkt, err := aead.SealPacket([]byte(d.id), d.cipher, appendUDPReply(nil, src, b))
+	if err != nil {
+		return err
+	}
+	_, err = pc.WriteTo(pkt, addr)
+	return err
+}
+
+// datagramTable holds the native UDP sessions by id.
+type datagramTable struct {
+	mu       sync.Mutex
+	sessions map[string]*datagramSession
+}
+
+// add registers d under a new random id.
+func (t *datagramTable) add(d *datagramSession) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sessions == nil {
+		t.sessions = make(map[string]*datagramSession)
+	}
+	id := make([]byte, datagramIDSize)
+	for {
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		if _, ok := t.sessions[string(id)]; !ok {
+			break
+		}
+	}
+	d.id = string(id)
+	t.sessions[d.id] = d
+	return nil
+}
+
+func (t *datagramTable) get(id []byte) *datagramSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessions[string(id)]
+}
+
+func (t *datagramTable) remove(d *datagramSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, d.id)
+}
+
+// handleUDPDatagram sets up a native UDP session, which lasts until the
+// client or the server closes the snell connection.
+func (s *Server) handleUDPDatagram(sess *session) {
+	conn := sess.conn
+	if !s.opts.Datagram {
+		err := fmt.Errorf("UDP datagrams %w", ErrDenied)
+		log.V(1).Infof("UDP datagram session from %s refused: %v\n", conn.RemoteAddr().String(), err)
+		s.writeError(conn, err)
+		return
+	}
+	log.V(1).Infof("New UDP datagram session from %s\n", conn.RemoteAddr().String())
+
+	secret := make([]byte, datagramSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		s.writeError(conn, err)
+		return
+	}
+	ciph := s.cipher
+	if sess.version(s) == CapabilityV1 {
+		ciph = s.fallback
+	}
+	d := &datagramSession{cipher: aead.Resumed(ciph, secret), conn: conn, queue: make(chan udpPacket, udpQueueSize)}
+	relay, err := s.newUDPRelay(sess, d.reply, func() { conn.Close() })
+	if err != nil {
+		log.Errorf("UDP failed to listen: %v\n", err)
+		s.writeError(conn, err)
+		return
+	}
+	defer relay.close()
+	d.relay = relay
+	go relay.serveQueue(d.queue, func(err error) {
+		log.Errorf("UDP datagram session of %s failed to forward: %v\n", conn.RemoteAddr().String(), err)
+		conn.Close()
+	})
+	if err := s.datagrams.add(d); err != nil {
+		s.writeError(conn, err)
+		return
+	}
+	defer s.datagrams.remove(d)
+
+	reply := append([]byte{ResponseReady}, d.id...)
+	if _, err := conn.Write(append(reply, secret...)); err != nil {
+		log.Errorf("Failed to write ResponseReady: %v\n", err)
+		return
+	}
+	sessionCount.Add(sess.metricsName()+"/datagram", 1)
+	io.Copy(io.Discard, conn)
+	log.V(1).Infof("UDP datagram session from %s ends\n", conn.RemoteAddr().String())
+}
+
+// ServeDatagram serves the packets of native UDP sessions received on pc
+// until ctx is done, pc is closed on return. The sessions are set up on
+// snell connections, Datagram must be set in the ServerOptions.
+func (s *Server) ServeDatagram(ctx context.Context, pc net.PacketConn) error {
+	defer pc.Close()
+	stop := context.AfterFunc(ctx, func() { pc.Close() })
+	defer stop()
+
+	buf := p.Get(p.RelayBufferSize)
+	defer p.Put(buf)
+	plain := make([]byte, p.RelayBufferSize)
+
+	for {
+		n, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if err := s.handleDatagram(pc, src, buf[:n], plain); err != nil {
+			log.V(1).Infof("UDP datagram from %s dropped: %v\n", src.String(), err)
+		}
+	}
+}
+
+func (s *Server) handleDatagram(pc net.PacketConn, src net.Addr, pkt, plain []byte) error {
+	if len(pkt) < datagramIDSize {
+		return errors.New("short packet")
+	}
+	d := s.datagrams.get(pkt[:datagramIDSize])
+	if d == nil {
+		return errors.New("unknown session")
+	}
+	b, err := aead.OpenPacket(plain[:0], d.cipher, pkt[datagramIDSize:])
+	if err != nil {
+		return err
+	}
+	if len(b) < datagramSeqSize {
+		return errors.New("short packet")
+	}
+	if err := d.check(pc, src, binary.BigEndian.Uint64(b)); err != nil {
+		return err
+	}
+	host, ip, port, payload, err := parseUDPForward(b[datagramSeqSize:])
+	if err != nil {
+		return err
+	}
+	if !queueUDP(d.queue, host, ip, port, payload) {
+		d.relay.drop("queue", net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	return nil
+}
+
+// datagramConn is the client side of a native UDP session, exchanging
+// datagrams on pc. The session is closed along with ctrl, its snell
+// connection.
+type datagramConn struct {
+	net.Conn
+	ctrl   net.Conn
+	id     []byte
+	cipher aead.Cipher
+	seq    atomic.Uint64
+}
+
+func newDatagramConn(pc, ctrl net.Conn, id []byte, cipher aead.Cipher) *datagramConn {
+	d := &datagramConn{Conn: pc, ctrl: ctrl, id: id, cipher: cipher}
+	go func() {
+		/* the server ends the session by closing the connection */
+		io.Copy(io.Discard, ctrl)
+		d.Close()
+	}()
+	return d
+}
+
+func (d *datagramConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	plain := binary.BigEndian.AppendUint64(nil, d.seq.Add(1))
+	plain, err := appendUDPForward(plain, addr, b)
+	if err != nil {
+		return 0, err
+	}
+	pkt, err := aead.SealPacket(append([]byte{}, d.id...), d.cipher, plain)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := d.Conn.Write(pkt); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (d *datagramConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := p.Get(p.RelayBufferSize)
+	defer p.Put(buf)
+	plain := p.Get(p.RelayBufferSize)
+	defer p.Put(plain)
+	for {
+		n, err := d.Conn.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n < datagramIDSize || string(buf[:datagramIDSize]) != string(d.id) {
+			continue
+		}
+		pkt, err := aead.OpenPacket(plain[:0], d.cipher, buf[datagramIDSize:n])
+		if err != nil {
+			continue
+		}
+		addr, payload, ok := parseUDPReply(pkt)
+		if !ok {
+			continue
+		}
+		return copy(b, payload), addr, nil
+	}
+}
+
+func (d *datagramConn) Close() error {
+	d.ctrl.Close()
+	return d.Conn.Close()
+}
@@ -0,0 +1,145 @@
+package snell
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/icpz/open-snell/components/socks5"
+)
+
+func roundTrip(t *testing.T, pc net.PacketConn, to net.Addr, msg []byte) {
+	t.Helper()
+	if _, err := pc.WriteTo(msg, to); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		t.Errorf("expected %q, got %q", msg, buf[:n])
+	}
+	if from.String() != to.String() {
+		t.Errorf("expected reply from %s, got %s", to, from)
+	}
+}
+
+func TestUpstream_Datagram(t *testing.T) {
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+	srv, err := NewSnellServerWithOptions("127.0.0.1:0", "test-psk", "", &ServerOptions{Datagram: true})
+	if err != nil {
+		t.Fatalf("Failed to start snell server: %v", err)
+	}
+	defer srv.Close()
+
+	u, _ := NewUpstream(srv.Addr().String(), "", "", "test-psk", "", true)
+	u.Datagram = true
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pc, err := u.ListenPacket(ctx)
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer pc.Close()
+	d, ok := pc.(*datagramConn)
+	if !ok {
+		t.Fatalf("expected a datagram session, got %T", pc)
+	}
+	roundTrip(t, pc, echo.LocalAddr(), []byte("ping over datagrams"))
+
+	/* the client address changes, e.g. by NAT rebinding */
+	rebound, err := net.Dial("udp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	d.Conn.Close()
+	d.Conn = rebound
+	roundTrip(t, pc, echo.LocalAddr(), []byte("ping after rebinding"))
+}
+
+func TestUpstream_DatagramFallback(t *testing.T) {
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+	srv := startSnellServer(t, "test-psk")
+	defer srv.Close()
+
+	u, _ := NewUpstream(srv.Addr().String(), "", "", "test-psk", "", true)
+	u.Datagram = true
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pc, err := u.ListenPacket(ctx)
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer pc.Close()
+	if _, ok := pc.(*udpSession); !ok {
+		t.Fatalf("expected UDP over TCP, got %T", pc)
+	}
+	roundTrip(t, pc, echo.LocalAddr(), []byte("ping over tcp"))
+}
+
+func TestDatagramSession_Replay(t *testing.T) {
+	d := &datagramSession{}
+	first := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	second := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1000}
+
+	for _, seq := range []uint64{1, 3, 2} {
+		if err := d.check(nil, first, seq); err != nil {
+			t.Errorf("sequence %d rejected: %v", seq, err)
+		}
+	}
+	if err := d.check(nil, second, 2); err == nil {
+		t.Error("replayed sequence accepted")
+	}
+	if d.addr != first {
+		t.Errorf("replayed packet rebound the session to %s", d.addr)
+	}
+	if err := d.check(nil, second, 3+replayWindow); err != nil {
+		t.Errorf("new sequence rejected: %v", err)
+	}
+	if d.addr != second {
+		t.Errorf("session not rebound, replying to %s", d.addr)
+	}
+	if err := d.check(nil, first, 3); err == nil {
+		t.Error("sequence behind the window accepted")
+	}
+}
+
+func TestServer_DatagramSlowTarget(t *testing.T) {
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+	resolver := &slowResolver{release: make(chan struct{})}
+	defer close(resolver.release)
+	srv, err := NewSnellServerWithOptions("127.0.0.1:0", "test-psk", "", &ServerOptions{Datagram: true, Resolver: resolver})
+	if err != nil {
+		t.Fatalf("Failed to start snell server: %v", err)
+	}
+	defer srv.Close()
+
+	u, _ := NewUpstream(srv.Addr().String(), "", "", "test-psk", "", true)
+	u.Datagram = true
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	slow, err := u.ListenPacket(ctx)
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer slow.Close()
+	pc, err := u.ListenPacket(ctx)
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer pc.Close()
+
+	/* a session waiting for its target to resolve does not hold up others */
+	if _, err := slow.WriteTo([]byte("stuck"), socks5.ParseAddr("slow.test:53")); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	roundTrip(t, pc, echo.LocalAddr(), []byte("ping past a slow session"))
+}
@@ -0,0 +1,128 @@
+package snell
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memDialer connects in memory, serve handles the remote end of streams.
+type memDialer struct {
+	serve func(address string, c net.Conn)
+
+	mu    sync.Mutex
+	dials []string
+}
+
+func (d *memDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials = append(d.dials, address)
+	d.mu.Unlock()
+	local, remote := net.Pipe()
+	go d.serve(address, remote)
+	return local, nil
+}
+
+func (d *memDialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	return newEchoPacketConn(), nil
+}
+
+type memPacket struct {
+	b    []byte
+	addr net.Addr
+}
+
+// echoPacketConn returns every packet written to it, as sent by its
+// destination.
+type echoPacketConn struct {
+	ch     chan memPacket
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newEchoPacketConn() *echoPacketConn {
+	return &echoPacketConn{ch: make(chan memPacket, 16), closed: make(chan struct{})}
+}
+
+func (c *echoPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.ch:
+		return copy(b, p.b), p.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *echoPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case c.ch <- memPacket{append([]byte(nil), b...), addr}:
+		return len(b), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *echoPacketConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *echoPacketConn) LocalAddr() net.Addr                { return &net.UDPAddr{} }
+func (c *echoPacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *echoPacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *echoPacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestServer_Dialer(t *testing.T) {
+	egress := &memDialer{serve: func(address string, c net.Conn) {
+		defer c.Close()
+		io.Copy(c, c)
+	}}
+	srv, err := NewServer("test-psk", "", &ServerOptions{Dialer: egress})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	u, err := NewUpstream("snell.test:443", "", "", "test-psk", "", true)
+	if err != nil {
+		t.Fatalf("NewUpstream failed: %v", err)
+	}
+	u.Dialer = &memDialer{serve: func(address string, c net.Conn) {
+		srv.ServeConn(context.Background(), c)
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := u.DialContext(ctx, "192.0.2.1:80")
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := []byte("hello in memory")
+	go c.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != string(msg) {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+	egress.mu.Lock()
+	if len(egress.dials) != 1 || egress.dials[0] != "192.0.2.1:80" {
+		t.Errorf("egress dials = %v", egress.dials)
+	}
+	egress.mu.Unlock()
+
+	pc, err := u.ListenPacket(ctx)
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer pc.Close()
+	target := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 53}
+	go pc.WriteTo(msg, target)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := pc.ReadFrom(make([]byte, 2048))
+	if err != nil || n != len(msg) || addr.String() != target.String() {
+		t.Fatalf("UDP echo = %d from %v, %v", n, addr, err)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/icpz/open-snell/components/outbound"
+	"github.com/icpz/open-snell/components/socks5"
+)
+
+// Error codes carried in ResponseError, telling the client why a request
+// failed.
+const (
+	ErrorUnknown         byte = 0
+	ErrorResolve         byte = 1
+	ErrorRefused         byte = 2
+	ErrorTimeout         byte = 3
+	ErrorNetUnreachable  byte = 4
+	ErrorHostUnreachable byte = 5
+	ErrorDenied          byte = 6
+	ErrorQuota           byte = 7
+)
+
+var (
+	// ErrDenied is wrapped by requests refused by the server policy
+	ErrDenied = errors.New("not allowed")
+	// ErrQuota is wrapped by requests exceeding a quota
+	ErrQuota = errors.New("quota exceeded")
+)
+
+// errorCode classifies a server side error into an error code.
+func errorCode(err error) byte {
+	var (
+		appErr   *AppError
+		socksErr socks5.Error
+		dnsErr   *net.DNSError
+		netErr   net.Error
+	)
+	switch {
+	case errors.Is(err, errRejected), errors.Is(err, ErrDenied):
+		return ErrorDenied
+	case errors.Is(err, ErrQuota):
+		return ErrorQuota
+	case errors.As(err, &appErr):
+		/* reported by a snell upstream */
+		return appErr.code
+	case errors.As(err, &socksErr):
+		/* reported by a socks5 upstream */
+		switch socksErr {
+		case socks5.ErrConnectionNotAllowed:
+			return ErrorDenied
+		case socks5.ErrNetworkUnreachable:
+			return ErrorNetUnreachable
+		case socks5.ErrHostUnreachable:
+			return ErrorHostUnreachable
+		case socks5.ErrConnectionRefused:
+			return ErrorRefused
+		case socks5.ErrTTLExpired:
+			return ErrorTimeout
+		}
+	case errors.As(err, &dnsErr), errors.Is(err, outbound.ErrNoAddress):
+		return ErrorResolve
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ErrorNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return ErrorHostUnreachable
+	case errors.Is(err, syscall.ETIMEDOUT), errors.Is(err, context.DeadlineExceeded):
+		return ErrorTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTimeout
+	}
+	return ErrorUnknown
+}
+
+// socksError translates an error of a snell request into the reply of
+// the SOCKS5 request, as defined in RFC 1928 section 6.
+func socksError(err error) socks5.Error {
+	var appErr *AppError
+	if !errors.As(err, &appErr) {
+		return socks5.ErrGeneralFailure
+	}
+	return socksReply(appErr.code)
+}
+
+// socksReply maps an error code to a SOCKS5 reply.
+func socksReply(code byte) socks5.Error {
+	switch code {
+	case ErrorResolve, ErrorHostUnreachable:
+		return socks5.ErrHostUnreachable
+	case ErrorRefused:
+		return socks5.ErrConnectionRefused
+	case ErrorTimeout:
+		return socks5.ErrTTLExpired
+	case ErrorNetUnreachable:
+		return socks5.ErrNetworkUnreachable
+	case ErrorDenied, ErrorQuota:
+		return socks5.ErrConnectionNotAllowed
+	}
+	return socks5.ErrGeneralFailure
+}
@@ -0,0 +1,82 @@
+package snell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/icpz/open-snell/components/outbound"
+	"github.com/icpz/open-snell/components/socks5"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code byte
+	}{
+		{errors.New("boom"), ErrorUnknown},
+		{&net.DNSError{Err: "no such host", Name: "x.test", IsNotFound: true}, ErrorResolve},
+		{outbound.ErrNoAddress, ErrorResolve},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.AddrError{}}, ErrorUnknown},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, ErrorRefused},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ENETUNREACH}, ErrorNetUnreachable},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.EHOSTUNREACH}, ErrorHostUnreachable},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), ErrorTimeout},
+		{errRejected, ErrorDenied},
+		{fmt.Errorf("udp %w", ErrDenied), ErrorDenied},
+		{fmt.Errorf("socks5 upstream: %w", socks5.ErrConnectionRefused), ErrorRefused},
+		{NewAppError(ErrorQuota, "quota exceeded"), ErrorQuota},
+	}
+	for _, tt := range tests {
+		if code := errorCode(tt.err); code != tt.code {
+			t.Errorf("errorCode(%v) = %d, want %d", tt.err, code, tt.code)
+		}
+	}
+}
+
+func TestClient_SocksReply(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	closed.Close()
+
+	srv := startSnellServer(t, "test-psk")
+	defer srv.Close()
+	c, err := NewSnellClient("127.0.0.1:0", srv.listener.Addr().String(), "", "", "test-psk", true)
+	if err != nil {
+		t.Fatalf("NewSnellClient failed: %v", err)
+	}
+	defer c.Close()
+
+	connect := func(target string) error {
+		conn, err := net.DialTimeout("tcp", c.socks5.Listener.Addr().String(), 5*time.Second)
+		if err != nil {
+			t.Fatalf("Failed to dial SOCKS5 proxy: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		_, err = socks5.ClientHandshake(conn, socks5.ParseAddr(target), socks5.CmdConnect, nil)
+		return err
+	}
+
+	if err := connect(echo.Addr().String()); err != nil {
+		t.Errorf("CONNECT to echo server failed: %v", err)
+	}
+	if err := connect(closed.Addr().String()); err != socks5.ErrConnectionRefused {
+		t.Errorf("CONNECT to closed port error = %v, want %v", err, socks5.ErrConnectionRefused)
+	}
+	if err := connect("nonexistent.invalid:80"); err != socks5.ErrHostUnreachable {
+		t.Errorf("CONNECT to unknown host error = %v, want %v", err, socks5.ErrHostUnreachable)
+	}
+	/* the pooled session survives failed requests */
+	if err := connect(echo.Addr().String()); err != nil {
+		t.Errorf("CONNECT after failures failed: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package snell
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/icpz/open-snell/components/socks5"
+)
+
+// countConn counts the bytes written to it
+type countConn struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// countDialer wraps the connections of memDialer in countConn
+type countDialer struct {
+	*memDialer
+	n *atomic.Int64
+}
+
+func (d *countDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	c, err := d.memDialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &countConn{Conn: c, n: d.n}, nil
+}
+
+// dialHooks records the bytes written to the target once it is dialed
+type dialHooks struct {
+	NopHooks
+	written *atomic.Int64
+	atDial  atomic.Int64
+}
+
+func (h *dialHooks) OnDial(ctx context.Context, req *Request, target string, err error) {
+	h.atDial.Store(h.written.Load())
+}
+
+func TestClient_FastReplyEarlyData(t *testing.T) {
+	var written atomic.Int64
+	egress := &memDialer{serve: func(address string, c net.Conn) {
+		defer c.Close()
+		io.Copy(c, c)
+	}}
+	dialer := &countDialer{memDialer: egress, n: &written}
+	hooks := &dialHooks{written: &written}
+	srv, err := NewSnellServerWithOptions("127.0.0.1:0", "test-psk", "", &ServerOptions{Dialer: dialer, FastOpen: true, Hooks: hooks})
+	if err != nil {
+		t.Fatalf("Failed to start snell server: %v", err)
+	}
+	defer srv.Close()
+	c, err := NewSnellClientWithOptions("127.0.0.1:0", srv.Addr().String(), "", "", "test-psk", true, &ClientOptions{FastReply: true})
+	if err != nil {
+		t.Fatalf("NewSnellClientWithOptions failed: %v", err)
+	}
+	defer c.Close()
+
+	conn, err := net.DialTimeout("tcp", c.socks5.Listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial SOCKS5 proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := socks5.ClientHandshake(conn, socks5.ParseAddr("192.0.2.1:80"), socks5.CmdConnect, nil); err != nil {
+		t.Fatalf("SOCKS5 handshake failed: %v", err)
+	}
+	msg := []byte("hello early")
+	conn.Write(msg)
+	if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if n := hooks.atDial.Load(); n != int64(len(msg)) {
+		t.Errorf("target got %d bytes when dialed, want the %d bytes sent with the request", n, len(msg))
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// Request describes a client request after the snell handshake.
+type Request struct {
+	RemoteAddr net.Addr
+	// ClientID is the id sent by the client, it may not match a User
+	ClientID string
+	Command  byte
+	// Target is "host:port" of connect requests, it may be rewritten by
+	// Hooks.OnRequest
+	Target string
+}
+
+// RelayStats summarizes a finished tunnel.
+type RelayStats struct {
+	// Upload counts the bytes sent to the target, Download the bytes sent
+	// back to the client.
+	Upload   int64
+	Download int64
+	Duration time.Duration
+	Err      error
+}
+
+// Packet describes a UDP packet forwarded for a client.
+type Packet struct {
+	// Addr is the target of the packet, or its source for replies
+	Addr  net.Addr
+	Size  int
+	Reply bool
+}
+
+// Hooks observes and influences the sessions of a server, NopHooks can be
+// embedded to implement only some of the methods. Hooks are called from
+// the session goroutines, concurrently.
+type Hooks interface {
+	// OnAccept is called for each client connection before the handshake,
+	// the returned context is passed to the hooks of its requests. An
+	// error closes the connection.
+	OnAccept(ctx context.Context, conn net.Conn) (context.Context, error)
+	// OnRequest is called after the handshake of each request, it may
+	// rewrite req.Target. An error rejects the request, reported as
+	// ErrorDenied unless it wraps ErrQuota or another classified error.
+	OnRequest(ctx context.Context, req *Request) error
+	// OnDial is called once the target of a connect request was dialed,
+	// target is the address after rewriting and err the dial result.
+	OnDial(ctx context.Context, req *Request, target string, err error)
+	// OnRelayDone is called once a tunnel is closed.
+	OnRelayDone(ctx context.Context, req *Request, stats *RelayStats)
+	// OnPacket is called for each UDP packet forwarded to a target, and
+	// for each reply sent back to the client.
+	OnPacket(ctx context.Context, req *Request, pkt *Packet)
+}
+
+// NopHooks implements Hooks doing nothing.
+type NopHooks struct{}
+
+func (NopHooks) OnAccept(ctx context.Context, conn net.Conn) (context.Context, error) {
+	return ctx, nil
+}
+
+func (NopHooks) OnRequest(ctx context.Context, req *Request) error { return nil }
+
+func (NopHooks) OnDial(ctx context.Context, req *Request, target string, err error) {}
+
+func (NopHooks) OnRelayDone(ctx context.Context, req *Request, stats *RelayStats) {}
+
+func (NopHooks) OnPacket(ctx context.Context, req *Request, pkt *Packet) {}
+
+// onRequest calls Hooks.OnRequest for sess.req, unclassified errors are
+// wrapped as ErrDenied.
+func (s *Server) onRequest(sess *session) error {
+	target := sess.req.Target
+	err := s.opts.Hooks.OnRequest(sess.ctx, sess.req)
+	if err != nil {
+		if errorCode(err) == ErrorUnknown {
+			err = fmt.Errorf("%w: %v", ErrDenied, err)
+		}
+		log.Infof("Request from %s rejected by hook: %v\n", sess.req.RemoteAddr.String(), err)
+		return err
+	}
+	if sess.req.Target != target {
+		log.V(1).Infof("Target %s rewritten by hook to %s\n", target, sess.req.Target)
+	}
+	return nil
+}
+
+// clientID reports the user name to hooks for the inbounds without a
+// snell client id.
+func clientID(u *User) string {
+	if u == nil {
+		return ""
+	}
+	return u.Name
+}
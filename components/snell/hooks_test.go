@@ -0,0 +1,126 @@
+package snell
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingHooks struct {
+	NopHooks
+	target string
+
+	mu      sync.Mutex
+	accepts int
+	dials   []string
+	relays  []RelayStats
+	packets []Packet
+}
+
+func (h *recordingHooks) OnAccept(ctx context.Context, conn net.Conn) (context.Context, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.accepts++
+	return ctx, nil
+}
+
+func (h *recordingHooks) OnRequest(ctx context.Context, req *Request) error {
+	switch req.Target {
+	case "blocked.test:80":
+		return errors.New("blocked")
+	case "alias.test:80":
+		req.Target = h.target
+	}
+	return nil
+}
+
+func (h *recordingHooks) OnDial(ctx context.Context, req *Request, target string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dials = append(h.dials, target)
+}
+
+func (h *recordingHooks) OnRelayDone(ctx context.Context, req *Request, stats *RelayStats) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.relays = append(h.relays, *stats)
+}
+
+func (h *recordingHooks) OnPacket(ctx context.Context, req *Request, pkt *Packet) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.packets = append(h.packets, *pkt)
+}
+
+func TestServer_Hooks(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	uecho := startUDPEchoServer(t)
+	defer uecho.Close()
+
+	hooks := &recordingHooks{target: echo.Addr().String()}
+	srv, u := startSnellServerWithOptions(t, &ServerOptions{Hooks: hooks})
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var appErr *AppError
+	if _, err := u.DialContext(ctx, "blocked.test:80"); !errors.As(err, &appErr) || appErr.Code() != ErrorDenied {
+		t.Errorf("blocked target error = %v, want denied", err)
+	}
+
+	c, err := u.DialContext(ctx, "alias.test:80")
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	msg := []byte("hello hooks")
+	c.Write(msg)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, make([]byte, len(msg))); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	c.Close()
+
+	pc, err := u.ListenPacket(ctx)
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	pc.WriteTo(msg, uecho.LocalAddr())
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := pc.ReadFrom(make([]byte, 2048)); err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	pc.Close()
+
+	/* hooks may run after the client got its data */
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		hooks.mu.Lock()
+		done := len(hooks.relays) > 0 && len(hooks.packets) > 1
+		hooks.mu.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	if hooks.accepts != 3 {
+		t.Errorf("accepts = %d, want 3", hooks.accepts)
+	}
+	if len(hooks.dials) != 1 || hooks.dials[0] != echo.Addr().String() {
+		t.Errorf("dials = %v, want the rewritten target only", hooks.dials)
+	}
+	if len(hooks.relays) != 1 || hooks.relays[0].Upload != int64(len(msg)) || hooks.relays[0].Download != int64(len(msg)) {
+		t.Errorf("relays = %+v", hooks.relays)
+	}
+	if len(hooks.packets) != 2 || hooks.packets[0].Reply || !hooks.packets[1].Reply || hooks.packets[1].Size != len(msg) {
+		t.Errorf("packets = %+v", hooks.packets)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/golang/glog"
+
+	"github.com/icpz/open-snell/components/socks5"
+	p "github.com/icpz/open-snell/components/utils/pool"
+)
+
+// authUser returns the user named name if password matches, nil otherwise.
+func (s *Server) authUser(name, password string) *User {
+	u := s.users[name]
+	if u == nil || u.Password == "" {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) != 1 {
+		return nil
+	}
+	return u
+}
+
+// serveTunnel runs the hooks of the connect request sess.req and relays it
+// on the inbounds other than snell, reply reports the dial result.
+func (s *Server) serveTunnel(sess *session, reply func(error) error) error {
+	target := sess.req.Target
+	hookErr := s.onRequest(sess)
+	if hookErr == nil {
+		target = sess.req.Target
+	}
+	el, err := s.tunnel(sess, target, hookErr, reply)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if el != nil && !errors.Is(el, io.EOF) {
+		log.V(1).Infof("Tunnel from %s to %s closed: %v\n", sess.req.RemoteAddr.String(), target, el)
+	}
+	return nil
+}
+
+// ServeSocks accepts SOCKS5 clients on l, like Serve does for snell
+// clients.
+func (s *Server) ServeSocks(ctx context.Context, l net.Listener) error {
+	return s.serve(ctx, l, s.ServeSocksConn)
+}
+
+// ServeSocksConn serves the SOCKS5 connection c, the CONNECT and UDP
+// ASSOCIATE requests of authenticated users are accepted. c is closed on
+// return.
+func (s *Server) ServeSocksConn(ctx context.Context, c net.Conn) error {
+	defer c.Close()
+	ctx, ok := s.acceptConn(ctx, c)
+	if !ok {
+		return nil
+	}
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+
+	var user *User
+	addr, command, _, err := socks5.ReadRequestWithAuth(c, func(u *socks5.User) bool {
+		user = s.authUser(u.Username, u.Password)
+		return user != nil
+	})
+	if err != nil {
+		return fmt.Errorf("socks5 handshake: %w", err)
+	}
+	sess := &session{ctx: ctx, conn: c, user: user}
+	sessionCount.Add(sess.metricsName()+"/socks5", 1)
+
+	switch command {
+	case socks5.CmdConnect:
+		target := addr.String()
+		log.Infof("New SOCKS5 target from %s to %s\n", c.RemoteAddr().String(), target)
+		sess.req = &Request{RemoteAddr: c.RemoteAddr(), ClientID: clientID(user), Command: CommandConnect, Target: target}
+		return s.serveTunnel(sess, func(err error) error {
+			if err != nil {
+				return writeSocksReply(c, socksReply(errorCode(err)))
+			}
+			return writeSocksReply(c, nil)
+		})
+	case socks5.CmdUDPAssociate:
+		sess.req = &Request{RemoteAddr: c.RemoteAddr(), ClientID: clientID(user), Command: CommandUDP}
+		return s.handleSocksUDP(sess)
+	}
+	writeSocksReply(c, socks5.ErrCommandNotSupported)
+	return nil
+}
+
+// writeSocksReply answers a SOCKS5 request with the local address of c,
+// 0.0.0.0:0 if it has none, e.g. in memory.
+func writeSocksReply(c net.Conn, rep error) error {
+	bnd := socks5.ParseAddr(c.LocalAddr().String())
+	if bnd == nil {
+		bnd = socks5.ParseAddr("0.0.0.0:0")
+	}
+	return socks5.WriteReplyAddr(c, rep, bnd)
+}
+
+// handleSocksUDP relays the packets of a UDP association until its control
+// connection is closed. Packets are accepted from the IP address of the
+// control connection only.
+func (s *Server) handleSocksUDP(sess *session) error {
+	conn := sess.conn
+	if err := sess.allow(s, CapabilityUDP); err != nil {
+		log.Infof("UDP from %s denied: %v\n", conn.RemoteAddr().String(), err)
+		return writeSocksReply(conn, socks5.ErrConnectionNotAllowed)
+	}
+	if err := s.onRequest(sess); err != nil {
+		return writeSocksReply(conn, socksReply(errorCode(err)))
+	}
+
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		writeSocksReply(conn, socks5.ErrGeneralFailure)
+		return fmt.Errorf("UDP associate: %w", err)
+	}
+	defer pc.Close()
+
+	var client atomic.Pointer[net.UDPAddr]
+	relay, err := s.newUDPRelay(sess, func(src *net.UDPAddr, b []byte) error {
+		pkt, err := socks5.EncodeUDPPacket(socks5.ParseAddrToSocksAddr(src), b)
+		if err != nil {
+			return err
+		}
+		_, err = pc.WriteTo(pkt, client.Load())
+		return err
+	}, func() { conn.Close() })
+	if err != nil {
+		writeSocksReply(conn, socksReply(errorCode(err)))
+		return fmt.Errorf("UDP associate: %w", err)
+	}
+	defer relay.close()
+	if err := socks5.WriteReplyAddr(conn, nil, socks5.ParseAddrToSocksAddr(pc.LocalAddr())); err != nil {
+		return err
+	}
+	log.V(1).Infof("New SOCKS5 UDP association from %s at %s\n", conn.RemoteAddr().String(), pc.LocalAddr().String())
+
+	/* the association ends along with the control connection */
+	go func() {
+		io.Copy(io.Discard, conn)
+		pc.Close()
+	}()
+
+	var allowed net.IP
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		allowed = addr.IP
+	}
+	buf := p.Get(p.RelayBufferSize)
+	defer p.Put(buf)
+	for {
+		n, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		usrc := src.(*net.UDPAddr)
+		if allowed != nil && !allowed.Equal(usrc.IP) {
+			log.V(1).Infof("SOCKS5 UDP packet from unexpected %s dropped\n", src.String())
+			continue
+		}
+		addr, payload, err := socks5.DecodeUDPPacket(buf[:n])
+		if err != nil {
+			log.V(1).Infof("SOCKS5 UDP packet from %s dropped: %v\n", src.String(), err)
+			continue
+		}
+		if client.Load() == nil {
+			client.Store(usrc)
+		}
+
+		host, sport, _ := net.SplitHostPort(addr.String())
+		port, _ := strconv.Atoi(sport)
+		if err := relay.forward(host, net.ParseIP(host), port, payload); err != nil {
+			return fmt.Errorf("UDP forward: %w", err)
+		}
+	}
+}
+
+// ServeHTTPConnect accepts HTTP CONNECT proxy clients on l, like Serve
+// does for snell clients.
+func (s *Server) ServeHTTPConnect(ctx context.Context, l net.Listener) error {
+	return s.serve(ctx, l, s.ServeHTTPConnectConn)
+}
+
+// ServeHTTPConnectConn serves the CONNECT request of an HTTP proxy client
+// authenticated with Basic auth, c is closed on return.
+func (s *Server) ServeHTTPConnectConn(ctx context.Context, c net.Conn) error {
+	defer c.Close()
+	ctx, ok := s.acceptConn(ctx, c)
+	if !ok {
+		return nil
+	}
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return fmt.Errorf("read HTTP request: %w", err)
+	}
+	if req.Method != http.MethodConnect {
+		return writeHTTPStatus(c, http.StatusMethodNotAllowed, "")
+	}
+	name, password, _ := proxyAuth(req)
+	user := s.authUser(name, password)
+	if user == nil {
+		log.V(1).Infof("HTTP proxy client %s failed to authenticate\n", c.RemoteAddr().String())
+		return writeHTTPStatus(c, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"snell\"\r\n")
+	}
+	target := req.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return writeHTTPStatus(c, http.StatusBadRequest, "")
+	}
+	log.Infof("New HTTP CONNECT target from %s to %s\n", c.RemoteAddr().String(), target)
+
+	sess := &session{ctx: ctx, conn: &bufferedConn{Conn: c, r: br}, user: user}
+	sessionCount.Add(sess.metricsName()+"/http", 1)
+	sess.req = &Request{RemoteAddr: c.RemoteAddr(), ClientID: clientID(user), Command: CommandConnect, Target: target}
+	return s.serveTunnel(sess, func(err error) error {
+		if err != nil {
+			return writeHTTPStatus(c, httpStatus(errorCode(err)), "")
+		}
+		return writeHTTPStatus(c, http.StatusOK, "")
+	})
+}
+
+// proxyAuth returns the Basic credentials of the Proxy-Authorization
+// header.
+func proxyAuth(req *http.Request) (name, password string, ok bool) {
+	auth, ok := strings.CutPrefix(req.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(b), ":")
+}
+
+// httpStatus maps an error code to the status of a CONNECT response.
+func httpStatus(code byte) int {
+	switch code {
+	case ErrorDenied, ErrorQuota:
+		return http.StatusForbidden
+	case ErrorTimeout:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// writeHTTPStatus writes a response without body, header holds the extra
+// header lines.
+func writeHTTPStatus(w io.Writer, code int, header string) error {
+	if code != http.StatusOK {
+		header += "Connection: close\r\nContent-Length: 0\r\n"
+	}
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n%s\r\n", code, http.StatusText(code), header)
+	return err
+}
+
+// bufferedConn reads the data buffered by r ahead of the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Buffered returns the number of bytes readable without blocking.
+func (c *bufferedConn) Buffered() int {
+	return c.r.Buffered()
+}
@@ -0,0 +1,207 @@
+package snell
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/icpz/open-snell/components/socks5"
+)
+
+func newInboundServer(t *testing.T) *Server {
+	t.Helper()
+	egress := &memDialer{serve: func(address string, c net.Conn) {
+		defer c.Close()
+		io.Copy(c, c)
+	}}
+	srv, err := NewServer("test-psk", "", &ServerOptions{
+		Dialer: egress,
+		Users:  []*User{{Name: "alice", Password: "alice-pass"}, {Name: "bob"}},
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	return srv
+}
+
+func expectEcho(t *testing.T, c net.Conn) {
+	t.Helper()
+	msg := []byte("hello inbound")
+	go c.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != string(msg) {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+}
+
+func TestServer_SocksConn(t *testing.T) {
+	srv := newInboundServer(t)
+
+	for _, tt := range []struct {
+		user *socks5.User
+		ok   bool
+	}{
+		{&socks5.User{Username: "alice", Password: "alice-pass"}, true},
+		{&socks5.User{Username: "alice", Password: "wrong"}, false},
+		{&socks5.User{Username: "bob", Password: ""}, false},
+		{nil, false},
+	} {
+		client, server := net.Pipe()
+		go srv.ServeSocksConn(context.Background(), server)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+
+		_, err := socks5.ClientHandshake(client, socks5.ParseAddr("192.0.2.1:80"), socks5.CmdConnect, tt.user)
+		if (err == nil) != tt.ok {
+			t.Errorf("handshake as %v = %v, want ok %v", tt.user, err, tt.ok)
+		} else if tt.ok {
+			expectEcho(t, client)
+		}
+		client.Close()
+	}
+}
+
+func TestServer_SocksUDP(t *testing.T) {
+	srv := newInboundServer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.ServeSocks(ctx, l)
+
+	ctrl, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer ctrl.Close()
+	ctrl.SetDeadline(time.Now().Add(5 * time.Second))
+	bnd, err := socks5.ClientHandshake(ctrl, socks5.ParseAddr("0.0.0.0:0"), socks5.CmdUDPAssociate, &socks5.User{Username: "alice", Password: "alice-pass"})
+	if err != nil {
+		t.Fatalf("UDP associate failed: %v", err)
+	}
+
+	client, err := net.Dial("udp", bnd.String())
+	if err != nil {
+		t.Fatalf("Dial UDP failed: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := []byte("hello datagram")
+	pkt, _ := socks5.EncodeUDPPacket(socks5.ParseAddr("192.0.2.2:53"), msg)
+	if _, err := client.Write(pkt); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	buf := make([]byte, 2048)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	addr, payload, err := socks5.DecodeUDPPacket(buf[:n])
+	if err != nil || addr.String() != "192.0.2.2:53" || string(payload) != string(msg) {
+		t.Errorf("reply = %v %q, %v", addr, payload, err)
+	}
+}
+
+func TestSnellClient_UDPAssociate(t *testing.T) {
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+	srv, err := NewSnellServerWithOptions("127.0.0.1:0", "test-psk", "", &ServerOptions{Datagram: true})
+	if err != nil {
+		t.Fatalf("Failed to start snell server: %v", err)
+	}
+	defer srv.Close()
+
+	for name, opts := range map[string]*ClientOptions{
+		"tcp":      {},
+		"datagram": {Datagram: true},
+		"mux":      {Mux: true},
+	} {
+		c, err := NewSnellClientWithOptions("127.0.0.1:0", srv.Addr().String(), "", "", "test-psk", true, opts)
+		if err != nil {
+			t.Fatalf("%s: NewSnellClientWithOptions failed: %v", name, err)
+		}
+		ctrl, err := net.DialTimeout("tcp", c.socks5.Listener.Addr().String(), 5*time.Second)
+		if err != nil {
+			t.Fatalf("%s: Dial failed: %v", name, err)
+		}
+		ctrl.SetDeadline(time.Now().Add(5 * time.Second))
+		bnd, err := socks5.ClientHandshake(ctrl, socks5.ParseAddr("0.0.0.0:0"), socks5.CmdUDPAssociate, nil)
+		if err != nil {
+			t.Fatalf("%s: UDP associate failed: %v", name, err)
+		}
+
+		pc, err := net.Dial("udp", bnd.String())
+		if err != nil {
+			t.Fatalf("%s: Dial UDP failed: %v", name, err)
+		}
+		pc.SetDeadline(time.Now().Add(5 * time.Second))
+		msg := []byte("hello " + name)
+		pkt, _ := socks5.EncodeUDPPacket(socks5.ParseAddr(echo.LocalAddr().String()), msg)
+		if _, err := pc.Write(pkt); err != nil {
+			t.Fatalf("%s: Write failed: %v", name, err)
+		}
+		buf := make([]byte, 2048)
+		n, err := pc.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: Read failed: %v", name, err)
+		}
+		addr, payload, err := socks5.DecodeUDPPacket(buf[:n])
+		if err != nil || addr.String() != echo.LocalAddr().String() || string(payload) != string(msg) {
+			t.Errorf("%s: reply = %v %q, %v", name, addr, payload, err)
+		}
+		pc.Close()
+		ctrl.Close()
+		c.Close()
+	}
+}
+
+func TestServer_HTTPConnectConn(t *testing.T) {
+	srv := newInboundServer(t)
+
+	for _, tt := range []struct {
+		auth   string
+		status int
+	}{
+		{"alice:alice-pass", http.StatusOK},
+		{"alice:wrong", http.StatusProxyAuthRequired},
+		{"", http.StatusProxyAuthRequired},
+	} {
+		client, server := net.Pipe()
+		go srv.ServeHTTPConnectConn(context.Background(), server)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+
+		req := "CONNECT 192.0.2.1:80 HTTP/1.1\r\nHost: 192.0.2.1:80\r\n"
+		if tt.auth != "" {
+			req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(tt.auth)) + "\r\n"
+		}
+		go io.WriteString(client, req+"\r\n")
+		br := bufio.NewReader(client)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("ReadResponse failed: %v", err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("CONNECT with %q = %d, want %d", tt.auth, resp.StatusCode, tt.status)
+		} else if tt.status == http.StatusOK {
+			expectEcho(t, &bufferedConn{Conn: client, r: br})
+		}
+		client.Close()
+	}
+}
+
+func TestServerOptions_InboundValidate(t *testing.T) {
+	opts := &ServerOptions{SocksListen: "127.0.0.1:1080", Users: []*User{{Name: "bob"}}}
+	if opts.Validate() == nil {
+		t.Error("SOCKS5 inbound without password accepted")
+	}
+	opts.Users[0].Password = "bob-pass"
+	if err := opts.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package snell
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/icpz/open-snell/components/socks5"
+)
+
+func TestSnellServer_MultipathTCP(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	srv, err := NewSnellServerWithOptions("127.0.0.1:0", "test-psk", "", &ServerOptions{MultipathTCP: true, MultipathTCPOutbound: true})
+	if err != nil {
+		t.Fatalf("NewSnellServerWithOptions failed: %v", err)
+	}
+	defer srv.Close()
+
+	/* plain TCP clients are still accepted by the MPTCP listener */
+	u, err := NewUpstream(srv.Addr().String(), "", "", "test-psk", "", true)
+	if err != nil {
+		t.Fatalf("NewUpstream failed: %v", err)
+	}
+	pc, err := u.DialContext(context.Background(), echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial over plain TCP failed: %v", err)
+	}
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+	pc.Write([]byte("hello"))
+	if _, err := io.ReadFull(pc, make([]byte, 5)); err != nil {
+		t.Errorf("echo over plain TCP failed: %v", err)
+	}
+	pc.Close()
+
+	c, err := NewSnellClientWithOptions("127.0.0.1:0", srv.Addr().String(), "", "", "test-psk", true, &ClientOptions{MultipathTCP: true})
+	if err != nil {
+		t.Fatalf("NewSnellClientWithOptions failed: %v", err)
+	}
+	defer c.Close()
+	conn, err := net.DialTimeout("tcp", c.socks5.Listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial SOCKS5 proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := socks5.ClientHandshake(conn, socks5.ParseAddr(echo.Addr().String()), socks5.CmdConnect, nil); err != nil {
+		t.Fatalf("SOCKS5 handshake failed: %v", err)
+	}
+	conn.Write([]byte("hello"))
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Errorf("echo over MPTCP failed: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+)
+
+// Capability is a protocol feature a client may be allowed to use.
+type Capability uint8
+
+const (
+	// CapabilityV1 accepts clients using the legacy ChaCha20-Poly1305 cipher
+	CapabilityV1 Capability = 1 << iota
+	// CapabilityV2 accepts clients using the AES-128-GCM cipher
+	CapabilityV2
+	// CapabilityUDP allows UDP over TCP sessions
+	CapabilityUDP
+	// CapabilityPing allows ping requests
+	CapabilityPing
+
+	CapabilityAll = CapabilityV1 | CapabilityV2 | CapabilityUDP | CapabilityPing
+)
+
+var capabilityNames = []struct {
+	c    Capability
+	name string
+}{
+	{CapabilityV1, "v1"},
+	{CapabilityV2, "v2"},
+	{CapabilityUDP, "udp"},
+	{CapabilityPing, "ping"},
+}
+
+var (
+	// sessionCount counts accepted connections by user and protocol
+	// version, showing who is still on legacy clients.
+	sessionCount = expvar.NewMap("snell_sessions")
+	// deniedCount counts requests rejected by the capability policy, by
+	// user and capability.
+	deniedCount = expvar.NewMap("snell_denied")
+	// udpDropped counts UDP packets dropped by the NAT policy, by user
+	// and reason.
+	udpDropped = expvar.NewMap("snell_udp_dropped")
+)
+
+func (c Capability) String() string {
+	var names []string
+	for _, n := range capabilityNames {
+		if c&n.c != 0 {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseCapabilities parses a comma separated list of capability names,
+// "all" and "none" are accepted as well.
+func ParseCapabilities(s string) (Capability, error) {
+	var caps Capability
+	for _, f := range strings.Split(s, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		switch f {
+		case "":
+			continue
+		case "all":
+			caps |= CapabilityAll
+			continue
+		case "none":
+			continue
+		}
+		found := false
+		for _, n := range capabilityNames {
+			if n.name == f {
+				caps |= n.c
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid capability %s", f)
+		}
+	}
+	return caps, nil
+}
+
+// capabilities returns the features allowed to the session, settings of
+// an authenticated user take precedence over the listener ones, those of
+// a user anyone may claim can only narrow them.
+func (s *session) capabilities(srv *Server) Capability {
+	caps := srv.opts.Capabilities
+	if caps == 0 {
+		caps = CapabilityAll
+	}
+	if s.user != nil && s.user.Capabilities != nil {
+		if s.authenticated() {
+			return *s.user.Capabilities
+		}
+		return caps & *s.user.Capabilities
+	}
+	return caps
+}
+
+// allow checks a capability against the policy, denied requests are
+// counted and returned as an error to be reported to the client.
+func (s *session) allow(srv *Server, c Capability) error {
+	if s.capabilities(srv)&c != 0 {
+		return nil
+	}
+	deniedCount.Add(s.metricsName()+"/"+c.String(), 1)
+	return fmt.Errorf("%s %w", c, ErrDenied)
+}
+
+// version returns the protocol version capability of the connection, told
+// by the key size of its cipher, which resumed connections keep.
+func (s *session) version(srv *Server) Capability {
+	if c, ok := s.conn.(interface{ KeySize() int }); ok && c.KeySize() != srv.cipher.KeySize() {
+		return CapabilityV1
+	}
+	return CapabilityV2
+}
+
+func (s *session) metricsName() string {
+	if s.user != nil {
+		return s.user.Name
+	}
+	return "-"
+}
@@ -0,0 +1,192 @@
+package snell
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	caps, err := ParseCapabilities("V2, udp")
+	if err != nil {
+		t.Fatalf("ParseCapabilities failed: %v", err)
+	}
+	if caps != CapabilityV2|CapabilityUDP || caps.String() != "v2,udp" {
+		t.Errorf("ParseCapabilities = %s", caps)
+	}
+	if caps, _ := ParseCapabilities("all"); caps != CapabilityAll {
+		t.Errorf("all = %s", caps)
+	}
+	if caps, _ := ParseCapabilities("none"); caps != 0 {
+		t.Errorf("none = %s", caps)
+	}
+	if _, err := ParseCapabilities("v3"); err == nil {
+		t.Error("invalid capability accepted")
+	}
+}
+
+func counter(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestServer_Capabilities(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	udp := CapabilityV1 | CapabilityV2 | CapabilityUDP
+	srv, u := startSnellServerWithOptions(t, &ServerOptions{
+		Capabilities: CapabilityV2,
+		Users: []*User{
+			{Name: "legacy", Capabilities: &udp, Password: "legacy-pass"},
+			{Name: "claimed", Capabilities: &udp},
+		},
+	})
+	defer srv.Close()
+	addr := srv.listener.Addr().String()
+	denied, legacySessions := counter(deniedCount, "-/v1"), counter(sessionCount, "legacy/v1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dial := func(u *Upstream) error {
+		c, err := u.DialContext(ctx, echo.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		msg := []byte("hello")
+		c.Write(msg)
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(c, make([]byte, len(msg)))
+		return err
+	}
+
+	if err := dial(u); err != nil {
+		t.Fatalf("v2 dial failed: %v", err)
+	}
+
+	v1, err := NewUpstream(addr, "", "", "test-psk", "", false)
+	if err != nil {
+		t.Fatalf("NewUpstream failed: %v", err)
+	}
+	var appErr *AppError
+	if err := dial(v1); !errors.As(err, &appErr) {
+		t.Errorf("v1 dial error = %v, want denied", err)
+	}
+	if _, err := u.ListenPacket(ctx); !errors.As(err, &appErr) {
+		t.Errorf("UDP error = %v, want denied", err)
+	}
+
+	/* a user anyone may claim, or a wrong password, widens nothing */
+	claimed, _ := NewUpstream(addr, "", "", "test-psk", "claimed", false)
+	if err := dial(claimed); !errors.As(err, &appErr) {
+		t.Errorf("unauthenticated v1 dial error = %v, want denied", err)
+	}
+	spoofed, _ := NewUpstream(addr, "", "", "test-psk", "legacy", false)
+	spoofed.Password = "guess"
+	if err := dial(spoofed); !errors.As(err, &appErr) || appErr.Code() != ErrorDenied {
+		t.Errorf("spoofed v1 dial error = %v, want denied", err)
+	}
+
+	legacy, err := NewUpstream(addr, "", "", "test-psk", "legacy", false)
+	if err != nil {
+		t.Fatalf("NewUpstream failed: %v", err)
+	}
+	legacy.Password = "legacy-pass"
+	if err := dial(legacy); err != nil {
+		t.Errorf("legacy v1 dial failed: %v", err)
+	}
+	pc, err := legacy.ListenPacket(ctx)
+	if err != nil {
+		t.Fatalf("legacy ListenPacket failed: %v", err)
+	}
+	pc.Close()
+
+	if n := counter(deniedCount, "-/v1") - denied; n != 1 {
+		t.Errorf("denied v1 count = %d, want 1", n)
+	}
+	if n := counter(deniedCount, "claimed/v1"); n != 1 {
+		t.Errorf("denied claimed v1 count = %d, want 1", n)
+	}
+	if n := counter(sessionCount, "legacy/v1") - legacySessions; n != 2 {
+		t.Errorf("legacy v1 sessions = %d, want 2", n)
+	}
+}
+
+func TestServer_VersionPolicy(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	legacy := CapabilityV1 | CapabilityV2
+	srv, err := NewServer("test-psk", "", &ServerOptions{
+		Capabilities:   CapabilityV2,
+		TicketLifetime: time.Minute,
+		Users:          []*User{{Name: "legacy", Capabilities: &legacy, Password: "legacy-pass"}},
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	host, port, _ := net.SplitHostPort(echo.Addr().String())
+	iport, _ := strconv.Atoi(port)
+
+	serve := func(wrap func(net.Conn) net.Conn) net.Conn {
+		server, client := net.Pipe()
+		go srv.ServeConn(context.Background(), server)
+		c := wrap(client)
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		return c
+	}
+	connect := func(c net.Conn, id string) byte {
+		if err := writeHeader(c, id, host, uint(iport), true, nil); err != nil {
+			t.Fatalf("writeHeader failed: %v", err)
+		}
+		var reply [1]byte
+		if _, err := io.ReadFull(c, reply[:]); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		return reply[0]
+	}
+
+	/* resumed connections keep the version of the cipher of the ticket */
+	for _, ciph := range []aead.Cipher{aead.NewChacha20Poly1305([]byte("test-psk")), aead.NewAES128GCM([]byte("test-psk"))} {
+		ticket, secret, _ := srv.tickets.Issue(ciph.KeySize())
+		c := serve(func(c net.Conn) net.Conn {
+			return aead.NewResumedConn(c, ciph, ticket, secret)
+		})
+		if reply, want := connect(c, ""), ciph.KeySize() == 16; (reply == ResponseTunnel) != want {
+			t.Errorf("resumed connection with %d bytes keys: reply %d", ciph.KeySize(), reply)
+		}
+		c.Close()
+	}
+
+	/* the policy of each client id sent on a connection applies */
+	c := serve(func(c net.Conn) net.Conn {
+		return aead.NewConn(c, aead.NewChacha20Poly1305([]byte("test-psk")))
+	})
+	defer c.Close()
+	id, _ := credential(c, "legacy", "legacy-pass")
+	if reply := connect(c, id); reply != ResponseTunnel {
+		t.Fatalf("legacy request reply %d", reply)
+	}
+	c.Write([]byte{})
+	for {
+		if _, err := c.Read(make([]byte, 64)); err != nil {
+			if !errors.Is(err, aead.ErrZeroChunk) {
+				t.Fatalf("Read = %v, want the zero chunk", err)
+			}
+			break
+		}
+	}
+	if reply := connect(c, ""); reply != ResponseError {
+		t.Errorf("anonymous request on a legacy connection reply %d", reply)
+	}
+}
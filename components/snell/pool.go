@@ -63,13 +63,13 @@ func (p *snellPool) Get() (net.Conn, error) {
 }
 
 func (p *snellPool) put(c net.Conn, t time.Time) {
+	/* held until sent, the channel is closed along with the pool */
 	p.mu.Lock()
+	defer p.mu.Unlock()
 	if p.closed {
-		p.mu.Unlock()
 		c.Close()
 		return
 	}
-	p.mu.Unlock()
 
 	select {
 	case p.conns <- &idleConn{c: c, t: t}:
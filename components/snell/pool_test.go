@@ -3,6 +3,7 @@ package snell
 import (
 	"errors"
 	"net"
+	"sync"
 	"testing"
 	"time"
 )
@@ -132,3 +133,26 @@ func TestSnellPool_FactoryError(t *testing.T) {
 		t.Errorf("Expected factory error, got %v", err)
 	}
 }
+
+func TestSnellPool_PutClose(t *testing.T) {
+	for i := 0; i < 2000; i++ {
+		pool, _ := newSnellPool(64, 1000, func() (net.Conn, error) { return &MockConn{}, nil })
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for j := 0; j < 16; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				<-start
+				if j == 8 {
+					pool.Close()
+					return
+				}
+				pool.put(&MockConn{}, time.Now())
+			}(j)
+		}
+		/* returning a session while the pool closes must not panic */
+		close(start)
+		wg.Wait()
+	}
+}
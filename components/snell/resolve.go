@@ -0,0 +1,190 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	log "github.com/golang/glog"
+
+	"github.com/icpz/open-snell/components/dns"
+)
+
+// fallbackTTL is reported for answers of resolvers without TTLs
+const fallbackTTL = 60
+
+// recordResolver is implemented by resolvers reporting record TTLs,
+// such as *dns.Resolver.
+type recordResolver interface {
+	Lookup(ctx context.Context, name string, qtype uint16) ([]dns.Record, error)
+}
+
+// lookup resolves host with the session resolver, a name without
+// records of qtype gives an empty answer.
+func (s *session) lookup(srv *Server, host string, qtype uint16) ([]dns.Record, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, connectTimeout)
+	defer cancel()
+
+	var records []dns.Record
+	var err error
+	resolver := s.resolver(srv)
+	if rr, ok := resolver.(recordResolver); ok {
+		records, err = rr.Lookup(ctx, host, qtype)
+	} else {
+		network := "ip4"
+		if qtype == dns.TypeAAAA {
+			network = "ip6"
+		}
+		var ips []net.IP
+		ips, err = resolver.LookupIP(ctx, network, host)
+		for _, ip := range ips {
+			records = append(records, dns.Record{IP: ip, TTL: fallbackTTL})
+		}
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, nil
+	}
+	return records, err
+}
+
+// handleResolve answers CommandResolve, whose request carries the query
+// type in place of the port. The reply is ResponseRecords followed by the
+// record count and, for each record, the IP version, the address and the
+// TTL in seconds.
+func (s *Server) handleResolve(sess *session, target string) {
+	host, port, _ := net.SplitHostPort(target)
+	qtype, _ := strconv.Atoi(port)
+	log.V(1).Infof("Resolve request from %s for %s, type %d\n", sess.conn.RemoteAddr().String(), host, qtype)
+
+	if qtype != int(dns.TypeA) && qtype != int(dns.TypeAAAA) {
+		s.writeError(sess.conn, fmt.Errorf("unsupported query type %d", qtype))
+		return
+	}
+	records, err := sess.lookup(s, host, uint16(qtype))
+	if err != nil {
+		log.Warningf("Failed to resolve %s: %v\n", host, err)
+		s.writeError(sess.conn, err)
+		return
+	}
+	if len(records) > 255 {
+		records = records[:255]
+	}
+
+	buf := bytes.NewBuffer([]byte{ResponseRecords, byte(len(records))})
+	for _, r := range records {
+		if ip4 := r.IP.To4(); ip4 != nil {
+			buf.WriteByte(4)
+			buf.Write(ip4)
+		} else {
+			buf.WriteByte(6)
+			buf.Write(r.IP.To16())
+		}
+		binary.Write(buf, binary.BigEndian, r.TTL)
+	}
+	if _, err := sess.conn.Write(buf.Bytes()); err != nil {
+		log.Errorf("Failed to write ResponseRecords: %v\n", err)
+	}
+}
+
+// resolve sends CommandResolve on a fresh connection and reads the
+// records.
+func resolve(ctx context.Context, c net.Conn, id, host string, qtype uint16) ([]dns.Record, error) {
+	if len(host) > 255 {
+		return nil, fmt.Errorf("host name too long")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	buf := bytes.NewBuffer([]byte{Version, CommandResolve, byte(len(id))})
+	buf.WriteString(id)
+	buf.WriteByte(byte(len(host)))
+	buf.WriteString(host)
+	binary.Write(buf, binary.BigEndian, qtype)
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := readReply(c); err != nil {
+		return nil, err
+	}
+
+	var count [1]byte
+	if _, err := io.ReadFull(c, count[:]); err != nil {
+		return nil, err
+	}
+	records := make([]dns.Record, 0, count[0])
+	for i := 0; i < int(count[0]); i++ {
+		var ver [1]byte
+		if _, err := io.ReadFull(c, ver[:]); err != nil {
+			return nil, err
+		}
+		var ip net.IP
+		switch ver[0] {
+		case 4:
+			ip = make(net.IP, net.IPv4len)
+		case 6:
+			ip = make(net.IP, net.IPv6len)
+		default:
+			return nil, fmt.Errorf("unknown IP version 0x%x", ver[0])
+		}
+		var ttl [4]byte
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(c, ttl[:]); err != nil {
+			return nil, err
+		}
+		records = append(records, dns.Record{IP: ip, TTL: binary.BigEndian.Uint32(ttl[:])})
+	}
+	return records, nil
+}
+
+// Resolve looks up host through the server, qtype is dns.TypeA or
+// dns.TypeAAAA. Names without such records give an empty answer.
+func (u *Upstream) Resolve(ctx context.Context, host string, qtype uint16) ([]dns.Record, error) {
+	c, err := u.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	id, err := credential(c, u.clientID, u.Password)
+	if err != nil {
+		return nil, err
+	}
+	return resolve(ctx, c, id, host, qtype)
+}
+
+// Resolve looks up host through the server, see Upstream.Resolve.
+func (s *SnellClient) Resolve(ctx context.Context, host string, qtype uint16) ([]dns.Record, error) {
+	c, err := s.dialServer(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	id, err := s.clientID(c)
+	if err != nil {
+		return nil, err
+	}
+	return resolve(ctx, c, id, host, qtype)
+}
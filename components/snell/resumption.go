@@ -0,0 +1,149 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+const (
+	// DefaultTicketLifetime is the suggested ticket lifetime
+	DefaultTicketLifetime = time.Hour
+	// maxTickets bounds the tickets kept by a client
+	maxTickets = 16
+)
+
+// handleTicket answers CommandTicket with ResponseTicket, the ticket
+// length, the ticket, the resumption secret and the ticket lifetime in
+// seconds. The reply travels encrypted by the current session keys.
+func (s *Server) handleTicket(conn net.Conn) error {
+	if s.tickets == nil {
+		return s.writeError(conn, errors.New("session resumption disabled"))
+	}
+	ks, ok := conn.(interface{ KeySize() int })
+	if !ok {
+		return s.writeError(conn, errors.New("session resumption unsupported"))
+	}
+	ticket, secret, err := s.tickets.Issue(ks.KeySize())
+	if err != nil {
+		return s.writeError(conn, err)
+	}
+	if r, ok := conn.(interface{ Resumed() bool }); ok {
+		log.V(1).Infof("Issuing ticket to %s, session resumed: %v\n", conn.RemoteAddr().String(), r.Resumed())
+	}
+
+	buf := bytes.NewBuffer([]byte{ResponseTicket, byte(len(ticket))})
+	buf.Write(ticket)
+	buf.Write(secret)
+	binary.Write(buf, binary.BigEndian, uint32(s.tickets.Lifetime()/time.Second))
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+type ticket struct {
+	ticket []byte
+	secret []byte
+	expire time.Time
+}
+
+// ticketStore keeps the tickets received by a client, each one is used
+// for a single connection.
+type ticketStore struct {
+	mu      sync.Mutex
+	tickets []ticket
+}
+
+// get pops a valid ticket, returns nil if none.
+func (ts *ticketStore) get() *ticket {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for len(ts.tickets) > 0 {
+		t := ts.tickets[len(ts.tickets)-1]
+		ts.tickets = ts.tickets[:len(ts.tickets)-1]
+		if time.Now().Before(t.expire) {
+			return &t
+		}
+	}
+	return nil
+}
+
+func (ts *ticketStore) put(t ticket) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if len(ts.tickets) >= maxTickets {
+		ts.tickets = ts.tickets[1:]
+	}
+	ts.tickets = append(ts.tickets, t)
+}
+
+// clear drops every ticket, after the server rejected one, e.g. because
+// it restarted.
+func (ts *ticketStore) clear() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.tickets = nil
+}
+
+func writeTicketRequest(c net.Conn, id string) error {
+	buf := bytes.NewBuffer([]byte{Version, CommandTicket, byte(len(id))})
+	buf.WriteString(id)
+	buf.Write([]byte{0, 0, 0}) // empty host and port
+	_, err := c.Write(buf.Bytes())
+	return err
+}
+
+// readTicket reads the reply of CommandTicket into the store.
+func (ts *ticketStore) readTicket(c net.Conn) error {
+	err := readReply(c)
+	var t ticket
+	var n [1]byte
+	if err == nil {
+		if _, err = io.ReadFull(c, n[:]); err == nil && (n[0] < aead.MinTicketSize || n[0] > aead.MaxTicketSize) {
+			err = fmt.Errorf("invalid ticket size %d", n[0])
+		}
+	}
+	if err == nil {
+		size := int(n[0])
+		buf := make([]byte, size+32+4)
+		if _, err = io.ReadFull(c, buf); err == nil {
+			t.ticket, t.secret = buf[:size], buf[size:size+32]
+			lifetime := time.Duration(binary.BigEndian.Uint32(buf[size+32:])) * time.Second
+			// leave a margin for clock drift and connection setup
+			t.expire = time.Now().Add(lifetime * 9 / 10)
+			ts.put(t)
+			return nil
+		}
+	}
+
+	if r, ok := c.(interface{ Resumed() bool }); ok && r.Resumed() {
+		var appErr *AppError
+		if !errors.As(err, &appErr) {
+			log.Warningf("Resumed session failed, dropping tickets: %v\n", err)
+			ts.clear()
+		}
+	}
+	return err
+}
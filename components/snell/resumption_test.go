@@ -0,0 +1,87 @@
+package snell
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClient_Resumption(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	srv, _ := startSnellServerWithOptions(t, &ServerOptions{TicketLifetime: time.Minute})
+	defer srv.Close()
+
+	c, err := NewSnellClientWithOptions("", srv.listener.Addr().String(), "", "", "test-psk", true, &ClientOptions{Resumption: true})
+	if err != nil {
+		t.Fatalf("NewSnellClientWithOptions failed: %v", err)
+	}
+	defer c.Close()
+
+	for i, wantResumed := range []bool{false, true, true} {
+		sess, err := c.GetSession(echo.Addr().String())
+		if err != nil {
+			t.Fatalf("GetSession %d failed: %v", i, err)
+		}
+		msg := []byte("hello resumed")
+		sess.Write(msg)
+		buf := make([]byte, len(msg))
+		sess.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(sess, buf); err != nil {
+			t.Fatalf("session %d read failed: %v", i, err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Errorf("expected %q, got %q", msg, buf)
+		}
+
+		conn := sess.(*snellPoolConn).Conn.(*clientSession).Conn
+		if resumed := conn.(interface{ Resumed() bool }).Resumed(); resumed != wantResumed {
+			t.Errorf("session %d resumed: %v, want %v", i, resumed, wantResumed)
+		}
+		c.DropSession(sess)
+	}
+
+	/* the error of a resumed session's first request is read ahead of the
+	 * caller and still reported to it */
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+	sess, err := c.GetSession(closed.Addr().String())
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	sess.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var appErr *AppError
+	if _, err := sess.Read(make([]byte, 1)); !errors.As(err, &appErr) {
+		t.Errorf("read from a refused target: %v, want an AppError", err)
+	}
+	c.DropSession(sess)
+
+	/* tickets are rejected by another server, e.g. one restarted, the
+	 * client drops them all and retries with a full handshake */
+	other, _ := startSnellServerWithOptions(t, &ServerOptions{TicketLifetime: time.Minute})
+	defer other.Close()
+	if tk := c.tickets.get(); tk != nil {
+		c.tickets.put(*tk)
+		c.tickets.put(*tk)
+	}
+	c.server = other.listener.Addr().String()
+	for i, wantResumed := range []bool{false, true} {
+		sess, err := c.GetSession(echo.Addr().String())
+		if err != nil {
+			t.Fatalf("GetSession %d after the restart failed: %v", i, err)
+		}
+		sess.Write([]byte("x"))
+		sess.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := sess.Read(make([]byte, 1)); err != nil {
+			t.Errorf("session %d after the restart read failed: %v", i, err)
+		}
+		conn := sess.(*snellPoolConn).Conn.(*clientSession).Conn
+		if resumed := conn.(interface{ Resumed() bool }).Resumed(); resumed != wantResumed {
+			t.Errorf("session %d after the restart resumed: %v, want %v", i, resumed, wantResumed)
+		}
+		c.DropSession(sess)
+	}
+}
@@ -0,0 +1,370 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/icpz/open-snell/components/utils"
+)
+
+// Frames sent by the server on the control session of a reverse tunnel
+const (
+	reverseKeepalive byte = 0
+	// reverseAccept is followed by the token of the accepted connection
+	reverseAccept byte = 1
+)
+
+const (
+	reverseTokenSize = 16
+	// reverseKeepaliveInterval is the period of keepalive frames, clients
+	// give up on a control session silent for reverseKeepaliveTimeout.
+	reverseKeepaliveInterval = 30 * time.Second
+	reverseKeepaliveTimeout  = 3 * reverseKeepaliveInterval
+	// reverseAcceptTimeout bounds the wait for the client to pick up an
+	// accepted connection.
+	reverseAcceptTimeout = 10 * time.Second
+	// reverseRetryMax bounds the backoff between registrations
+	reverseRetryMax = 30 * time.Second
+)
+
+// DefaultReverseAddress is the address reverse tunnels listen on unless
+// configured otherwise.
+const DefaultReverseAddress = "127.0.0.1"
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Low, High uint16
+}
+
+// ParsePortRanges parses a comma separated list of ports and ranges, e.g.
+// "8000-8099, 9000".
+func ParsePortRanges(s string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		lo, hi, found := strings.Cut(f, "-")
+		if !found {
+			hi = lo
+		}
+		l, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %s", f)
+		}
+		h, err := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+		if err != nil || h < l {
+			return nil, fmt.Errorf("invalid port %s", f)
+		}
+		ranges = append(ranges, PortRange{uint16(l), uint16(h)})
+	}
+	return ranges, nil
+}
+
+func portAllowed(ranges []PortRange, port uint16) bool {
+	for _, r := range ranges {
+		if port >= r.Low && port <= r.High {
+			return true
+		}
+	}
+	return false
+}
+
+// reversePending is an accepted connection waiting for the client.
+type reversePending struct {
+	conn net.Conn
+	user *User
+	req  *Request
+}
+
+// reverseTable holds the accepted connections of every reverse tunnel by
+// token.
+type reverseTable struct {
+	mu      sync.Mutex
+	pending map[string]*reversePending
+}
+
+func (t *reverseTable) put(token string, p *reversePending) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending == nil {
+		t.pending = make(map[string]*reversePending)
+	}
+	t.pending[token] = p
+}
+
+func (t *reverseTable) take(token string) *reversePending {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.pending[token]
+	delete(t.pending, token)
+	return p
+}
+
+// handleBind serves a reverse tunnel registration, until the client or
+// the server closes the control session.
+func (s *Server) handleBind(sess *session, target string) {
+	conn := sess.conn
+	_, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.ParseUint(port, 10, 16)
+	/* the listener is bound for the session user, a client id without
+	 * password could be claimed by anyone */
+	if !sess.authenticated() || !portAllowed(sess.user.ReversePorts, uint16(portNum)) {
+		err := fmt.Errorf("reverse port %s %w", port, ErrDenied)
+		log.Infof("Reverse tunnel from %s denied: %v\n", conn.RemoteAddr().String(), err)
+		s.writeError(conn, err)
+		return
+	}
+
+	addr := s.opts.ReverseAddress
+	if addr == "" {
+		addr = DefaultReverseAddress
+	}
+	addr = net.JoinHostPort(addr, port)
+	lc := &net.ListenConfig{}
+	l, err := lc.Listen(sess.ctx, "tcp", addr)
+	if err != nil {
+		log.Warningf("Reverse tunnel from %s failed to listen: %v\n", conn.RemoteAddr().String(), err)
+		s.writeError(conn, err)
+		return
+	}
+	defer l.Close()
+	if _, err := conn.Write([]byte{ResponseReady}); err != nil {
+		log.Errorf("Failed to write ResponseReady: %v\n", err)
+		return
+	}
+	log.Infof("Reverse tunnel of %s listening at %s\n", sess.user.Name, l.Addr().String())
+	defer log.Infof("Reverse tunnel at %s closed\n", l.Addr().String())
+	sessionCount.Add(sess.metricsName()+"/reverse", 1)
+
+	/* the tunnel is closed along with the control session */
+	ctx, cancel := context.WithCancel(sess.ctx)
+	defer cancel()
+	go func() {
+		io.Copy(io.Discard, conn)
+		cancel()
+	}()
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+
+	var mu sync.Mutex
+	write := func(b []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		_, err := conn.Write(b)
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(reverseKeepaliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if write([]byte{reverseKeepalive}) != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Errorf("Reverse tunnel at %s failed to accept: %v\n", l.Addr().String(), err)
+			}
+			return
+		}
+		log.V(1).Infof("Reverse tunnel at %s accepted %s\n", l.Addr().String(), c.RemoteAddr().String())
+
+		b := make([]byte, reverseTokenSize)
+		rand.Read(b)
+		token := hex.EncodeToString(b)
+		req := &Request{RemoteAddr: conn.RemoteAddr(), ClientID: sess.req.ClientID, Command: CommandBindAccept, Target: c.RemoteAddr().String()}
+		s.reverse.put(token, &reversePending{conn: c, user: sess.user, req: req})
+		time.AfterFunc(reverseAcceptTimeout, func() {
+			if p := s.reverse.take(token); p != nil {
+				log.V(1).Infof("Reverse connection from %s not picked up\n", p.conn.RemoteAddr().String())
+				p.conn.Close()
+			}
+		})
+		if err := write(append([]byte{reverseAccept}, b...)); err != nil {
+			log.Errorf("Reverse tunnel failed to notify %s: %v\n", conn.RemoteAddr().String(), err)
+			return
+		}
+	}
+}
+
+// handleBindAccept relays the accepted connection of token over the
+// session.
+func (s *Server) handleBindAccept(sess *session, target string) {
+	conn := sess.conn
+	token, _, _ := net.SplitHostPort(target)
+	p := s.reverse.take(token)
+	if p == nil || !sess.authenticated() || p.user != sess.user {
+		if p != nil {
+			p.conn.Close()
+		}
+		s.writeError(conn, fmt.Errorf("unknown reverse connection: %w", ErrDenied))
+		return
+	}
+	defer p.conn.Close()
+	if _, err := conn.Write([]byte{ResponseTunnel}); err != nil {
+		log.Errorf("Failed to write ResponseTunnel: %v\n", err)
+		return
+	}
+
+	start := time.Now()
+	up, down, el, _ := utils.RelayCount(conn, p.conn)
+	stats := &RelayStats{Upload: up, Download: down, Duration: time.Since(start), Err: el}
+	if errors.Is(el, io.EOF) {
+		stats.Err = nil
+	}
+	s.opts.Hooks.OnRelayDone(sess.ctx, p.req, stats)
+}
+
+// Reverse exposes the local service at local on port of the server until
+// ctx is done, the registration is renewed after failures. The client id
+// must name a server user with a password, set as ClientOptions.Password,
+// allowed to bind port.
+func (s *SnellClient) Reverse(ctx context.Context, port uint16, local string) error {
+	var delay time.Duration
+	for {
+		err := s.reverse(ctx, port, local)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var appErr *AppError
+		if errors.As(err, &appErr) && appErr.Code() == ErrorDenied {
+			return err
+		}
+		if delay = 2 * delay; delay == 0 {
+			delay = time.Second
+		} else if delay > reverseRetryMax {
+			delay = reverseRetryMax
+		}
+		log.Warningf("Reverse tunnel of port %d failed: %v, retrying in %v\n", port, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// reverse registers the tunnel once and serves it until the control
+// session fails.
+func (s *SnellClient) reverse(ctx context.Context, port uint16, local string) error {
+	c, err := s.dialServer(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+
+	id, err := s.clientID(c)
+	if err != nil {
+		return err
+	}
+	buf := bytes.NewBuffer([]byte{Version, CommandBind, byte(len(id))})
+	buf.WriteString(id)
+	buf.WriteByte(0)
+	binary.Write(buf, binary.BigEndian, port)
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	c.SetReadDeadline(time.Now().Add(dialTimeout))
+	if err := readReply(c); err != nil {
+		return err
+	}
+	log.Infof("Reverse tunnel registered, server port %d to %s\n", port, local)
+
+	frame := make([]byte, 1+reverseTokenSize)
+	for {
+		c.SetReadDeadline(time.Now().Add(reverseKeepaliveTimeout))
+		if _, err := io.ReadFull(c, frame[:1]); err != nil {
+			return err
+		}
+		switch frame[0] {
+		case reverseKeepalive:
+			continue
+		case reverseAccept:
+			if _, err := io.ReadFull(c, frame[1:]); err != nil {
+				return err
+			}
+			go s.reverseAccept(ctx, hex.EncodeToString(frame[1:]), local)
+		default:
+			return fmt.Errorf("unknown reverse frame 0x%x", frame[0])
+		}
+	}
+}
+
+// reverseAccept connects local to the server connection of token.
+func (s *SnellClient) reverseAccept(ctx context.Context, token, local string) {
+	d := &net.Dialer{Timeout: dialTimeout}
+	lc, err := d.DialContext(ctx, "tcp", local)
+	if err != nil {
+		/* the server drops the connection once not picked up */
+		log.Warningf("Reverse tunnel failed to connect %s: %v\n", local, err)
+		return
+	}
+	defer lc.Close()
+
+	c, err := s.dialServer(ctx, nil)
+	if err != nil {
+		log.Warningf("Reverse tunnel failed to connect server: %v\n", err)
+		return
+	}
+	defer c.Close()
+	id, err := s.clientID(c)
+	if err != nil {
+		log.Warningf("Reverse tunnel failed to pick up connection: %v\n", err)
+		return
+	}
+	buf := bytes.NewBuffer([]byte{Version, CommandBindAccept, byte(len(id))})
+	buf.WriteString(id)
+	buf.WriteByte(byte(len(token)))
+	buf.WriteString(token)
+	buf.Write([]byte{0, 0})
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		log.Warningf("Reverse tunnel failed to pick up connection: %v\n", err)
+		return
+	}
+	if err := readReply(c); err != nil {
+		log.Warningf("Reverse tunnel failed to pick up connection: %v\n", err)
+		return
+	}
+	log.V(1).Infof("Reverse connection relayed to %s\n", local)
+	utils.Relay(c, lc)
+}
@@ -0,0 +1,108 @@
+package snell
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParsePortRanges(t *testing.T) {
+	ranges, err := ParsePortRanges("8000-8099, 9000")
+	if err != nil {
+		t.Fatalf("ParsePortRanges failed: %v", err)
+	}
+	for port, want := range map[uint16]bool{7999: false, 8000: true, 8099: true, 8100: false, 9000: true} {
+		if got := portAllowed(ranges, port); got != want {
+			t.Errorf("portAllowed(%d) = %v, want %v", port, got, want)
+		}
+	}
+	for _, s := range []string{"80-70", "http", "1-65536"} {
+		if _, err := ParsePortRanges(s); err == nil {
+			t.Errorf("ParsePortRanges(%q) succeeded", s)
+		}
+	}
+}
+
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestReverse(t *testing.T) {
+	port := freePort(t)
+	srv, err := NewServer("test-psk", "", &ServerOptions{Users: []*User{
+		{Name: "alice", Password: "alice-secret", ReversePorts: []PortRange{{port, port}}},
+		{Name: "bob", Password: "bob-secret"},
+		{Name: "carol", ReversePorts: []PortRange{{port, port}}},
+	}})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go srv.Serve(ctx, l)
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer local.Close()
+	go func() {
+		for {
+			c, err := local.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	/* bob may not bind the port, carol has no password to prove her id */
+	for _, opts := range []*ClientOptions{{ClientID: "bob", Password: "bob-secret"}, {ClientID: "carol"}} {
+		c, _ := NewSnellClientWithOptions("", l.Addr().String(), "", "", "test-psk", true, opts)
+		var appErr *AppError
+		if err := c.Reverse(ctx, port, local.Addr().String()); !errors.As(err, &appErr) || appErr.Code() != ErrorDenied {
+			t.Errorf("Reverse as %s = %v, want denied", opts.ClientID, err)
+		}
+		c.Close()
+	}
+
+	alice, _ := NewSnellClientWithOptions("", l.Addr().String(), "", "", "test-psk", true, &ClientOptions{ClientID: "alice", Password: "alice-secret"})
+	defer alice.Close()
+	go alice.Reverse(ctx, port, local.Addr().String())
+
+	var c net.Conn
+	for ctx.Err() == nil {
+		if c, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if c == nil {
+		t.Fatalf("reverse tunnel not listening: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := []byte("hello reverse")
+	go c.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != string(msg) {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+}
@@ -0,0 +1,206 @@
+package snell
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/icpz/open-snell/components/aead"
+	"github.com/icpz/open-snell/components/rules"
+)
+
+func startUDPEchoServer(t *testing.T) net.PacketConn {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen UDP: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	return echo
+}
+
+func startSnellServerWithOptions(t *testing.T, opts *ServerOptions) (*SnellServer, *Upstream) {
+	s, err := NewSnellServerWithOptions("127.0.0.1:0", "test-psk", "", opts)
+	if err != nil {
+		t.Fatalf("Failed to start snell server: %v", err)
+	}
+	u, err := NewUpstream(s.listener.Addr().String(), "", "", "test-psk", "", true)
+	if err != nil {
+		t.Fatalf("NewUpstream failed: %v", err)
+	}
+	return s, u
+}
+
+func TestServer_Rewrite(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	uecho := startUDPEchoServer(t)
+	defer uecho.Close()
+
+	rw, err := rules.NewRewriter([]string{
+		"DOMAIN,backend.test," + echo.Addr().String(),
+		"IP-CIDR,192.0.2.0/24," + uecho.LocalAddr().String(),
+	})
+	if err != nil {
+		t.Fatalf("NewRewriter failed: %v", err)
+	}
+	srv, u := startSnellServerWithOptions(t, &ServerOptions{Rewriter: rw})
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := u.DialContext(ctx, "backend.test:80")
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	defer c.Close()
+	msg := []byte("hello rewritten")
+	c.Write(msg)
+	buf := make([]byte, 2048)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, buf[:len(msg)]); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	pc, err := u.ListenPacket(ctx)
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer pc.Close()
+	orig := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	if _, err := pc.WriteTo(msg, orig); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		t.Errorf("expected %q, got %q", msg, buf[:n])
+	}
+	if from.String() != orig.String() {
+		t.Errorf("expected reply from %s, got %s", orig, from)
+	}
+
+	/* another target rewritten to the same address, or the address itself,
+	 * would receive the replies of the first target and is dropped */
+	for _, addr := range []net.Addr{&net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 53}, uecho.LocalAddr()} {
+		pc.WriteTo(msg, addr)
+	}
+	pc.WriteTo(msg, orig)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, from, err = pc.ReadFrom(buf); err != nil || from.String() != orig.String() {
+		t.Fatalf("ReadFrom = %v, %v, want a reply from %s", from, err, orig)
+	}
+	pc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, from, err := pc.ReadFrom(buf); err == nil {
+		t.Errorf("unexpected reply from %s", from)
+	}
+}
+
+func TestServer_Sniff(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	rw, _ := rules.NewRewriter([]string{"DOMAIN,backend.test," + echo.Addr().String()})
+	router, err := rules.NewRouter(rules.Config{Rules: []string{"PROTOCOL,bittorrent,reject"}})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	srv, u := startSnellServerWithOptions(t, &ServerOptions{
+		Rewriter:      rw,
+		Router:        router,
+		Sniff:         true,
+		SniffTimeout:  50 * time.Millisecond,
+		SniffOverride: true,
+	})
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	exchange := func(target string, msg []byte, delay time.Duration) error {
+		c, err := u.DialContext(ctx, target)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		time.Sleep(delay)
+		c.Write(msg)
+		buf := make([]byte, len(msg))
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return err
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Errorf("expected %q, got %q", msg, buf)
+		}
+		return nil
+	}
+
+	/* the IP literal target is replaced by the Host header, then rewritten */
+	if err := exchange("192.0.2.1:80", []byte("GET / HTTP/1.1\r\nHost: backend.test\r\n\r\n"), 0); err != nil {
+		t.Fatalf("HTTP exchange failed: %v", err)
+	}
+	/* nothing to sniff within the timeout */
+	if err := exchange(echo.Addr().String(), []byte("late payload"), 200*time.Millisecond); err != nil {
+		t.Fatalf("late exchange failed: %v", err)
+	}
+	if err := exchange(echo.Addr().String(), []byte("\x13BitTorrent protocol"), 0); err == nil {
+		t.Fatalf("BitTorrent handshake was not rejected")
+	}
+}
+
+func TestServer_SniffZeroChunk(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	srv, err := NewServer("test-psk", "", &ServerOptions{Sniff: true, SniffTimeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	go srv.ServeConn(context.Background(), server)
+
+	/* the client closes its side of the request before sending any data */
+	c := aead.NewConn(client, aead.NewAES128GCM([]byte("test-psk")))
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	host, port, _ := net.SplitHostPort(echo.Addr().String())
+	p, _ := strconv.Atoi(port)
+	if err := writeHeader(c, "", host, uint(p), true, nil); err != nil {
+		t.Fatalf("writeHeader failed: %v", err)
+	}
+	/* with nothing to sniff yet, the server replies first */
+	buf := make([]byte, 64)
+	if _, err := io.ReadFull(c, buf[:1]); err != nil || buf[0] != ResponseTunnel {
+		t.Fatalf("reply = %v, %v", buf[:1], err)
+	}
+	if _, err := c.Write([]byte{}); err != nil {
+		t.Fatalf("write zero chunk failed: %v", err)
+	}
+	if _, err := c.Read(buf); !errors.Is(err, aead.ErrZeroChunk) {
+		t.Fatalf("Read = %v, want the zero chunk back", err)
+	}
+
+	/* the session is still usable */
+	if _, err := c.Write([]byte{Version, CommandPing, 0, 0, 0, 0}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := io.ReadFull(c, buf[:1]); err != nil || buf[0] != ResponsePong {
+		t.Fatalf("ping reply = %v, %v", buf[:1], err)
+	}
+}
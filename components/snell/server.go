@@ -16,19 +16,20 @@ package snell
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
 	"sync"
-	"syscall"
 	"time"
 
 	log "github.com/golang/glog"
-	lru "github.com/hashicorp/golang-lru"
 
 	"github.com/icpz/open-snell/components/aead"
+	"github.com/icpz/open-snell/components/dns"
+	"github.com/icpz/open-snell/components/outbound"
 	obfs "github.com/icpz/open-snell/components/simple-obfs"
 	"github.com/icpz/open-snell/components/utils"
 	p "github.com/icpz/open-snell/components/utils/pool"
@@ -41,13 +42,40 @@ var handshakeBufPool = sync.Pool{
 	},
 }
 
+// Server serves snell sessions on connections accepted by the caller, it
+// is not bound to any listener.
+type Server struct {
+	obfs     string
+	opts     ServerOptions
+	users    map[string]*User
+	tickets  *aead.TicketKeys
+	cipher   aead.Cipher
+	fallback aead.Cipher
+	// ssCiphers are tried in turn on Shadowsocks clients, ssUsers holds
+	// the user of each, nil for the listener password.
+	ssCiphers []aead.Cipher
+	ssUsers   []*User
+	ssSalts   *aead.ReplayFilter
+	reverse   reverseTable
+	datagrams datagramTable
+}
+
+// SnellServer is a Server listening on its own TCP listener, on the same
+// UDP port for datagrams, and on the addresses of the other inbounds if
+// configured.
 type SnellServer struct {
+	*Server
 	listener net.Listener
-	psk      []byte
-	closed   bool
+	cancel   context.CancelFunc
+	done     chan struct{}
 }
 
-func (s *SnellServer) ServerHandshake(c net.Conn) (target string, cmd byte, err error) {
+func (s *Server) ServerHandshake(c net.Conn) (target string, cmd byte, err error) {
+	_, target, cmd, err = s.serverHandshake(c)
+	return
+}
+
+func (s *Server) serverHandshake(c net.Conn) (id, target string, cmd byte, err error) {
 	buf := handshakeBufPool.Get().([]byte)
 	defer handshakeBufPool.Put(buf)
 
@@ -67,13 +95,18 @@ func (s *SnellServer) ServerHandshake(c net.Conn) (target string, cmd byte, err
 			return
 		}
 
-		log.V(1).Infof("client id %s\n", string(buf[:clen]))
+		id = string(buf[:clen])
+		log.V(1).Infof("client id %s\n", id)
 	}
 
-	if cmd == CommandUDP {
+	if cmd == CommandUDP || cmd == CommandUDPDatagram || cmd == CommandUDPMux {
 		log.V(1).Infof("UDP request, skip reading in handshake stage\n")
 		return
 	}
+	if cmd == CommandSpeedtest {
+		log.V(1).Infof("Speedtest request, skip reading in handshake stage\n")
+		return
+	}
 
 	if _, err = io.ReadFull(c, buf[:1]); err != nil {
 		return
@@ -88,61 +121,309 @@ func (s *SnellServer) ServerHandshake(c net.Conn) (target string, cmd byte, err
 	return
 }
 
+// Addr returns the address of the snell listener.
+func (s *SnellServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops the listener and every session, then waits for them.
 func (s *SnellServer) Close() {
-	s.closed = true
-	s.listener.Close()
+	s.cancel()
+	<-s.done
 }
 
+const DefaultFastOpenQueue = 1
+
+// acceptDelayMax bounds the backoff after failed accepts
+const acceptDelayMax = time.Second
+
 func NewSnellServer(listen, psk, obfsType string) (*SnellServer, error) {
-	if obfsType != "tls" && obfsType != "http" && obfsType != "" {
-		return nil, fmt.Errorf("invalid snell obfs type %s", obfsType)
+	return NewSnellServerWithOptions(listen, psk, obfsType, nil)
+}
+
+func NewSnellServerWithOptions(listen, psk, obfsType string, opts *ServerOptions) (*SnellServer, error) {
+	if opts == nil {
+		opts = &ServerOptions{FastOpenQueue: DefaultFastOpenQueue}
+	}
+	srv, err := NewServer(psk, obfsType, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	l, err := net.Listen("tcp", listen)
+	lc := &net.ListenConfig{Control: opts.ClientTCP.Control(nil)}
+	lc.SetMultipathTCP(opts.MultipathTCP)
+	l, err := lc.Listen(context.Background(), "tcp", listen)
 	if err != nil {
 		return nil, err
 	}
-	setTcpFastOpen(l, 1)
+	if opts.FastOpenQueue > 0 {
+		setTcpFastOpen(l, opts.FastOpenQueue)
+	}
 
-	bpsk := []byte(psk)
-	ss := &SnellServer{l, bpsk, false}
-	ciph := aead.NewAES128GCM(bpsk)
-	fb := aead.NewChacha20Poly1305(bpsk)
-	go func() {
-		log.Infof("snell server listening at: %s\n", listen)
-		for {
-			c, err := l.Accept()
-			if err != nil {
-				if ss.closed {
-					break
-				}
-				continue
-			}
-			c, _ = obfs.NewObfsServer(c, obfsType)
-			c = aead.NewConnWithFallback(c, ciph, fb)
-			go ss.handleSnell(c)
+	/* each inbound is served by its own goroutine */
+	type inbound struct {
+		name  string
+		addr  string
+		serve func(context.Context) error
+	}
+	inbounds := []inbound{{"snell", listen, func(ctx context.Context) error { return srv.Serve(ctx, l) }}}
+	closers := []io.Closer{l}
+	fail := func(err error) (*SnellServer, error) {
+		for _, c := range closers {
+			c.Close()
 		}
+		return nil, err
+	}
+	listenTCP := func(name, addr string, serve func(context.Context, net.Listener) error) error {
+		il, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			return err
+		}
+		closers = append(closers, il)
+		inbounds = append(inbounds, inbound{name, il.Addr().String(), func(ctx context.Context) error { return serve(ctx, il) }})
+		return nil
+	}
+	if opts.Datagram {
+		/* the port of the listener, which may have been picked by the system */
+		pc, err := lc.ListenPacket(context.Background(), "udp", l.Addr().String())
+		if err != nil {
+			return fail(err)
+		}
+		closers = append(closers, pc)
+		inbounds = append(inbounds, inbound{"snell UDP", pc.LocalAddr().String(), func(ctx context.Context) error { return srv.ServeDatagram(ctx, pc) }})
+	}
+	if ss := opts.Shadowsocks; ss != nil && ss.Listen != "" {
+		if err := listenTCP("shadowsocks", ss.Listen, srv.ServeShadowsocks); err != nil {
+			return fail(err)
+		}
+		pc, err := lc.ListenPacket(context.Background(), "udp", ss.Listen)
+		if err != nil {
+			return fail(err)
+		}
+		closers = append(closers, pc)
+		inbounds = append(inbounds, inbound{"shadowsocks UDP", pc.LocalAddr().String(), func(ctx context.Context) error { return srv.ServeShadowsocksPacket(ctx, pc) }})
+	}
+	if opts.SocksListen != "" {
+		if err := listenTCP("socks5", opts.SocksListen, srv.ServeSocks); err != nil {
+			return fail(err)
+		}
+	}
+	if opts.HTTPListen != "" {
+		if err := listenTCP("http", opts.HTTPListen, srv.ServeHTTPConnect); err != nil {
+			return fail(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ss := &SnellServer{
+		Server:   srv,
+		listener: l,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	var wg sync.WaitGroup
+	for _, in := range inbounds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Infof("%s server listening at: %s\n", in.name, in.addr)
+			if err := in.serve(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				log.Errorf("%s server at %s stopped: %v\n", in.name, in.addr, err)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(ss.done)
 	}()
 
 	return ss, nil
 }
 
-func (s *SnellServer) handleSnell(conn net.Conn) {
+// NewServer creates a snell server, sessions are served by Serve and
+// ServeConn.
+func NewServer(psk, obfsType string, opts *ServerOptions) (*Server, error) {
+	if opts == nil {
+		opts = &ServerOptions{}
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if obfsType != "tls" && obfsType != "http" && obfsType != "" {
+		return nil, fmt.Errorf("invalid snell obfs type %s", obfsType)
+	}
+
+	bpsk := []byte(psk)
+	s := &Server{
+		obfs:     obfsType,
+		opts:     *opts,
+		users:    make(map[string]*User),
+		cipher:   aead.NewAES128GCM(bpsk),
+		fallback: aead.NewChacha20Poly1305(bpsk),
+	}
+	for _, u := range opts.Users {
+		s.users[u.Name] = u
+	}
+	if s.opts.Hooks == nil {
+		s.opts.Hooks = NopHooks{}
+	}
+	if ss := opts.Shadowsocks; ss != nil {
+		if ss.Password != "" {
+			c, _ := aead.NewShadowsocks(ss.Method, ss.Password)
+			s.ssCiphers = append(s.ssCiphers, c)
+			s.ssUsers = append(s.ssUsers, nil)
+		}
+		for _, u := range opts.Users {
+			if u.Password != "" {
+				c, _ := aead.NewShadowsocks(ss.Method, u.Password)
+				s.ssCiphers = append(s.ssCiphers, c)
+				s.ssUsers = append(s.ssUsers, u)
+			}
+		}
+		s.ssSalts = aead.NewReplayFilter(0)
+	}
+	if opts.TicketLifetime > 0 {
+		s.tickets = aead.NewTicketKeys(opts.TicketLifetime)
+	}
+	if s.opts.Resolver == nil {
+		r, err := dns.New(dns.Options{Dialer: opts.Dialer})
+		if err != nil {
+			return nil, err
+		}
+		s.opts.Resolver = r
+	}
+	return s, nil
+}
+
+// Serve accepts client connections on l and serves each of them in its
+// own goroutine. Once ctx is done, l and every session are closed, Serve
+// returns after the sessions ended, with the error that stopped it.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	return s.serve(ctx, l, s.ServeConn)
+}
+
+func (s *Server) serve(ctx context.Context, l net.Listener, handle func(context.Context, net.Conn) error) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+
+	var delay time.Duration
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			/* e.g. running out of file descriptors, retry later */
+			if delay = 2 * delay; delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay > acceptDelayMax {
+				delay = acceptDelayMax
+			}
+			log.Warningf("Failed to accept: %v, retrying in %v\n", err, delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		delay = 0
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := handle(ctx, c); err != nil && !errors.Is(err, context.Canceled) {
+				log.Warningf("Session from %s failed: %v\n", c.RemoteAddr().String(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn serves the snell sessions of an accepted client connection
+// until the client is done or ctx is, c is closed on return.
+func (s *Server) ServeConn(ctx context.Context, c net.Conn) error {
+	ctx, ok := s.acceptConn(ctx, c)
+	if !ok {
+		c.Close()
+		return nil
+	}
+	if utils.TCPFastOpenUsed(c) {
+		log.V(1).Infof("Accepted TCP fastopen connection from %s\n", c.RemoteAddr().String())
+	}
+	if s.opts.MultipathTCP {
+		log.V(1).Infof("Connection from %s using MPTCP: %v\n", c.RemoteAddr().String(), utils.MultipathTCPUsed(c))
+	}
+	c, _ = obfs.NewObfsServer(c, s.obfs)
+	if s.tickets != nil {
+		c = aead.NewConnWithTickets(c, s.cipher, s.fallback, s.tickets)
+	} else {
+		c = aead.NewConnWithFallback(c, s.cipher, s.fallback)
+	}
+
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+	if err := s.handleSnell(ctx, c); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+// acceptConn runs Hooks.OnAccept and tunes the client connection c, false
+// is returned if c is rejected.
+func (s *Server) acceptConn(ctx context.Context, c net.Conn) (context.Context, bool) {
+	ctx, err := s.opts.Hooks.OnAccept(ctx, c)
+	if err != nil {
+		log.Infof("Connection from %s rejected by hook: %v\n", c.RemoteAddr().String(), err)
+		return ctx, false
+	}
+	if err := s.opts.ClientTCP.Apply(c); err != nil {
+		log.Warningf("Failed to tune connection from %s: %v\n", c.RemoteAddr().String(), err)
+	}
+	return ctx, true
+}
+
+func (s *Server) handleSnell(ctx context.Context, conn net.Conn) error {
 	defer conn.Close()
+	defer log.V(1).Infof("Session from %s done", conn.RemoteAddr().String())
 
 	isV2 := true
+	/* the protocol version is checked on the first request, and again
+	 * whenever the client id changes as the policy is per user */
+	checked, checkedID := false, ""
 
 muxLoop:
 	for isV2 {
-		target, command, err := s.ServerHandshake(conn)
+		id, target, command, err := s.serverHandshake(conn)
 		if err != nil {
 			if err != io.EOF {
-				log.Warningf("Failed to handshake from %s: %v\n", conn.RemoteAddr().String(), err)
+				return fmt.Errorf("handshake: %w", err)
 			}
 			break
 		}
 
-		if command != CommandUDP {
+		id, user, err := s.authenticate(conn, id)
+		if err != nil {
+			log.Infof("Request from %s as %s denied: %v\n", conn.RemoteAddr().String(), id, err)
+			s.writeError(conn, err)
+			break
+		}
+		sess := &session{ctx: ctx, conn: conn, user: user}
+		if id != "" && sess.user == nil {
+			log.V(1).Infof("Unknown client id %s from %s, using listener defaults\n", id, conn.RemoteAddr().String())
+		}
+
+		switch command {
+		case CommandUDP, CommandUDPDatagram, CommandUDPMux, CommandResolve, CommandSpeedtest, CommandTicket, CommandBind, CommandBindAccept:
+		default:
 			log.Infof("New target from %s to %s\n", conn.RemoteAddr().String(), target)
 		}
 
@@ -150,44 +431,107 @@ muxLoop:
 			c.SetKeepAlive(true)
 		}
 
+		if !checked || id != checkedID {
+			checked, checkedID = true, id
+			version := sess.version(s)
+			sessionCount.Add(sess.metricsName()+"/"+version.String(), 1)
+			if err := sess.allow(s, version); err != nil {
+				log.Infof("Connection from %s denied: %v\n", conn.RemoteAddr().String(), err)
+				s.writeError(conn, err)
+				break
+			}
+		}
+
+		/* connect requests rejected by hooks are answered like dial errors */
+		sess.req = &Request{RemoteAddr: conn.RemoteAddr(), ClientID: id, Command: command, Target: target}
+		hookErr := s.onRequest(sess)
+		if hookErr != nil {
+			if command != CommandConnect && command != CommandConnectV2 {
+				s.writeError(conn, hookErr)
+				break
+			}
+		} else {
+			target = sess.req.Target
+		}
+
 		if command == CommandPing {
+			if err := sess.allow(s, CapabilityPing); err != nil {
+				log.V(1).Infof("Ping from %s denied: %v\n", conn.RemoteAddr().String(), err)
+				s.writeError(conn, err)
+				break
+			}
 			buf := []byte{ResponsePong}
 			conn.Write(buf)
 			break
 		}
+		if command == CommandTicket {
+			if err := s.handleTicket(conn); err != nil {
+				return fmt.Errorf("write ResponseTicket: %w", err)
+			}
+			continue
+		}
+		if command == CommandResolve {
+			s.handleResolve(sess, target)
+			break
+		}
+		if command == CommandSpeedtest {
+			s.handleSpeedtest(sess)
+			break
+		}
+		if command == CommandBind {
+			s.handleBind(sess, target)
+			break
+		}
+		if command == CommandBindAccept {
+			s.handleBindAccept(sess, target)
+			break
+		}
 
 		switch command {
 		case CommandConnect:
 			isV2 = false
-		case CommandUDP:
-			s.handleUDPRequest(conn)
+		case CommandUDP, CommandUDPDatagram, CommandUDPMux:
+			if err := sess.allow(s, CapabilityUDP); err != nil {
+				log.Infof("UDP from %s denied: %v\n", conn.RemoteAddr().String(), err)
+				s.writeError(conn, err)
+				break muxLoop
+			}
+			switch command {
+			case CommandUDPDatagram:
+				s.handleUDPDatagram(sess)
+			case CommandUDPMux:
+				s.handleUDPMux(sess)
+			default:
+				s.handleUDPRequest(sess)
+			}
 			break muxLoop
 		case CommandConnectV2:
 		default:
-			log.Errorf("Unknown command 0x%x\n", command)
-			break muxLoop
+			return fmt.Errorf("unknown command 0x%x", command)
 		}
 
-		var el error = nil
-		tc, err := net.DialTimeout("tcp", target, 5*time.Second)
-		if err != nil {
-			el = s.writeError(conn, err)
-		} else {
-			defer tc.Close()
-			_, el = conn.Write([]byte{ResponseTunnel})
+		el, err := s.tunnel(sess, target, hookErr, func(err error) error {
+			if err != nil {
+				return s.writeError(sess.conn, err)
+			}
+			_, el := sess.conn.Write([]byte{ResponseTunnel})
 			if el != nil {
 				log.Errorf("Failed to write ResponseTunnel: %v\n", el)
-			} else {
-				el, _ = utils.Relay(conn, tc)
 			}
+			return el
+		})
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
 		}
+		conn = sess.conn
 
 		if isV2 {
 			conn.SetReadDeadline(time.Time{})
 			_, err := conn.Write([]byte{}) // write zero chunk back
 			if err != nil {
-				log.Errorf("Unexpected write error %v\n", err)
-				return
+				return fmt.Errorf("write zero chunk: %w", err)
 			}
 			if e, ok := el.(*net.OpError); ok {
 				if e.Op == "write" {
@@ -202,25 +546,114 @@ muxLoop:
 			p.Put(buf)
 			if !errors.Is(el, aead.ErrZeroChunk) {
 				if !errors.Is(el, io.EOF) {
-					log.Warningf("Unexpected error %v, ZERO CHUNK wanted\n", el)
+					return fmt.Errorf("unexpected error %w, ZERO CHUNK wanted", el)
 				}
 				log.V(1).Infof("Close connection due to %v anyway\n", el)
 				break
 			}
 		}
 	}
+	return nil
+}
 
-	log.V(1).Infof("Session from %s done", conn.RemoteAddr().String())
+// tunnel connects the session to target and relays until either side
+// closes, reply reports the dial result to the client. A non-nil err is
+// fatal to the session, io.EOF if the client closed before sending data.
+func (s *Server) tunnel(sess *session, target string, hookErr error, reply func(error) error) (el, err error) {
+	ctx, conn := sess.ctx, sess.conn
+	if hookErr == nil && (s.opts.FastOpen || s.opts.Sniff) {
+		if err := sess.readEarlyData(); err != nil {
+			return nil, fmt.Errorf("read early data: %w", err)
+		}
+	}
+	/* set once the client was told the tunnel is up */
+	replied := false
+	if hookErr == nil && s.opts.Sniff {
+		/* a client sending nothing along with the request may wait for
+		 * the reply first, so reply before waiting for a payload to sniff,
+		 * later failures then simply end the request */
+		if len(sess.early) == 0 {
+			if el = reply(nil); el != nil {
+				return el, nil
+			}
+			replied = true
+		}
+		if err := sess.sniff(s); err != nil {
+			if !errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("sniff: %w", err)
+			}
+			return nil, io.EOF
+		}
+		conn = sess.conn
+		if sess.sniffed.Protocol != "" {
+			log.Infof("Target %s from %s sniffed as %s, domain %q\n", target, conn.RemoteAddr().String(), sess.sniffed.Protocol, sess.sniffed.Domain)
+		}
+	}
+
+	var tc net.Conn
+	/* set once the early data went along with the dial */
+	sent := false
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.ParseUint(port, 10, 16)
+	if s.opts.SniffOverride && sess.sniffed.Domain != "" && net.ParseIP(host) != nil {
+		log.V(1).Infof("Overriding target %s with sniffed domain %s\n", target, sess.sniffed.Domain)
+		host = sess.sniffed.Domain
+	}
+	host, rport := sess.rewrite(s, "tcp", host, uint16(portNum))
+	target = net.JoinHostPort(host, strconv.Itoa(int(rport)))
+	if hookErr != nil {
+		err = hookErr
+	} else if _, ob := sess.route(s, "tcp", host, rport); ob == nil {
+		log.Infof("Connection from %s to %s rejected by rule\n", conn.RemoteAddr().String(), target)
+		err = errRejected
+	} else {
+		dctx, cancel := context.WithTimeout(ctx, connectTimeout)
+		tc, err = ob.DialContext(dctx, target)
+		cancel()
+		s.opts.Hooks.OnDial(ctx, sess.req, target, err)
+		if d, ok := ob.(*outbound.Direct); ok && len(d.Early) > 0 {
+			sent = true
+		}
+	}
+	if err == nil && len(sess.early) > 0 && !sent {
+		if _, err = tc.Write(sess.early); err != nil {
+			tc.Close()
+		}
+	}
+	if err != nil {
+		if replied {
+			log.Infof("Connection from %s to %s failed after sniffing: %v\n", conn.RemoteAddr().String(), target, err)
+			return err, nil
+		}
+		return reply(err), nil
+	}
+	defer tc.Close()
+	if !replied {
+		el = reply(nil)
+	}
+	if el == nil {
+		start := time.Now()
+		up, down, e, _ := utils.RelayCount(conn, tc)
+		el = e
+		stats := &RelayStats{Upload: up + int64(len(sess.early)), Download: down, Duration: time.Since(start), Err: el}
+		if errors.Is(el, aead.ErrZeroChunk) || errors.Is(el, io.EOF) {
+			stats.Err = nil
+		}
+		s.opts.Hooks.OnRelayDone(ctx, sess.req, stats)
+	}
+	if len(sess.early) > 0 {
+		log.V(1).Infof("TCP fastopen to %s used: %v\n", target, utils.TCPFastOpenUsed(tc))
+	}
+	if s.opts.MultipathTCPOutbound {
+		log.V(1).Infof("Connection to %s using MPTCP: %v\n", target, utils.MultipathTCPUsed(tc))
+	}
+	return el, nil
 }
 
-func (s *SnellServer) writeError(conn net.Conn, err error) error {
+func (s *Server) writeError(conn net.Conn, err error) error {
 	buf := bytes.NewBuffer([]byte{})
 	buf.WriteByte(ResponseError)
-	if e, ok := err.(syscall.Errno); ok {
-		buf.WriteByte(byte(e))
-	} else {
-		buf.WriteByte(byte(0))
-	}
+	buf.WriteByte(errorCode(err))
 	es := err.Error()
 	if len(es) > 250 {
 		es = es[0:250]
@@ -231,36 +664,28 @@ func (s *SnellServer) writeError(conn net.Conn, err error) error {
 	return el
 }
 
-func (s *SnellServer) handleUDPRequest(conn net.Conn) {
+func (s *Server) handleUDPRequest(sess *session) {
+	conn := sess.conn
 	log.V(1).Infof("New UDP request from %s\n", conn.RemoteAddr().String())
 
-	cache, err := lru.New(256)
-	if err != nil {
-		log.Errorf("UDP failed to create lru cache: %v\n", err)
-		return
-	}
-	defer cache.Purge()
-
-	pc, err := net.ListenPacket("udp", "0.0.0.0:0")
+	relay, err := s.newUDPRelay(sess, func(src *net.UDPAddr, b []byte) error {
+		_, err := conn.Write(appendUDPReply(nil, src, b))
+		return err
+	}, func() { conn.Close() })
 	if err != nil {
 		log.Errorf("UDP failed to listen: %v\n", err)
 		s.writeError(conn, err)
 		return
-	} else {
-		defer pc.Close()
-		log.V(1).Infof("UDP listening on: %s\n", pc.LocalAddr().String())
-		if _, err := conn.Write([]byte{ResponseReady}); err != nil {
-			log.Errorf("Failed to write ResponseReady: %v\n", err)
-			return
-		}
 	}
-
-	go s.handleUDPIngress(conn, pc)
+	defer relay.close()
+	if _, err := conn.Write([]byte{ResponseReady}); err != nil {
+		log.Errorf("Failed to write ResponseReady: %v\n", err)
+		return
+	}
 
 	buf := p.Get(p.RelayBufferSize)
 	defer p.Put(buf)
 
-uotLoop:
 	for {
 		n, err := conn.Read(buf)
 		if err != nil {
@@ -272,111 +697,74 @@ uotLoop:
 			break
 		}
 
-		if n < 5 {
-			log.Errorf("UDP over TCP insufficient chunk size: %d < 5\n", n)
+		host, ip, port, payload, err := parseUDPForward(buf[:n])
+		if err != nil {
+			log.Errorf("UDP over TCP %v\n", err)
 			break
 		}
-		cmd := buf[0]
-		hlen := buf[1]
-		iplen := 0
-		head := 2
-		host := ""
-
-		if cmd != CommandUDPForward {
-			log.Errorf("UDP over TCP unknown UDP command: 0x%x\n", cmd)
+		if err := relay.forward(host, ip, port, payload); err != nil {
+			log.Errorf("UDP over TCP failed to forward to %s: %v\n", net.JoinHostPort(host, strconv.Itoa(port)), err)
 			break
 		}
-		if hlen == 0 {
-			switch buf[2] {
-			case 4:
-				iplen = 4
-			case 6:
-				iplen = 16
-			default:
-				log.Errorf("Unknown IP Version: 0x%x\n", buf[2])
-				break uotLoop
-			}
-
-			head = 3 + iplen /* now points to port */
-			if n < head+2 {
-				log.Errorf("UDP over TCP insufficient chunk size: %d < %d\n", n, head+2)
-				break
-			}
-			ip := net.IP(buf[3:head])
-			host = ip.String()
-		} else {
-			head = 2 + int(hlen)
-			if n < head+2 {
-				log.Errorf("UDP over TCP insufficient chunk size: %d < %d\n", n, head+2)
-				break
-			}
-			host = string(buf[2:head])
-		}
-		port := (int(buf[head]) << 8) | int(buf[head+1])
-		head += 2
-		target := net.JoinHostPort(host, strconv.Itoa(port))
-		log.V(1).Infof("UDP over TCP forwarding to %s\n", target)
-
-		var uaddr *net.UDPAddr
-		if value, ok := cache.Get(target); ok {
-			uaddr = value.(*net.UDPAddr)
-			log.V(1).Infof("UDP cache hit: %s -> %s\n", target, uaddr.String())
-		} else {
-			uaddr, err = net.ResolveUDPAddr("udp", target)
-			if err != nil {
-				log.Warningf("UDP over TCP failed to resolve %s: %v\n", target, err)
-				/* won't close connection, but cause this packet losses */
-			}
-			log.V(1).Infof("UDP over TCP resolved target %s -> %s\n", target, uaddr.String())
-			cache.Add(target, uaddr)
-		}
-
-		payloadSize := n - head
-		if payloadSize > 0 {
-			log.V(1).Infof("UDP over TCP forward %d bytes to target %s\n", payloadSize, target)
-			_, err = pc.WriteTo(buf[head:n], uaddr)
-			if err != nil {
-				log.Errorf("UDP over TCP  failed to write to %s: %v\n", target, err)
-				break
-			}
-		}
 	}
 }
 
-func (s *SnellServer) handleUDPIngress(conn net.Conn, pc net.PacketConn) {
-	buf := p.Get(p.RelayBufferSize)
-	defer p.Put(buf)
-
-	for {
-		n, raddr, err := pc.ReadFrom(buf)
-		if err != nil {
-			if !errors.Is(err, net.ErrClosed) {
-				log.Errorf("UDP failed to read: %v\n", err)
-			}
-			break
-		}
-		log.V(1).Infof("UDP read %d bytes from %s\n", n, raddr.String())
+// parseUDPForward splits a CommandUDPForward request into its target and
+// payload, ip is nil for domain targets.
+func parseUDPForward(b []byte) (host string, ip net.IP, port int, payload []byte, err error) {
+	n := len(b)
+	if n < 5 {
+		err = fmt.Errorf("insufficient chunk size: %d < 5", n)
+		return
+	}
+	cmd := b[0]
+	hlen := b[1]
+	head := 2
 
-		uaddr := raddr.(*net.UDPAddr)
-		ipver := 4
-		if uaddr.IP.To4() == nil {
-			ipver = 6
-		}
-		buffer := bytes.NewBuffer([]byte{})
-		buffer.WriteByte(byte(ipver))
-		switch ipver {
+	if cmd != CommandUDPForward {
+		err = fmt.Errorf("unknown UDP command: 0x%x", cmd)
+		return
+	}
+	if hlen == 0 {
+		iplen := 0
+		switch b[2] {
 		case 4:
-			buffer.Write([]byte(uaddr.IP.To4()))
+			iplen = 4
 		case 6:
-			buffer.Write([]byte(uaddr.IP.To16()))
+			iplen = 16
+		default:
+			err = fmt.Errorf("unknown IP Version: 0x%x", b[2])
+			return
 		}
-		buffer.Write([]byte{byte(uaddr.Port >> 8), byte(uaddr.Port & 0xff)})
-		buffer.Write(buf[:n])
 
-		_, err = conn.Write(buffer.Bytes())
-		if err != nil {
-			log.Errorf("UDP failed to write back: %v\n", err)
-			break
+		head = 3 + iplen /* now points to port */
+		if n < head+2 {
+			err = fmt.Errorf("insufficient chunk size: %d < %d", n, head+2)
+			return
 		}
+		ip = net.IP(b[3:head])
+		host = ip.String()
+	} else {
+		head = 2 + int(hlen)
+		if n < head+2 {
+			err = fmt.Errorf("insufficient chunk size: %d < %d", n, head+2)
+			return
+		}
+		host = string(b[2:head])
+	}
+	port = (int(b[head]) << 8) | int(b[head+1])
+	payload = b[head+2:]
+	return
+}
+
+// appendUDPReply appends to dst the packet b from src, framed as sent
+// back to UDP clients.
+func appendUDPReply(dst []byte, src *net.UDPAddr, b []byte) []byte {
+	if ip4 := src.IP.To4(); ip4 != nil {
+		dst = append(append(dst, 4), ip4...)
+	} else {
+		dst = append(append(dst, 6), src.IP.To16()...)
 	}
+	dst = append(dst, byte(src.Port>>8), byte(src.Port&0xff))
+	return append(dst, b...)
 }
@@ -1,9 +1,15 @@
 package snell
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
+	"io"
 	"net"
 	"testing"
+	"time"
+
+	"github.com/icpz/open-snell/components/aead"
 )
 
 func TestSnellServer_ServerHandshake_Connect(t *testing.T) {
@@ -98,3 +104,78 @@ func TestSnellServer_ServerHandshake_InvalidVersion(t *testing.T) {
 		t.Fatalf("Unexpected error: %v", err) // It doesn't return error in current implementation
 	}
 }
+
+func TestServer_ServeConn(t *testing.T) {
+	srv, err := NewServer("test-psk", "", nil)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- srv.ServeConn(context.Background(), server) }()
+
+	c := aead.NewConn(client, aead.NewAES128GCM([]byte("test-psk")))
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte{Version, CommandPing, 0, 0, 0, 0}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(c, buf); err != nil || buf[0] != ResponsePong {
+		t.Fatalf("ping reply = %v, %v", buf, err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("ServeConn failed: %v", err)
+	}
+}
+
+func TestServer_Serve(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	srv, err := NewServer("test-psk", "", nil)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ctx, l) }()
+
+	u, err := NewUpstream(l.Addr().String(), "", "", "test-psk", "", true)
+	if err != nil {
+		t.Fatalf("NewUpstream failed: %v", err)
+	}
+	c, err := u.DialContext(ctx, echo.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := []byte("hello")
+	c.Write(msg)
+	if _, err := io.ReadFull(c, make([]byte, len(msg))); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	/* cancelling closes the listener and the session in flight */
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Serve returned %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after cancel")
+	}
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("session still open after cancel")
+	}
+	if _, err := net.DialTimeout("tcp", l.Addr().String(), time.Second); err == nil {
+		t.Error("listener still open after cancel")
+	}
+}
@@ -0,0 +1,221 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/icpz/open-snell/components/aead"
+	"github.com/icpz/open-snell/components/socks5"
+	p "github.com/icpz/open-snell/components/utils/pool"
+)
+
+// ServeShadowsocks accepts Shadowsocks clients on l, like Serve does for
+// snell clients.
+func (s *Server) ServeShadowsocks(ctx context.Context, l net.Listener) error {
+	return s.serve(ctx, l, s.ServeShadowsocksConn)
+}
+
+// ServeShadowsocksConn serves the Shadowsocks TCP connection c until the
+// tunnel is closed or ctx is done, c is closed on return.
+func (s *Server) ServeShadowsocksConn(ctx context.Context, c net.Conn) error {
+	defer c.Close()
+	ctx, ok := s.acceptConn(ctx, c)
+	if !ok {
+		return nil
+	}
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+
+	sc, i, err := aead.Accept(c, s.ssCiphers, s.ssSalts)
+	if err != nil {
+		if errors.Is(err, aead.ErrNoCipher) {
+			/* keep reading like a valid session, so that probes can not
+			 * tell from the connection being closed early, but bounded */
+			c.SetReadDeadline(time.Now().Add(ssDrainTimeout))
+			io.CopyN(io.Discard, c, ssDrainLimit)
+		}
+		return fmt.Errorf("shadowsocks handshake: %w", err)
+	}
+	sess := &session{ctx: ctx, conn: sc, user: s.ssUsers[i]}
+	addr, err := socks5.ReadAddr(sc, make([]byte, socks5.MaxAddrLen))
+	if err != nil {
+		return fmt.Errorf("read target: %w", err)
+	}
+	target := addr.String()
+	log.Infof("New shadowsocks target from %s to %s\n", c.RemoteAddr().String(), target)
+	sessionCount.Add(sess.metricsName()+"/shadowsocks", 1)
+
+	sess.req = &Request{RemoteAddr: c.RemoteAddr(), ClientID: clientID(sess.user), Command: CommandConnect, Target: target}
+	/* there is no reply in Shadowsocks, dial errors close the connection */
+	return s.serveTunnel(sess, func(err error) error { return err })
+}
+
+const (
+	// ssDrainTimeout and ssDrainLimit bound how long and how much is read
+	// from a connection which no cipher authenticates before closing it.
+	ssDrainTimeout = 30 * time.Second
+	ssDrainLimit   = 64 * 1024
+)
+
+// ssAssoc is the UDP association of a Shadowsocks client address, served
+// by its own goroutine which owns the relay.
+type ssAssoc struct {
+	cipher aead.Cipher
+	queue  chan udpPacket
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// ServeShadowsocksPacket serves the Shadowsocks UDP clients sending to pc
+// until ctx is done, pc is closed on return. Hooks.OnAccept is not called
+// for UDP associations.
+func (s *Server) ServeShadowsocksPacket(ctx context.Context, pc net.PacketConn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { pc.Close() })
+	defer stop()
+
+	var mu sync.Mutex
+	assocs := make(map[string]*ssAssoc)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, a := range assocs {
+			a.cancel()
+		}
+	}()
+
+	buf := p.Get(p.RelayBufferSize)
+	defer p.Put(buf)
+	plain := make([]byte, p.RelayBufferSize)
+
+	for {
+		n, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		var b []byte
+		i := -1
+		for j, c := range s.ssCiphers {
+			if b, err = aead.OpenPacket(plain[:0], c, buf[:n]); err == nil {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			log.V(1).Infof("Shadowsocks packet from %s dropped: %v\n", src.String(), aead.ErrNoCipher)
+			continue
+		}
+		addr := socks5.SplitAddr(b)
+		if addr == nil {
+			log.V(1).Infof("Shadowsocks packet from %s dropped: invalid target\n", src.String())
+			continue
+		}
+
+		key := src.String()
+		mu.Lock()
+		a := assocs[key]
+		mu.Unlock()
+		if a != nil && a.cipher != s.ssCiphers[i] {
+			/* the address was taken over by another user */
+			s.expireAssoc(&mu, assocs, key, a)
+			a = nil
+		}
+		if a == nil {
+			a = &ssAssoc{cipher: s.ssCiphers[i], queue: make(chan udpPacket, udpQueueSize)}
+			a.ctx, a.cancel = context.WithCancel(ctx)
+			mu.Lock()
+			assocs[key] = a
+			mu.Unlock()
+			go s.serveAssoc(pc, src, i, a, func() { s.expireAssoc(&mu, assocs, key, a) })
+		}
+
+		host, sport, _ := net.SplitHostPort(addr.String())
+		port, _ := strconv.Atoi(sport)
+		if !queueUDP(a.queue, host, net.ParseIP(host), port, b[len(addr):]) {
+			log.V(1).Infof("Shadowsocks packet from %s dropped: queue full\n", key)
+		}
+	}
+}
+
+// serveAssoc sets up the relay of a, keyed by the i-th cipher, and forwards
+// its packets until a is expired. Resolving and dialing only hold up this
+// association.
+func (s *Server) serveAssoc(pc net.PacketConn, src net.Addr, i int, a *ssAssoc, expire func()) {
+	defer expire()
+	relay, err := s.newAssoc(a.ctx, pc, src, i, expire)
+	if err != nil {
+		log.Infof("Shadowsocks UDP from %s rejected: %v\n", src.String(), err)
+		return
+	}
+	defer relay.close()
+	stop := context.AfterFunc(a.ctx, relay.close)
+	defer stop()
+	relay.serveQueue(a.queue, func(err error) {
+		log.Errorf("Shadowsocks UDP from %s failed to forward: %v\n", src.String(), err)
+	})
+}
+
+// newAssoc creates the relay of the association of src keyed by the i-th
+// cipher, idle is called once it is idle.
+func (s *Server) newAssoc(ctx context.Context, pc net.PacketConn, src net.Addr, i int, idle func()) (*udpRelay, error) {
+	ciph := s.ssCiphers[i]
+	sess := &session{ctx: ctx, user: s.ssUsers[i]}
+	sess.req = &Request{RemoteAddr: src, ClientID: clientID(sess.user), Command: CommandUDP}
+	if err := sess.allow(s, CapabilityUDP); err != nil {
+		return nil, err
+	}
+	if err := s.onRequest(sess); err != nil {
+		return nil, err
+	}
+	sessionCount.Add(sess.metricsName()+"/shadowsocks", 1)
+
+	relay, err := s.newUDPRelay(sess, func(from *net.UDPAddr, b []byte) error {
+		pkt, err := aead.SealPacket(nil, ciph, append(socks5.ParseAddrToSocksAddr(from), b...))
+		if err != nil {
+			return err
+		}
+		_, err = pc.WriteTo(pkt, src)
+		return err
+	}, idle)
+	if err != nil {
+		return nil, err
+	}
+	log.V(1).Infof("New shadowsocks UDP association from %s\n", src.String())
+	return relay, nil
+}
+
+func (s *Server) expireAssoc(mu *sync.Mutex, assocs map[string]*ssAssoc, key string, a *ssAssoc) {
+	mu.Lock()
+	if assocs[key] == a {
+		delete(assocs, key)
+	}
+	mu.Unlock()
+	a.cancel()
+}
@@ -0,0 +1,188 @@
+package snell
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/icpz/open-snell/components/aead"
+	"github.com/icpz/open-snell/components/socks5"
+)
+
+func newShadowsocksServer(t *testing.T) *Server {
+	t.Helper()
+	egress := &memDialer{serve: func(address string, c net.Conn) {
+		defer c.Close()
+		io.Copy(c, c)
+	}}
+	srv, err := NewServer("test-psk", "", &ServerOptions{
+		Dialer:      egress,
+		Users:       []*User{{Name: "alice", Password: "alice-pass"}},
+		Shadowsocks: &ShadowsocksOptions{Method: aead.MethodAES256GCM, Password: "listener-pass"},
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	return srv
+}
+
+func TestServer_ShadowsocksConn(t *testing.T) {
+	srv := newShadowsocksServer(t)
+	ciph, _ := aead.NewShadowsocks(aead.MethodAES256GCM, "alice-pass")
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go srv.ServeShadowsocksConn(context.Background(), server)
+
+	c := aead.NewConn(client, ciph)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := []byte("hello shadowsocks")
+	go c.Write(append(socks5.ParseAddr("192.0.2.1:80"), msg...))
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != string(msg) {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+}
+
+func TestServer_ShadowsocksConnUnauthenticated(t *testing.T) {
+	srv := newShadowsocksServer(t)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() { done <- srv.ServeShadowsocksConn(context.Background(), server) }()
+
+	/* garbage is read up to the drain limit, then the connection closes */
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	garbage := make([]byte, ssDrainLimit+4096)
+	if _, err := client.Write(garbage); err == nil {
+		t.Error("Write beyond the drain limit succeeded")
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, aead.ErrNoCipher) {
+			t.Errorf("ServeShadowsocksConn = %v, want %v", err, aead.ErrNoCipher)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeShadowsocksConn did not return")
+	}
+}
+
+func TestServer_ShadowsocksPacket(t *testing.T) {
+	srv := newShadowsocksServer(t)
+	ciph, _ := aead.NewShadowsocks(aead.MethodAES256GCM, "listener-pass")
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.ServeShadowsocksPacket(ctx, pc) }()
+
+	client, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	target := socks5.ParseAddr("192.0.2.2:53")
+	msg := []byte("hello datagram")
+	pkt, err := aead.SealPacket(nil, ciph, append(target, msg...))
+	if err != nil {
+		t.Fatalf("SealPacket failed: %v", err)
+	}
+	if _, err := client.Write(pkt); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	buf := make([]byte, 2048)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	reply, err := aead.OpenPacket(nil, ciph, buf[:n])
+	if err != nil {
+		t.Fatalf("OpenPacket failed: %v", err)
+	}
+	if addr := socks5.SplitAddr(reply); addr.String() != "192.0.2.2:53" || string(reply[len(addr):]) != string(msg) {
+		t.Errorf("reply = %q", reply)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("ServeShadowsocksPacket = %v, want context.Canceled", err)
+	}
+}
+
+func TestServer_ShadowsocksPacketSlowTarget(t *testing.T) {
+	resolver := &slowResolver{release: make(chan struct{})}
+	defer close(resolver.release)
+	srv, err := NewServer("test-psk", "", &ServerOptions{
+		Dialer:      &memDialer{},
+		Resolver:    resolver,
+		Shadowsocks: &ShadowsocksOptions{Method: aead.MethodAES256GCM, Password: "listener-pass"},
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	ciph, _ := aead.NewShadowsocks(aead.MethodAES256GCM, "listener-pass")
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.ServeShadowsocksPacket(ctx, pc)
+
+	send := func(c net.Conn, target string, msg []byte) {
+		pkt, _ := aead.SealPacket(nil, ciph, append(socks5.ParseAddr(target), msg...))
+		if _, err := c.Write(pkt); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	slow, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer slow.Close()
+	send(slow, "slow.test:53", []byte("stuck"))
+
+	/* another association is served while the first one resolves */
+	client, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	msg := []byte("hello past a slow association")
+	send(client, "192.0.2.2:53", msg)
+	buf := make([]byte, 2048)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	reply, err := aead.OpenPacket(nil, ciph, buf[:n])
+	if err != nil || string(reply[len(socks5.SplitAddr(reply)):]) != string(msg) {
+		t.Errorf("reply = %q, %v", reply, err)
+	}
+}
+
+func TestServerOptions_ShadowsocksValidate(t *testing.T) {
+	opts := &ServerOptions{Shadowsocks: &ShadowsocksOptions{Method: "rc4-md5", Password: "x"}}
+	if opts.Validate() == nil {
+		t.Error("unsupported method accepted")
+	}
+	opts.Shadowsocks = &ShadowsocksOptions{Method: aead.MethodChacha20Poly1305}
+	if opts.Validate() == nil {
+		t.Error("inbound without password accepted")
+	}
+	opts.Users = []*User{{Name: "bob", Password: "bob-pass"}}
+	if err := opts.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/icpz/open-snell/components/aead"
+	"github.com/icpz/open-snell/components/sniff"
+	p "github.com/icpz/open-snell/components/utils/pool"
+)
+
+// DefaultSniffTimeout bounds the wait for the first client payload, server
+// first protocols never send one.
+const DefaultSniffTimeout = 300 * time.Millisecond
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// pendingConn hands out the result of a read started while sniffing
+// before reading from the connection again.
+type pendingConn struct {
+	net.Conn
+	ch   chan readResult
+	data []byte
+	err  error
+}
+
+func (c *pendingConn) Read(b []byte) (int, error) {
+	if c.ch != nil {
+		r := <-c.ch
+		c.ch = nil
+		c.data, c.err = r.data, r.err
+	}
+	if len(c.data) > 0 {
+		n := copy(b, c.data)
+		c.data = c.data[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		err := c.err
+		c.err = nil
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// sniff detects the protocol of the first client payload, waiting for it
+// if nothing came along with the handshake. The payload is kept as early
+// data and sent once the target is connected.
+func (s *session) sniff(srv *Server) error {
+	if len(s.early) == 0 {
+		timeout := srv.opts.SniffTimeout
+		if timeout <= 0 {
+			timeout = DefaultSniffTimeout
+		}
+
+		ch := make(chan readResult, 1)
+		go func(conn net.Conn) {
+			buf := p.Get(p.RelayBufferSize)
+			n, err := conn.Read(buf)
+			data := append([]byte{}, buf[:n]...)
+			p.Put(buf)
+			ch <- readResult{data, err}
+		}(s.conn)
+
+		select {
+		case r := <-ch:
+			/* a zero chunk ends the request, not the session, the relay
+			 * passes it on like any half close */
+			if r.err != nil && len(r.data) == 0 && !errors.Is(r.err, aead.ErrZeroChunk) {
+				return r.err
+			}
+			s.early = r.data
+			if r.err != nil {
+				s.conn = &pendingConn{Conn: s.conn, err: r.err}
+			}
+		case <-time.After(timeout):
+			// leave the read running, the relay picks it up
+			s.conn = &pendingConn{Conn: s.conn, ch: ch}
+			return nil
+		}
+	}
+
+	s.sniffed = sniff.Stream(s.early)
+	return nil
+}
@@ -0,0 +1,218 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/icpz/open-snell/components/aead"
+	p "github.com/icpz/open-snell/components/utils/pool"
+)
+
+const (
+	// SpeedtestMaxDuration caps the duration requested by clients
+	SpeedtestMaxDuration = 30 * time.Second
+	// speedtestGrace is allowed on top of the duration for the last
+	// bytes in flight
+	speedtestGrace = 10 * time.Second
+	speedtestPings = 3
+)
+
+// handleSpeedtest serves CommandSpeedtest, the request carries the
+// direction and the duration in milliseconds. Downloads stream bytes for
+// the duration, uploads are sunk until a zero chunk and the received byte
+// count is sent back.
+func (s *Server) handleSpeedtest(sess *session) {
+	conn := sess.conn
+	var req [5]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		log.Warningf("Failed to read speedtest request: %v\n", err)
+		return
+	}
+	if !s.opts.Speedtest {
+		s.writeError(conn, errors.New("speedtest disabled"))
+		return
+	}
+	duration := time.Duration(binary.BigEndian.Uint32(req[1:])) * time.Millisecond
+	if duration <= 0 || duration > SpeedtestMaxDuration {
+		duration = SpeedtestMaxDuration
+	}
+	if req[0] != SpeedtestUpload && req[0] != SpeedtestDownload {
+		s.writeError(conn, fmt.Errorf("unknown speedtest direction %d", req[0]))
+		return
+	}
+	log.Infof("Speedtest from %s, direction %d for %v\n", conn.RemoteAddr().String(), req[0], duration)
+	if _, err := conn.Write([]byte{ResponseReady}); err != nil {
+		return
+	}
+
+	switch req[0] {
+	case SpeedtestDownload:
+		/* not pooled, the payload must not carry data of other sessions */
+		buf := make([]byte, p.RelayBufferSize)
+		conn.SetWriteDeadline(time.Now().Add(duration + speedtestGrace))
+		for end := time.Now().Add(duration); time.Now().Before(end); {
+			if _, err := conn.Write(buf); err != nil {
+				log.V(1).Infof("Speedtest download ends: %v\n", err)
+				return
+			}
+		}
+	case SpeedtestUpload:
+		buf := p.Get(p.RelayBufferSize)
+		defer p.Put(buf)
+		conn.SetReadDeadline(time.Now().Add(duration + speedtestGrace))
+		var total uint64
+		for {
+			n, err := conn.Read(buf)
+			total += uint64(n)
+			if errors.Is(err, aead.ErrZeroChunk) {
+				break
+			}
+			if err != nil {
+				log.V(1).Infof("Speedtest upload ends: %v\n", err)
+				return
+			}
+		}
+		binary.BigEndian.PutUint64(buf[:8], total)
+		conn.Write(buf[:8])
+	}
+}
+
+// SpeedtestResult holds the throughput in bytes per second and the
+// smallest round trip time measured with pings.
+type SpeedtestResult struct {
+	RTT      time.Duration
+	Upload   float64
+	Download float64
+}
+
+// Speedtest measures the round trip time, the upload and the download
+// throughput to the server, each transfer lasting duration, up to
+// SpeedtestMaxDuration.
+func (s *SnellClient) Speedtest(ctx context.Context, duration time.Duration) (*SpeedtestResult, error) {
+	if duration <= 0 || duration > SpeedtestMaxDuration {
+		duration = SpeedtestMaxDuration
+	}
+	res := &SpeedtestResult{}
+	for i := 0; i < speedtestPings; i++ {
+		rtt, err := s.ping(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("ping: %w", err)
+		}
+		if res.RTT == 0 || rtt < res.RTT {
+			res.RTT = rtt
+		}
+	}
+
+	var err error
+	if res.Upload, err = s.speedtest(ctx, SpeedtestUpload, duration); err != nil {
+		return nil, fmt.Errorf("upload: %w", err)
+	}
+	if res.Download, err = s.speedtest(ctx, SpeedtestDownload, duration); err != nil {
+		return nil, fmt.Errorf("download: %w", err)
+	}
+	return res, nil
+}
+
+// ping times a CommandPing exchange, excluding the connection setup.
+func (s *SnellClient) ping(ctx context.Context) (time.Duration, error) {
+	c, err := s.dialServer(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(speedtestGrace))
+
+	id, err := s.clientID(c)
+	if err != nil {
+		return 0, err
+	}
+	buf := bytes.NewBuffer([]byte{Version, CommandPing, byte(len(id))})
+	buf.WriteString(id)
+	buf.Write([]byte{0, 0, 0}) // empty host and port
+
+	start := time.Now()
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	var pong [1]byte
+	if _, err := io.ReadFull(c, pong[:]); err != nil {
+		return 0, err
+	}
+	if pong[0] != ResponsePong {
+		return 0, errors.New("Command not support")
+	}
+	return time.Since(start), nil
+}
+
+func (s *SnellClient) speedtest(ctx context.Context, direction byte, duration time.Duration) (float64, error) {
+	c, err := s.dialServer(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(duration + 2*speedtestGrace))
+
+	id, err := s.clientID(c)
+	if err != nil {
+		return 0, err
+	}
+	buf := bytes.NewBuffer([]byte{Version, CommandSpeedtest, byte(len(id))})
+	buf.WriteString(id)
+	buf.WriteByte(direction)
+	binary.Write(buf, binary.BigEndian, uint32(duration/time.Millisecond))
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	if err := readReply(c); err != nil {
+		return 0, err
+	}
+
+	data := make([]byte, p.RelayBufferSize)
+	start := time.Now()
+	var total uint64
+	if direction == SpeedtestUpload {
+		for end := start.Add(duration); time.Now().Before(end); {
+			if _, err := c.Write(data); err != nil {
+				return 0, err
+			}
+		}
+		c.Write([]byte{}) // zero chunk ends the upload
+		if _, err := io.ReadFull(c, data[:8]); err != nil {
+			return 0, err
+		}
+		total = binary.BigEndian.Uint64(data[:8])
+	} else {
+		for {
+			n, err := c.Read(data)
+			total += uint64(n)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return float64(total) / time.Since(start).Seconds(), nil
+}
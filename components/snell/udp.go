@@ -0,0 +1,499 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/icpz/open-snell/components/sniff"
+	p "github.com/icpz/open-snell/components/utils/pool"
+)
+
+// UDP reply filtering of UDPOptions.Filter
+const (
+	UDPFilterFullCone = "full-cone"
+	UDPFilterAddress  = "address-restricted"
+	UDPFilterPort     = "port-restricted"
+)
+
+// DefaultUDPTimeout closes UDP sessions idle for this duration unless
+// configured otherwise.
+const DefaultUDPTimeout = 5 * time.Minute
+
+// UDPOptions configures the NAT behaviour of UDP sessions. Each session
+// sends from the same address to every target, endpoint-independent
+// mapping, the sources of replies are filtered according to Filter.
+type UDPOptions struct {
+	// Filter accepts replies from any source with UDPFilterFullCone
+	// (default), from the addresses sent to with UDPFilterAddress, or from
+	// the exact addresses and ports with UDPFilterPort.
+	Filter string
+	// MaxDestinations bounds the targets of a session not idle for
+	// Timeout, PacketRate the packets it sends per second, 0 means
+	// unlimited. Packets over the limits are dropped.
+	MaxDestinations int
+	PacketRate      int
+	// Timeout closes idle sessions, DefaultUDPTimeout if 0.
+	Timeout time.Duration
+}
+
+func (o *UDPOptions) Validate() error {
+	switch o.Filter {
+	case "", UDPFilterFullCone, UDPFilterAddress, UDPFilterPort:
+		return nil
+	}
+	return fmt.Errorf("invalid UDP filter %s", o.Filter)
+}
+
+func (o *UDPOptions) timeout() time.Duration {
+	if o.Timeout <= 0 {
+		return DefaultUDPTimeout
+	}
+	return o.Timeout
+}
+
+// udpRelay forwards the packets of a UDP session to their targets, replies
+// are passed to reply along with their source address. The relay closes
+// itself and calls idle once no packet went through for the UDP timeout.
+type udpRelay struct {
+	srv   *Server
+	sess  *session
+	reply func(src *net.UDPAddr, b []byte) error
+	idle  func()
+	timer *time.Timer
+	/* unix nano of the last packet, in either direction */
+	last atomic.Int64
+
+	/* NAT state: the destinations and addresses sent to along with their
+	 * last use, the start and the packet count of the rate window */
+	nat     sync.Mutex
+	dests   map[string]time.Time
+	addrs   map[string]time.Time
+	sweepAt int
+	/* original targets of rewritten packets, keyed by the new address,
+	 * each address stands for one target as replies carry no more */
+	rewrites map[string]udpRewrite
+	window   time.Time
+	packets  int
+
+	mu sync.Mutex
+	pc net.PacketConn
+	/* packet conns of the routed egresses, created on first use */
+	routed map[string]net.PacketConn
+	closed bool
+	/* closed along with the relay */
+	done chan struct{}
+}
+
+// udpRewrite is the original target of packets rewritten to an address.
+type udpRewrite struct {
+	orig *net.UDPAddr
+	last time.Time
+}
+
+// udpQueueSize is the number of packets of a session which may wait for
+// their target to be resolved or dialed, further ones are dropped.
+const udpQueueSize = 64
+
+// udpPacket is a packet of the client waiting to be forwarded.
+type udpPacket struct {
+	host    string
+	ip      net.IP
+	port    int
+	payload []byte
+}
+
+// queueUDP copies a packet out of the read buffer into queue, it reports
+// false if the queue is full.
+func queueUDP(queue chan<- udpPacket, host string, ip net.IP, port int, payload []byte) bool {
+	pkt := udpPacket{host, append(net.IP(nil), ip...), port, append([]byte(nil), payload...)}
+	select {
+	case queue <- pkt:
+		return true
+	default:
+		return false
+	}
+}
+
+// serveQueue forwards the packets of queue until the relay is closed, so
+// that the loop reading the packets of many sessions is not held up by
+// one of them. fail is called once forwarding breaks the relay.
+func (r *udpRelay) serveQueue(queue <-chan udpPacket, fail func(error)) {
+	for {
+		select {
+		case pkt := <-queue:
+			if err := r.forward(pkt.host, pkt.ip, pkt.port, pkt.payload); err != nil {
+				fail(err)
+				return
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (s *Server) newUDPRelay(sess *session, reply func(*net.UDPAddr, []byte) error, idle func()) (*udpRelay, error) {
+	ctx, cancel := context.WithTimeout(sess.ctx, dialTimeout)
+	pc, err := sess.outbound(s).ListenPacket(ctx)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	log.V(1).Infof("UDP listening on: %s\n", pc.LocalAddr().String())
+
+	r := &udpRelay{
+		srv:      s,
+		sess:     sess,
+		reply:    reply,
+		idle:     idle,
+		pc:       pc,
+		routed:   make(map[string]net.PacketConn),
+		dests:    make(map[string]time.Time),
+		addrs:    make(map[string]time.Time),
+		done:     make(chan struct{}),
+		rewrites: make(map[string]udpRewrite),
+	}
+	r.touch()
+	r.mu.Lock()
+	r.timer = time.AfterFunc(s.opts.UDP.timeout(), r.checkIdle)
+	r.mu.Unlock()
+	go r.ingress(pc)
+	return r, nil
+}
+
+func (r *udpRelay) touch() {
+	r.last.Store(time.Now().UnixNano())
+}
+
+// checkIdle closes the relay once idle, or checks it again later.
+func (r *udpRelay) checkIdle() {
+	timeout := r.srv.opts.UDP.timeout()
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	if idle := time.Since(time.Unix(0, r.last.Load())); idle < timeout {
+		r.timer.Reset(timeout - idle)
+		r.mu.Unlock()
+		return
+	}
+	r.mu.Unlock()
+	log.V(1).Infof("UDP session of %s idle for %v, closing\n", r.sess.req.RemoteAddr.String(), timeout)
+	r.close()
+	if r.idle != nil {
+		r.idle()
+	}
+}
+
+// admit counts a packet from the client against the rate limit.
+func (r *udpRelay) admit() bool {
+	rate := r.srv.opts.UDP.PacketRate
+	if rate <= 0 {
+		return true
+	}
+	r.nat.Lock()
+	defer r.nat.Unlock()
+	if now := time.Now(); now.Sub(r.window) >= time.Second {
+		r.window, r.packets = now, 0
+	}
+	r.packets++
+	return r.packets <= rate
+}
+
+// track records the destination of a packet, false if it exceeds the
+// destination limit.
+func (r *udpRelay) track(dst *net.UDPAddr) bool {
+	opts := &r.srv.opts.UDP
+	if opts.MaxDestinations <= 0 && (opts.Filter == "" || opts.Filter == UDPFilterFullCone) {
+		return true
+	}
+	r.nat.Lock()
+	defer r.nat.Unlock()
+	now, key := time.Now(), dst.String()
+	if _, ok := r.dests[key]; !ok {
+		if len(r.dests) >= r.sweepAt || (opts.MaxDestinations > 0 && len(r.dests) >= opts.MaxDestinations) {
+			r.sweep(now)
+		}
+		if opts.MaxDestinations > 0 && len(r.dests) >= opts.MaxDestinations {
+			return false
+		}
+	}
+	r.dests[key] = now
+	r.addrs[dst.IP.String()] = now
+	return true
+}
+
+// sweep forgets the destinations idle for the UDP timeout.
+func (r *udpRelay) sweep(now time.Time) {
+	timeout := r.srv.opts.UDP.timeout()
+	for k, t := range r.dests {
+		if now.Sub(t) >= timeout {
+			delete(r.dests, k)
+		}
+	}
+	for k, t := range r.addrs {
+		if now.Sub(t) >= timeout {
+			delete(r.addrs, k)
+		}
+	}
+	for k, rw := range r.rewrites {
+		if now.Sub(rw.last) >= timeout {
+			delete(r.rewrites, k)
+		}
+	}
+	r.sweepAt = max(2*len(r.dests), 2*len(r.rewrites), 256)
+}
+
+// mapRewrite records that packets to dst are rewritten from orig, false if
+// dst already stands for another target. The mapping expires along with
+// the NAT state once no packet was sent to dst for the UDP timeout.
+func (r *udpRelay) mapRewrite(dst, orig *net.UDPAddr) bool {
+	r.nat.Lock()
+	defer r.nat.Unlock()
+	now, key := time.Now(), dst.String()
+	if rw, ok := r.rewrites[key]; ok && now.Sub(rw.last) < r.srv.opts.UDP.timeout() && rw.orig.String() != orig.String() {
+		return false
+	}
+	if len(r.rewrites) >= r.sweepAt {
+		r.sweep(now)
+	}
+	r.rewrites[key] = udpRewrite{orig: orig, last: now}
+	return true
+}
+
+// original returns the target rewritten to addr, nil if there is none.
+func (r *udpRelay) original(addr *net.UDPAddr) *net.UDPAddr {
+	r.nat.Lock()
+	defer r.nat.Unlock()
+	rw, ok := r.rewrites[addr.String()]
+	if !ok || time.Since(rw.last) >= r.srv.opts.UDP.timeout() {
+		return nil
+	}
+	return rw.orig
+}
+
+// filter reports whether a reply from src passes the filtering policy.
+func (r *udpRelay) filter(src *net.UDPAddr) bool {
+	var m map[string]time.Time
+	var key string
+	switch r.srv.opts.UDP.Filter {
+	case UDPFilterAddress:
+		m, key = r.addrs, src.IP.String()
+	case UDPFilterPort:
+		m, key = r.dests, src.String()
+	default:
+		return true
+	}
+	r.nat.Lock()
+	defer r.nat.Unlock()
+	_, ok := m[key]
+	return ok
+}
+
+// drop counts a packet dropped by the NAT policy.
+func (r *udpRelay) drop(reason, addr string) {
+	udpDropped.Add(r.sess.metricsName()+"/"+reason, 1)
+	log.V(1).Infof("UDP packet of %s for %s dropped: %s\n", r.sess.req.RemoteAddr.String(), addr, reason)
+}
+
+// forward sends payload to host:port, ip is set if host is an IP literal.
+// Packets which can not be delivered are dropped, an error is returned
+// only if the relay is broken.
+func (r *udpRelay) forward(host string, ip net.IP, port int, payload []byte) error {
+	s, sess := r.srv, r.sess
+	if !r.admit() {
+		r.drop("rate", net.JoinHostPort(host, strconv.Itoa(port)))
+		return nil
+	}
+	if s.opts.Sniff {
+		if sess.sniffed = sniff.Packet(payload); sess.sniffed.Protocol != "" {
+			log.V(1).Infof("UDP sniffed %s to %s, domain %q\n", sess.sniffed.Protocol, host, sess.sniffed.Domain)
+		}
+	}
+
+	/* replies from a rewritten IP target are mapped back to it, the
+	 * client can not tell the address of a domain target anyway */
+	var orig *net.UDPAddr
+	rhost, rport := sess.rewrite(s, "udp", host, uint16(port))
+	rewritten := rhost != host || int(rport) != port
+	if rewritten {
+		if ip != nil {
+			orig = &net.UDPAddr{IP: append(net.IP{}, ip...), Port: port}
+		}
+		host, port = rhost, int(rport)
+		if ip = net.ParseIP(host); ip != nil {
+			host = ip.String()
+		}
+	}
+
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	pc, err := r.egress(host, uint16(port))
+	if pc == nil {
+		if err != nil {
+			log.Warningf("UDP packet to %s dropped: %v\n", target, err)
+		}
+		return nil
+	}
+
+	ips := []net.IP{ip}
+	if ip == nil {
+		log.V(1).Infof("UDP forwarding to %s\n", target)
+		ctx, cancel := context.WithTimeout(sess.ctx, dialTimeout)
+		ips, err = sess.resolver(s).LookupIP(ctx, s.opts.Strategy.LookupNetwork(), host)
+		cancel()
+		if err != nil {
+			/* won't close the session, but cause this packet losses */
+			log.Warningf("UDP failed to resolve %s: %v\n", target, err)
+			return nil
+		}
+	}
+	/* UDP can not race, the first address of the strategy order is used */
+	if ips = s.opts.Strategy.Order(ips); len(ips) == 0 {
+		log.Warningf("UDP no address of %s matches the dial strategy\n", target)
+		return nil
+	}
+	uaddr := &net.UDPAddr{IP: ips[0], Port: port}
+	/* the replies of a many-to-one rewrite could not be told apart, only
+	 * the first target reaching an address within the session is relayed */
+	if orig != nil {
+		if !r.mapRewrite(uaddr, orig) {
+			r.drop("rewrite", uaddr.String())
+			return nil
+		}
+	} else if !rewritten && r.original(uaddr) != nil {
+		r.drop("rewrite", uaddr.String())
+		return nil
+	}
+	if ip == nil {
+		log.V(1).Infof("UDP resolved target %s -> %s\n", target, uaddr.String())
+	} else {
+		log.V(1).Infof("UDP forwarding to %s\n", uaddr.String())
+	}
+
+	if !r.track(uaddr) {
+		r.drop("destinations", uaddr.String())
+		return nil
+	}
+	r.touch()
+
+	if len(payload) > 0 {
+		log.V(1).Infof("UDP forward %d bytes to target %s\n", len(payload), uaddr.String())
+		if _, err = pc.WriteTo(payload, uaddr); err != nil {
+			return err
+		}
+		s.opts.Hooks.OnPacket(sess.ctx, sess.req, &Packet{Addr: uaddr, Size: len(payload)})
+	}
+	return nil
+}
+
+// egress returns the packet conn routed to host:port, nil if the packet
+// is rejected or the egress failed.
+func (r *udpRelay) egress(host string, port uint16) (net.PacketConn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, net.ErrClosed
+	}
+	if r.srv.opts.Router == nil {
+		return r.pc, nil
+	}
+	action, ob := r.sess.route(r.srv, "udp", host, port)
+	if ob == nil {
+		log.V(1).Infof("UDP packet to %s rejected by rule\n", net.JoinHostPort(host, strconv.Itoa(int(port))))
+		return nil, nil
+	}
+	if action == "" {
+		return r.pc, nil
+	}
+	if pc := r.routed[action]; pc != nil {
+		return pc, nil
+	}
+	ctx, cancel := context.WithTimeout(r.sess.ctx, dialTimeout)
+	pc, err := ob.ListenPacket(ctx)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	r.routed[action] = pc
+	go r.ingress(pc)
+	return pc, nil
+}
+
+// ingress passes the replies received on pc to the client.
+func (r *udpRelay) ingress(pc net.PacketConn) {
+	buf := p.Get(p.RelayBufferSize)
+	defer p.Put(buf)
+
+	for {
+		n, raddr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Errorf("UDP failed to read: %v\n", err)
+			}
+			break
+		}
+		log.V(1).Infof("UDP read %d bytes from %s\n", n, raddr.String())
+
+		uaddr, ok := raddr.(*net.UDPAddr)
+		if !ok {
+			/* custom dialers may report other address types */
+			ap, err := netip.ParseAddrPort(raddr.String())
+			if err != nil {
+				r.drop("address", raddr.String())
+				continue
+			}
+			uaddr = net.UDPAddrFromAddrPort(ap)
+		}
+		if !r.filter(uaddr) {
+			r.drop("filtered", uaddr.String())
+			continue
+		}
+		r.touch()
+		if orig := r.original(uaddr); orig != nil {
+			uaddr = orig
+		}
+		if err := r.reply(uaddr, buf[:n]); err != nil {
+			log.Errorf("UDP failed to write back: %v\n", err)
+			break
+		}
+		r.srv.opts.Hooks.OnPacket(r.sess.ctx, r.sess.req, &Packet{Addr: uaddr, Size: n, Reply: true})
+	}
+}
+
+func (r *udpRelay) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	close(r.done)
+	r.timer.Stop()
+	r.pc.Close()
+	for _, pc := range r.routed {
+		pc.Close()
+	}
+}
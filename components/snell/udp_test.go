@@ -0,0 +1,206 @@
+package snell
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestRelay returns a relay of srv collecting the sources of replies.
+func newTestRelay(t *testing.T, srv *Server) (*udpRelay, chan string, chan struct{}) {
+	t.Helper()
+	replies := make(chan string, 16)
+	idle := make(chan struct{})
+	sess := &session{ctx: context.Background(), req: &Request{RemoteAddr: &net.TCPAddr{}, Command: CommandUDP}}
+	r, err := srv.newUDPRelay(sess, func(src *net.UDPAddr, b []byte) error {
+		replies <- src.String()
+		return nil
+	}, func() { close(idle) })
+	if err != nil {
+		t.Fatalf("newUDPRelay failed: %v", err)
+	}
+	t.Cleanup(r.close)
+	return r, replies, idle
+}
+
+func countReplies(replies chan string) int {
+	n := 0
+	for {
+		select {
+		case <-replies:
+			n++
+		case <-time.After(100 * time.Millisecond):
+			return n
+		}
+	}
+}
+
+func TestUDPRelay_Limits(t *testing.T) {
+	srv, _ := NewServer("test-psk", "", &ServerOptions{
+		Dialer: &memDialer{},
+		UDP:    UDPOptions{MaxDestinations: 2, PacketRate: 4},
+	})
+	r, replies, _ := newTestRelay(t, srv)
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.1"} {
+		r.forward(ip, net.ParseIP(ip), 53, []byte("query"))
+	}
+	if n := countReplies(replies); n != 3 {
+		t.Errorf("got %d replies, want 3 with the third destination dropped", n)
+	}
+	/* the rate window is exhausted */
+	r.forward("192.0.2.1", net.ParseIP("192.0.2.1"), 53, []byte("query"))
+	if n := countReplies(replies); n != 0 {
+		t.Errorf("got %d replies over the packet rate", n)
+	}
+}
+
+func TestUDPRelay_Filter(t *testing.T) {
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer target.Close()
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer other.Close()
+	/* answers from the target and from another port of the same host */
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := target.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			target.WriteTo(buf[:n], from)
+			other.WriteTo(buf[:n], from)
+		}
+	}()
+	port := target.LocalAddr().(*net.UDPAddr).Port
+
+	for filter, want := range map[string]int{UDPFilterFullCone: 2, UDPFilterAddress: 2, UDPFilterPort: 1} {
+		srv, _ := NewServer("test-psk", "", &ServerOptions{UDP: UDPOptions{Filter: filter}})
+		r, replies, _ := newTestRelay(t, srv)
+		r.forward("127.0.0.1", net.ParseIP("127.0.0.1"), port, []byte("ping"))
+		if n := countReplies(replies); n != want {
+			t.Errorf("%s: got %d replies, want %d", filter, n, want)
+		}
+	}
+}
+
+func TestUDPRelay_Idle(t *testing.T) {
+	srv, _ := NewServer("test-psk", "", &ServerOptions{
+		Dialer: &memDialer{},
+		UDP:    UDPOptions{Timeout: 50 * time.Millisecond},
+	})
+	_, _, idle := newTestRelay(t, srv)
+	select {
+	case <-idle:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle relay not closed")
+	}
+}
+
+func TestUDPOptions_Validate(t *testing.T) {
+	if (&UDPOptions{Filter: "symmetric"}).Validate() == nil {
+		t.Error("invalid filter accepted")
+	}
+}
+
+// textAddr is an address type of a custom dialer.
+type textAddr string
+
+func (a textAddr) Network() string { return "udp" }
+func (a textAddr) String() string  { return string(a) }
+
+// textPacketConn reports the sources of replies as textAddr.
+type textPacketConn struct {
+	*echoPacketConn
+	source string
+}
+
+func (c *textPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.echoPacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+	if c.source != "" {
+		return n, textAddr(c.source), nil
+	}
+	return n, textAddr(addr.String()), nil
+}
+
+type textDialer struct {
+	memDialer
+	source string
+}
+
+func (d *textDialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	return &textPacketConn{echoPacketConn: newEchoPacketConn(), source: d.source}, nil
+}
+
+func TestUDPRelay_AddressType(t *testing.T) {
+	for source, want := range map[string]int{"": 1, "relay.test:53": 0} {
+		srv, _ := NewServer("test-psk", "", &ServerOptions{Dialer: &textDialer{source: source}})
+		r, replies, _ := newTestRelay(t, srv)
+		r.forward("192.0.2.1", net.ParseIP("192.0.2.1"), 53, []byte("query"))
+		if n := countReplies(replies); n != want {
+			t.Errorf("source %q: got %d replies, want %d", source, n, want)
+		}
+	}
+}
+
+// slowResolver holds the lookups of slow.test until release is closed.
+type slowResolver struct {
+	release chan struct{}
+}
+
+func (r *slowResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if host == "slow.test" {
+		select {
+		case <-r.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return []net.IP{net.ParseIP("192.0.2.9")}, nil
+}
+
+func TestUDPRelay_RewriteExpiry(t *testing.T) {
+	srv, _ := NewServer("test-psk", "", &ServerOptions{
+		Dialer: &memDialer{},
+		UDP:    UDPOptions{Timeout: 50 * time.Millisecond},
+	})
+	r, _, _ := newTestRelay(t, srv)
+	orig := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	other := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 53}
+	dst := func(i int) *net.UDPAddr { return &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 1000 + i} }
+
+	for i := 0; i < 300; i++ {
+		r.mapRewrite(dst(i), orig)
+	}
+	if r.mapRewrite(dst(0), other) {
+		t.Error("address standing for a live target remapped")
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	/* expired mappings are forgotten and swept along with the NAT state */
+	if r.original(dst(0)) != nil {
+		t.Error("expired mapping still used for replies")
+	}
+	if !r.mapRewrite(dst(0), other) {
+		t.Error("expired address not remapped")
+	}
+	for i := 300; i < 600; i++ {
+		r.mapRewrite(dst(i), orig)
+	}
+	r.nat.Lock()
+	n := len(r.rewrites)
+	r.nat.Unlock()
+	if n >= 600 {
+		t.Errorf("%d mappings kept, expired ones not swept", n)
+	}
+}
@@ -0,0 +1,403 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+
+	p "github.com/icpz/open-snell/components/utils/pool"
+)
+
+// A CommandUDPMux session carries the UDP flows of a client, framed as:
+//
+//	flow id (4 bytes) | CommandUDPForward | UDP over TCP request or reply
+//	flow id (4 bytes) | CommandUDPClose
+//
+// The client picks the flow ids, a flow starts with its first packet and
+// gets its own relay on the server. Either side closes a flow with
+// CommandUDPClose, the server does once the flow is idle or failed.
+const (
+	udpFlowIDSize = 4
+	// maxUDPFlows bounds the open flows of a session, packets of further
+	// flows are answered by CommandUDPClose
+	maxUDPFlows = 1024
+	// udpFlowQueue is the number of packets a client flow buffers for
+	// its reader, further ones are dropped
+	udpFlowQueue = 64
+)
+
+func udpFlowHeader(id uint32, cmd byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, id), cmd)
+}
+
+// udpMuxFlow is a flow of a CommandUDPMux session on the server.
+type udpMuxFlow struct {
+	id    uint32
+	relay *udpRelay
+}
+
+// handleUDPMux serves the UDP flows multiplexed on a snell connection,
+// until the client closes it.
+func (s *Server) handleUDPMux(sess *session) {
+	conn := sess.conn
+	log.V(1).Infof("New UDP mux request from %s\n", conn.RemoteAddr().String())
+
+	var wmu sync.Mutex
+	write := func(b []byte) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		_, err := conn.Write(b)
+		return err
+	}
+	if err := write([]byte{ResponseReady}); err != nil {
+		log.Errorf("Failed to write ResponseReady: %v\n", err)
+		return
+	}
+
+	var mu sync.Mutex
+	flows := make(map[uint32]*udpMuxFlow)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, f := range flows {
+			f.relay.close()
+		}
+	}()
+	/* closeFlow ends f unless already done, notifying the client if asked */
+	closeFlow := func(f *udpMuxFlow, notify bool) {
+		mu.Lock()
+		if flows[f.id] != f {
+			mu.Unlock()
+			return
+		}
+		delete(flows, f.id)
+		mu.Unlock()
+		f.relay.close()
+		log.V(1).Infof("UDP flow %d of %s closed\n", f.id, conn.RemoteAddr().String())
+		if notify {
+			write(udpFlowHeader(f.id, CommandUDPClose))
+		}
+	}
+
+	buf := p.Get(p.RelayBufferSize)
+	defer p.Put(buf)
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				log.V(1).Infof("UDP mux read EOF, session ends\n")
+			} else {
+				log.Errorf("UDP mux read error: %v\n", err)
+			}
+			break
+		}
+		if n <= udpFlowIDSize {
+			log.Errorf("UDP mux insufficient chunk size: %d\n", n)
+			break
+		}
+
+		id := binary.BigEndian.Uint32(buf)
+		mu.Lock()
+		f := flows[id]
+		count := len(flows)
+		mu.Unlock()
+		if buf[udpFlowIDSize] == CommandUDPClose {
+			if f != nil {
+				closeFlow(f, false)
+			}
+			continue
+		}
+		host, ip, port, payload, err := parseUDPForward(buf[udpFlowIDSize:n])
+		if err != nil {
+			log.Errorf("UDP mux %v\n", err)
+			break
+		}
+
+		if f == nil {
+			if count >= maxUDPFlows {
+				log.Warningf("UDP mux of %s has %d flows, flow %d refused\n", conn.RemoteAddr().String(), count, id)
+				write(udpFlowHeader(id, CommandUDPClose))
+				continue
+			}
+			nf := &udpMuxFlow{id: id}
+			relay, err := s.newUDPRelay(sess, func(src *net.UDPAddr, b []byte) error {
+				return write(appendUDPReply(udpFlowHeader(id, CommandUDPForward), src, b))
+			}, func() { closeFlow(nf, true) })
+			if err != nil {
+				log.Errorf("UDP flow %d failed to listen: %v\n", id, err)
+				write(udpFlowHeader(id, CommandUDPClose))
+				continue
+			}
+			mu.Lock()
+			nf.relay = relay
+			flows[id] = nf
+			mu.Unlock()
+			f = nf
+			log.V(1).Infof("New UDP flow %d of %s\n", id, conn.RemoteAddr().String())
+		}
+		if err := f.relay.forward(host, ip, port, payload); err != nil {
+			log.Errorf("UDP flow %d failed to forward to %s: %v\n", id, net.JoinHostPort(host, strconv.Itoa(port)), err)
+			closeFlow(f, true)
+		}
+	}
+}
+
+// UDPMux is the client side of a CommandUDPMux session, carrying many UDP
+// flows over one snell connection.
+type UDPMux struct {
+	conn net.Conn
+	wmu  sync.Mutex
+
+	mu    sync.Mutex
+	flows map[uint32]*udpFlow
+	next  uint32
+	// err is set once the connection is done
+	err error
+}
+
+// ListenPacketMux sets up a multiplexed UDP session, whose flows are
+// opened by ListenPacket of the returned UDPMux.
+func (u *Upstream) ListenPacketMux(ctx context.Context) (*UDPMux, error) {
+	c, err := u.requestUDP(ctx, CommandUDPMux, nil)
+	if err != nil {
+		return nil, err
+	}
+	m := &UDPMux{conn: c, flows: make(map[uint32]*udpFlow)}
+	go m.read()
+	return m, nil
+}
+
+// ListenPacket opens a new flow of the session, which has its own socket
+// on the server.
+func (m *UDPMux) ListenPacket() (net.PacketConn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.next++
+	f := &udpFlow{
+		mux:     m,
+		id:      m.next,
+		ch:      make(chan udpFlowPacket, udpFlowQueue),
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	m.flows[f.id] = f
+	return f, nil
+}
+
+// Close closes the connection along with every flow.
+func (m *UDPMux) Close() error {
+	return m.conn.Close()
+}
+
+// closed reports whether the connection is done.
+func (m *UDPMux) closed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err != nil
+}
+
+func (m *UDPMux) write(b []byte) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	_, err := m.conn.Write(b)
+	return err
+}
+
+// remove unregisters f, false if it was not open.
+func (m *UDPMux) remove(f *udpFlow) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.flows[f.id] != f {
+		return false
+	}
+	delete(m.flows, f.id)
+	return true
+}
+
+func (m *UDPMux) read() {
+	buf := p.Get(p.RelayBufferSize)
+	defer p.Put(buf)
+	var err error
+	for {
+		var n int
+		if n, err = m.conn.Read(buf); err != nil {
+			break
+		}
+		if n <= udpFlowIDSize {
+			continue
+		}
+		m.mu.Lock()
+		f := m.flows[binary.BigEndian.Uint32(buf)]
+		m.mu.Unlock()
+		if f == nil {
+			continue
+		}
+		switch buf[udpFlowIDSize] {
+		case CommandUDPClose:
+			/* closed by the server */
+			if m.remove(f) {
+				f.shutdown(io.EOF)
+			}
+		case CommandUDPForward:
+			if addr, payload, ok := parseUDPReply(buf[udpFlowIDSize+1 : n]); ok {
+				f.deliver(addr, payload)
+			}
+		}
+	}
+
+	m.conn.Close()
+	m.mu.Lock()
+	m.err = err
+	flows := m.flows
+	m.flows = nil
+	m.mu.Unlock()
+	for _, f := range flows {
+		f.shutdown(err)
+	}
+}
+
+type udpFlowPacket struct {
+	b    []byte
+	addr net.Addr
+}
+
+// udpFlow is a flow of a UDPMux, it implements net.PacketConn.
+type udpFlow struct {
+	mux  *UDPMux
+	id   uint32
+	ch   chan udpFlowPacket
+	done chan struct{}
+	once sync.Once
+	err  error
+
+	dmu      sync.Mutex
+	deadline time.Time
+	// changed is closed and replaced when the read deadline changes
+	changed chan struct{}
+}
+
+// shutdown ends the flow, reads return err then.
+func (f *udpFlow) shutdown(err error) {
+	f.once.Do(func() {
+		f.err = err
+		close(f.done)
+	})
+}
+
+func (f *udpFlow) deliver(addr net.Addr, b []byte) {
+	select {
+	case f.ch <- udpFlowPacket{append([]byte(nil), b...), addr}:
+	default:
+		log.V(1).Infof("UDP flow %d queue full, packet from %s dropped\n", f.id, addr.String())
+	}
+}
+
+func (f *udpFlow) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		pkt, err := f.wait()
+		if err == errDeadlineChanged {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		return copy(b, pkt.b), pkt.addr, nil
+	}
+}
+
+var errDeadlineChanged = errors.New("read deadline changed")
+
+// wait returns the next packet, or errDeadlineChanged if the read deadline
+// changed meanwhile.
+func (f *udpFlow) wait() (udpFlowPacket, error) {
+	f.dmu.Lock()
+	deadline, changed := f.deadline, f.changed
+	f.dmu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return udpFlowPacket{}, os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case pkt := <-f.ch:
+		return pkt, nil
+	case <-f.done:
+		return udpFlowPacket{}, f.err
+	case <-timeout:
+		return udpFlowPacket{}, os.ErrDeadlineExceeded
+	case <-changed:
+		return udpFlowPacket{}, errDeadlineChanged
+	}
+}
+
+func (f *udpFlow) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-f.done:
+		return 0, f.err
+	default:
+	}
+	pkt, err := appendUDPForward(udpFlowHeader(f.id, 0)[:udpFlowIDSize], addr, b)
+	if err != nil {
+		return 0, err
+	}
+	if err := f.mux.write(pkt); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close tears down the flow, leaving the other flows open.
+func (f *udpFlow) Close() error {
+	if f.mux.remove(f) {
+		f.mux.write(udpFlowHeader(f.id, CommandUDPClose))
+	}
+	f.shutdown(net.ErrClosed)
+	return nil
+}
+
+func (f *udpFlow) LocalAddr() net.Addr { return f.mux.conn.LocalAddr() }
+
+func (f *udpFlow) SetDeadline(t time.Time) error { return f.SetReadDeadline(t) }
+
+func (f *udpFlow) SetReadDeadline(t time.Time) error {
+	f.dmu.Lock()
+	defer f.dmu.Unlock()
+	f.deadline = t
+	close(f.changed)
+	f.changed = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline is a no-op, writes do not block on the flow.
+func (f *udpFlow) SetWriteDeadline(t time.Time) error { return nil }
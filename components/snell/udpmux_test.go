@@ -0,0 +1,130 @@
+package snell
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startUDPRecorder echoes packets like startUDPEchoServer, counting their
+// distinct sources.
+func startUDPRecorder(t *testing.T) (net.PacketConn, func() int) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen UDP: %v", err)
+	}
+	var mu sync.Mutex
+	sources := make(map[string]bool)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			sources[addr.String()] = true
+			mu.Unlock()
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	return echo, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sources)
+	}
+}
+
+func TestUDPMux_Flows(t *testing.T) {
+	echo, sources := startUDPRecorder(t)
+	defer echo.Close()
+	srv, err := NewSnellServerWithOptions("127.0.0.1:0", "test-psk", "", &ServerOptions{UDP: UDPOptions{Timeout: 200 * time.Millisecond}})
+	if err != nil {
+		t.Fatalf("Failed to start snell server: %v", err)
+	}
+	defer srv.Close()
+
+	u, _ := NewUpstream(srv.Addr().String(), "", "", "test-psk", "", true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m, err := u.ListenPacketMux(ctx)
+	if err != nil {
+		t.Fatalf("ListenPacketMux failed: %v", err)
+	}
+	defer m.Close()
+
+	a, _ := m.ListenPacket()
+	b, _ := m.ListenPacket()
+	roundTrip(t, a, echo.LocalAddr(), []byte("flow a"))
+	roundTrip(t, b, echo.LocalAddr(), []byte("flow b"))
+	roundTrip(t, a, echo.LocalAddr(), []byte("flow a again"))
+	if n := sources(); n != 2 {
+		t.Errorf("expected a server socket per flow, got %d sources", n)
+	}
+
+	/* closing a flow leaves the others open */
+	a.Close()
+	if _, err := a.WriteTo([]byte("closed"), echo.LocalAddr()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected net.ErrClosed writing a closed flow, got %v", err)
+	}
+	roundTrip(t, b, echo.LocalAddr(), []byte("flow b after a closed"))
+
+	/* the server tears down idle flows */
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := b.ReadFrom(make([]byte, 2048)); err != io.EOF {
+		t.Errorf("expected io.EOF once idle, got %v", err)
+	}
+	c, err := m.ListenPacket()
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	roundTrip(t, c, echo.LocalAddr(), []byte("flow c"))
+}
+
+func TestUpstream_Mux(t *testing.T) {
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+	srv, err := NewServer("test-psk", "", nil)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	u, _ := NewUpstream("snell.test:443", "", "", "test-psk", "", true)
+	u.Mux = true
+	dialer := &memDialer{serve: func(address string, c net.Conn) {
+		srv.ServeConn(context.Background(), c)
+	}}
+	u.Dialer = dialer
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		pc, err := u.ListenPacket(ctx)
+		if err != nil {
+			t.Fatalf("ListenPacket failed: %v", err)
+		}
+		defer pc.Close()
+		roundTrip(t, pc, echo.LocalAddr(), []byte("ping over mux"))
+	}
+	dialer.mu.Lock()
+	dials := len(dialer.dials)
+	dialer.mu.Unlock()
+	if dials != 1 {
+		t.Errorf("expected the sessions to share a connection, got %d dials", dials)
+	}
+
+	/* a broken session is set up again */
+	u.mux.Close()
+	for !u.mux.closed() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	pc, err := u.ListenPacket(ctx)
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer pc.Close()
+	roundTrip(t, pc, echo.LocalAddr(), []byte("ping over a new mux"))
+}
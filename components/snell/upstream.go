@@ -0,0 +1,331 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/icpz/open-snell/components/aead"
+	"github.com/icpz/open-snell/components/outbound"
+	obfs "github.com/icpz/open-snell/components/simple-obfs"
+)
+
+// Upstream chains egress traffic through another snell server, it
+// implements outbound.Outbound.
+type Upstream struct {
+	server   string
+	obfs     string
+	obfsHost string
+	clientID string
+	cipher   aead.Cipher
+	// Password proves the upstream to be the user of its client id, see
+	// ClientOptions.Password
+	Password string
+	// Dialer, if set, connects to the server
+	Dialer outbound.Dialer
+	// Datagram carries UDP sessions in datagrams to the server UDP port,
+	// UDP over TCP is used if the server does not allow them.
+	Datagram bool
+	// Mux carries UDP over TCP sessions as flows of one shared snell
+	// connection, which is set up again once broken.
+	Mux bool
+
+	mu  sync.Mutex
+	mux *UDPMux
+}
+
+func NewUpstream(server, obfsType, obfsHost, psk, clientID string, isV2 bool) (*Upstream, error) {
+	if obfsType != "tls" && obfsType != "http" && obfsType != "" {
+		return nil, fmt.Errorf("invalid snell obfs type %s", obfsType)
+	}
+	if obfsHost == "" {
+		obfsHost = "www.bing.com"
+	}
+
+	u := &Upstream{
+		server:   server,
+		obfs:     obfsType,
+		obfsHost: obfsHost,
+		clientID: clientID,
+	}
+	if isV2 {
+		u.cipher = aead.NewAES128GCM([]byte(psk))
+	} else {
+		u.cipher = aead.NewChacha20Poly1305([]byte(psk))
+	}
+	return u, nil
+}
+
+func (u *Upstream) dial(ctx context.Context) (net.Conn, error) {
+	var c net.Conn
+	var err error
+	if u.Dialer != nil {
+		dctx, cancel := context.WithTimeout(ctx, dialTimeout)
+		c, err = u.Dialer.DialContext(dctx, "tcp", u.server)
+		cancel()
+	} else {
+		d := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+		c, err = d.DialContext(ctx, "tcp", u.server)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, port, _ := net.SplitHostPort(u.server)
+	c, _ = obfs.NewObfsClient(c, u.obfsHost, port, u.obfs)
+	return aead.NewConn(c, u.cipher), nil
+}
+
+// DialContext opens a one-shot tunnel, CommandConnect is used so the
+// remote closes the session once the relay is done. The server reply is
+// awaited within the deadline of ctx, so that dial errors are returned.
+func (u *Upstream) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	iport, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := u.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id, err := credential(c, u.clientID, u.Password)
+	if err == nil {
+		err = writeHeader(c, id, host, uint(iport), false, nil)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	sess := &clientSession{Conn: c}
+	/* only ctx interrupts the read, so that its error is the one returned */
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(time.Unix(1, 0)) })
+	err = sess.readResponse()
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return sess, nil
+}
+
+func (u *Upstream) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if u.Datagram {
+		pc, err := u.listenDatagram(ctx)
+		var appErr *AppError
+		if err == nil || !errors.As(err, &appErr) || appErr.Code() != ErrorDenied {
+			return pc, err
+		}
+		log.V(1).Infof("UDP datagrams refused by %s, using UDP over TCP: %v\n", u.server, err)
+	}
+	if u.Mux {
+		return u.listenMux(ctx)
+	}
+	c, err := u.requestUDP(ctx, CommandUDP, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &udpSession{Conn: c}, nil
+}
+
+// listenMux opens a flow of the shared UDP mux session.
+func (u *Upstream) listenMux(ctx context.Context) (net.PacketConn, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.mux == nil || u.mux.closed() {
+		m, err := u.ListenPacketMux(ctx)
+		if err != nil {
+			return nil, err
+		}
+		u.mux = m
+	}
+	return u.mux.ListenPacket()
+}
+
+// listenDatagram sets up a native UDP session, see handleUDPDatagram.
+func (u *Upstream) listenDatagram(ctx context.Context) (net.PacketConn, error) {
+	reply := make([]byte, datagramIDSize+datagramSecretSize)
+	c, err := u.requestUDP(ctx, CommandUDPDatagram, reply)
+	if err != nil {
+		return nil, err
+	}
+	var pc net.Conn
+	if u.Dialer != nil {
+		dctx, cancel := context.WithTimeout(ctx, dialTimeout)
+		pc, err = u.Dialer.DialContext(dctx, "udp", u.server)
+		cancel()
+	} else {
+		pc, err = (&net.Dialer{}).DialContext(ctx, "udp", u.server)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	secret := reply[datagramIDSize:]
+	return newDatagramConn(pc, c, reply[:datagramIDSize], aead.Resumed(u.cipher, secret)), nil
+}
+
+// requestUDP sends a UDP request of cmd on a new connection, and reads the
+// reply followed by len(extra) bytes into extra.
+func (u *Upstream) requestUDP(ctx context.Context, cmd byte, extra []byte) (net.Conn, error) {
+	c, err := u.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	id, err := credential(c, u.clientID, u.Password)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	buf := bytes.NewBuffer([]byte{Version, cmd, byte(len(id))})
+	buf.WriteString(id)
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := readReply(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if _, err := io.ReadFull(c, extra); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// readReply reads a success reply, or returns the error reported by the
+// server.
+func readReply(c net.Conn) error {
+	var b [1]byte
+	if _, err := io.ReadFull(c, b[:]); err != nil {
+		return err
+	}
+	switch b[0] {
+	case ResponseReady:
+		return nil
+	case ResponseError:
+		// error code, message length and message
+		var hdr [2]byte
+		if _, err := io.ReadFull(c, hdr[:]); err != nil {
+			return err
+		}
+		msg := make([]byte, hdr[1])
+		if _, err := io.ReadFull(c, msg); err != nil {
+			return err
+		}
+		return NewAppError(hdr[0], string(msg))
+	default:
+		return errors.New("Command not support")
+	}
+}
+
+// udpSession is the client side of a UDP over TCP snell session.
+type udpSession struct {
+	net.Conn
+}
+
+func (s *udpSession) WriteTo(b []byte, addr net.Addr) (int, error) {
+	pkt, err := appendUDPForward(nil, addr, b)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.Conn.Write(pkt); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (s *udpSession) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, err := s.Conn.Read(b)
+		if err != nil {
+			return 0, nil, err
+		}
+		addr, payload, ok := parseUDPReply(b[:n])
+		if !ok {
+			continue
+		}
+		return copy(b, payload), addr, nil
+	}
+}
+
+// appendUDPForward appends to dst the CommandUDPForward request sending b
+// to addr.
+func appendUDPForward(dst []byte, addr net.Addr, b []byte) ([]byte, error) {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	iport, _ := strconv.Atoi(port)
+
+	dst = append(dst, CommandUDPForward)
+	if ip := net.ParseIP(host); ip != nil {
+		dst = append(dst, 0)
+		if ip4 := ip.To4(); ip4 != nil {
+			dst = append(append(dst, 4), ip4...)
+		} else {
+			dst = append(append(dst, 6), ip.To16()...)
+		}
+	} else {
+		dst = append(append(dst, byte(len(host))), host...)
+	}
+	dst = append(dst, byte(iport>>8), byte(iport))
+	return append(dst, b...), nil
+}
+
+// parseUDPReply splits a packet sent back by the server into its source
+// and payload.
+func parseUDPReply(b []byte) (*net.UDPAddr, []byte, bool) {
+	iplen := 0
+	switch {
+	case len(b) > 0 && b[0] == 4:
+		iplen = net.IPv4len
+	case len(b) > 0 && b[0] == 6:
+		iplen = net.IPv6len
+	default:
+		return nil, nil, false
+	}
+	head := 1 + iplen + 2
+	if len(b) < head {
+		return nil, nil, false
+	}
+	addr := &net.UDPAddr{
+		IP:   net.IP(append([]byte{}, b[1:1+iplen]...)),
+		Port: (int(b[1+iplen]) << 8) | int(b[2+iplen]),
+	}
+	return addr, b[head:], true
+}
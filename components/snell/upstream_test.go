@@ -0,0 +1,214 @@
+package snell
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/icpz/open-snell/components/dns"
+)
+
+func startEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func startSnellServer(t *testing.T, psk string) *SnellServer {
+	s, err := NewSnellServer("127.0.0.1:0", psk, "")
+	if err != nil {
+		t.Fatalf("Failed to start snell server: %v", err)
+	}
+	return s
+}
+
+func TestUpstream_DialContext(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	srv := startSnellServer(t, "test-psk")
+	defer srv.Close()
+
+	u, err := NewUpstream(srv.listener.Addr().String(), "", "", "test-psk", "", true)
+	if err != nil {
+		t.Fatalf("NewUpstream failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := u.DialContext(ctx, echo.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	defer c.Close()
+
+	msg := []byte("hello through upstream")
+	if _, err := c.Write(msg); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	buf := make([]byte, len(msg))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Errorf("expected %q, got %q", msg, buf)
+	}
+}
+
+func TestUpstream_DialContextErrors(t *testing.T) {
+	srv := startSnellServer(t, "test-psk")
+	defer srv.Close()
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+
+	/* the dial error is reported by DialContext itself */
+	u, _ := NewUpstream(srv.listener.Addr().String(), "", "", "test-psk", "", true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var appErr *AppError
+	if _, err := u.DialContext(ctx, closed.Addr().String()); !errors.As(err, &appErr) || appErr.Code() != ErrorRefused {
+		t.Errorf("DialContext to a closed port = %v, want refused", err)
+	}
+
+	/* a server which never replies is bounded by the context */
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer silent.Close()
+	go func() {
+		c, err := silent.Accept()
+		if err == nil {
+			defer c.Close()
+			io.Copy(io.Discard, c)
+		}
+	}()
+	u, _ = NewUpstream(silent.Addr().String(), "", "", "test-psk", "", true)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := u.DialContext(ctx, closed.Addr().String()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DialContext to a silent server = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestUpstream_ListenPacket(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen UDP: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	srv := startSnellServer(t, "test-psk")
+	defer srv.Close()
+
+	u, _ := NewUpstream(srv.listener.Addr().String(), "", "", "test-psk", "", true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pc, err := u.ListenPacket(ctx)
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer pc.Close()
+
+	msg := []byte("ping over udp")
+	if _, err := pc.WriteTo(msg, echo.LocalAddr()); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		t.Errorf("expected %q, got %q", msg, buf[:n])
+	}
+	if from.String() != echo.LocalAddr().String() {
+		t.Errorf("expected reply from %s, got %s", echo.LocalAddr(), from)
+	}
+}
+
+func TestUpstream_Resolve(t *testing.T) {
+	resolver, err := dns.New(dns.Options{Hosts: map[string][]net.IP{
+		"svc.test": {net.ParseIP("192.0.2.10"), net.ParseIP("2001:db8::10")},
+	}})
+	if err != nil {
+		t.Fatalf("dns.New failed: %v", err)
+	}
+	srv, u := startSnellServerWithOptions(t, &ServerOptions{Resolver: resolver})
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for qtype, want := range map[uint16]string{dns.TypeA: "192.0.2.10", dns.TypeAAAA: "2001:db8::10"} {
+		records, err := u.Resolve(ctx, "svc.test", qtype)
+		if err != nil {
+			t.Fatalf("Resolve type %d failed: %v", qtype, err)
+		}
+		if len(records) != 1 || records[0].IP.String() != want || records[0].TTL == 0 {
+			t.Errorf("Resolve type %d = %v, want %s", qtype, records, want)
+		}
+	}
+
+	if _, err := u.Resolve(ctx, "svc.test", 16); err == nil {
+		t.Errorf("Resolve of an unsupported type succeeded")
+	}
+}
+
+func TestClient_Speedtest(t *testing.T) {
+	srv, _ := startSnellServerWithOptions(t, &ServerOptions{Speedtest: true})
+	defer srv.Close()
+
+	c, err := NewSnellClientWithOptions("", srv.listener.Addr().String(), "", "", "test-psk", true, nil)
+	if err != nil {
+		t.Fatalf("NewSnellClientWithOptions failed: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := c.Speedtest(ctx, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Speedtest failed: %v", err)
+	}
+	if res.RTT <= 0 || res.Upload <= 0 || res.Download <= 0 {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	disabled, _ := startSnellServerWithOptions(t, &ServerOptions{})
+	defer disabled.Close()
+	c2, _ := NewSnellClientWithOptions("", disabled.listener.Addr().String(), "", "", "test-psk", true, nil)
+	defer c2.Close()
+	if _, err := c2.Speedtest(ctx, 200*time.Millisecond); err == nil {
+		t.Errorf("Speedtest succeeded on a disabled server")
+	}
+}
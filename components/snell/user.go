@@ -0,0 +1,403 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/icpz/open-snell/components/aead"
+	"github.com/icpz/open-snell/components/outbound"
+	"github.com/icpz/open-snell/components/rules"
+	"github.com/icpz/open-snell/components/sniff"
+	"github.com/icpz/open-snell/components/utils"
+)
+
+const (
+	// dialTimeout is the default timeout of one connection attempt
+	dialTimeout = 5 * time.Second
+	// connectTimeout bounds resolving and connecting to a target
+	connectTimeout = 30 * time.Second
+)
+
+var errRejected = errors.New("rejected by rule")
+
+// User holds per-user overrides of the listener options. Users are
+// identified by the client id sent in the snell handshake, which any
+// client knowing the PSK may claim unless the user has a Password.
+type User struct {
+	Name     string
+	Bind     *outbound.BindOptions
+	Upstream outbound.Outbound
+	Resolver outbound.Resolver
+	// Capabilities, if set, replaces the listener capabilities, they can
+	// only narrow them for users without a Password
+	Capabilities *Capability
+	// Password, if set, authenticates the user on the Shadowsocks, SOCKS5
+	// and HTTP inbounds, and snell clients must prove to know it
+	Password string
+	// ReversePorts lists the ports the user may expose as reverse
+	// tunnels, none if empty.
+	ReversePorts []PortRange
+}
+
+// ShadowsocksOptions configures the Shadowsocks AEAD inbound of a server.
+// Clients authenticate with Password or the password of a User, an empty
+// Password admits users only.
+type ShadowsocksOptions struct {
+	// Listen is the TCP and UDP address used by SnellServer
+	Listen   string
+	Method   string
+	Password string
+}
+
+// ServerOptions holds per-listener settings of a snell server.
+type ServerOptions struct {
+	Bind outbound.BindOptions
+	// Upstream, if set, carries the egress traffic instead of dialing
+	// targets directly.
+	Upstream outbound.Outbound
+	// Resolver resolves targets on both TCP and UDP paths, a caching
+	// system resolver is used if nil.
+	Resolver outbound.Resolver
+	// Strategy selects and orders the resolved addresses of targets,
+	// DialTimeout bounds each connection attempt.
+	Strategy    outbound.DialStrategy
+	DialTimeout time.Duration
+	// FastOpenQueue is the TCP Fast Open queue length of the listener,
+	// 0 disables it. FastOpen enables TCP Fast Open on direct dials when
+	// the client has already sent data along with the handshake.
+	FastOpenQueue int
+	FastOpen      bool
+	// MultipathTCP enables MPTCP on the listener, MultipathTCPOutbound
+	// on direct dials. Both fall back to plain TCP when unsupported.
+	MultipathTCP         bool
+	MultipathTCPOutbound bool
+	// ClientTCP tunes accepted client connections, TargetTCP the direct
+	// connections to targets.
+	ClientTCP utils.TCPOptions
+	TargetTCP utils.TCPOptions
+	Users     []*User
+	// Router, if set, selects the egress of each TCP connection and UDP
+	// packet, its actions name entries of Upstreams.
+	Router    *rules.Router
+	Upstreams map[string]outbound.Outbound
+	// Rewriter, if set, maps targets to other destinations before they
+	// are routed and dialed.
+	Rewriter *rules.Rewriter
+	// Sniff detects the protocol and domain of the first client payload,
+	// waiting up to SniffTimeout for it. SniffOverride dials the sniffed
+	// domain instead of IP literal targets.
+	Sniff         bool
+	SniffTimeout  time.Duration
+	SniffOverride bool
+	// Speedtest allows clients to measure the throughput to the server
+	Speedtest bool
+	// TicketLifetime enables session resumption, clients reconnecting
+	// with a ticket skip the Argon2 key derivation. Tickets expire and
+	// ticket keys rotate after this duration.
+	TicketLifetime time.Duration
+	// Hooks, if set, is called along the lifecycle of sessions
+	Hooks Hooks
+	// Dialer, if set, makes the direct egress connections instead of the
+	// host network stack, bind and socket options do not apply then.
+	Dialer outbound.Dialer
+	// Capabilities restricts the protocol versions and commands accepted
+	// from clients, 0 allows everything.
+	Capabilities Capability
+	// Shadowsocks, if set, enables the Shadowsocks inbound, served by
+	// ServeShadowsocks and ServeShadowsocksPacket.
+	Shadowsocks *ShadowsocksOptions
+	// SocksListen and HTTPListen, if set, are the addresses of the plain
+	// SOCKS5 and HTTP CONNECT inbounds of SnellServer. Their clients
+	// authenticate with the name and password of a User.
+	SocksListen string
+	HTTPListen  string
+	// ReverseAddress is the IP address reverse tunnels listen on,
+	// DefaultReverseAddress if empty.
+	ReverseAddress string
+	// UDP sets the NAT behaviour and limits of UDP sessions
+	UDP UDPOptions
+	// Datagram allows clients to carry UDP sessions in datagrams, served
+	// by ServeDatagram, on the listener port by SnellServer.
+	Datagram bool
+}
+
+func (o *ServerOptions) Validate() error {
+	if err := o.Bind.Validate(); err != nil {
+		return err
+	}
+	if err := o.Strategy.Validate(); err != nil {
+		return err
+	}
+	if err := o.UDP.Validate(); err != nil {
+		return err
+	}
+	for _, u := range o.Users {
+		if err := u.Bind.Validate(); err != nil {
+			return err
+		}
+	}
+	if o.Shadowsocks != nil {
+		if _, err := aead.NewShadowsocks(o.Shadowsocks.Method, ""); err != nil {
+			return err
+		}
+		if o.Shadowsocks.Password == "" && !o.hasPasswords() {
+			return errors.New("shadowsocks inbound without any password")
+		}
+	}
+	if (o.SocksListen != "" || o.HTTPListen != "") && !o.hasPasswords() {
+		return errors.New("SOCKS5 or HTTP inbound without any user password")
+	}
+	return nil
+}
+
+func (o *ServerOptions) hasPasswords() bool {
+	for _, u := range o.Users {
+		if u.Password != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// session carries the per-connection state derived from the handshake.
+type session struct {
+	// ctx is done once the server stops serving the connection
+	ctx  context.Context
+	conn net.Conn
+	user *User
+	// early holds client payload received along with the handshake
+	early []byte
+	// req is the current request, as seen by Hooks
+	req *Request
+	// sniffed is learned from the TCP payload, or the current packet of
+	// a UDP session
+	sniffed sniff.Result
+}
+
+func (s *session) bind(srv *Server) *outbound.BindOptions {
+	if s.user != nil && s.user.Bind != nil {
+		return s.user.Bind
+	}
+	return &srv.opts.Bind
+}
+
+// outbound returns the egress for the session, user settings take
+// precedence over the listener ones. An empty *outbound.Direct selects
+// direct dialing with the session bind options, so that a user can opt
+// out of a listener-wide upstream.
+func (s *session) outbound(srv *Server) outbound.Outbound {
+	ob := srv.opts.Upstream
+	if s.user != nil && s.user.Upstream != nil {
+		ob = s.user.Upstream
+	}
+	return s.withDefaults(srv, ob)
+}
+
+// withDefaults replaces a nil or empty *outbound.Direct with a direct
+// dialer configured for the session.
+func (s *session) withDefaults(srv *Server, ob outbound.Outbound) outbound.Outbound {
+	if d, ok := ob.(*outbound.Direct); ob == nil || (ok && d.Bind == nil) {
+		timeout := srv.opts.DialTimeout
+		if timeout <= 0 {
+			timeout = dialTimeout
+		}
+		d := &outbound.Direct{
+			Bind:     s.bind(srv),
+			Key:      s.bindKey(),
+			Timeout:  timeout,
+			Resolver: s.resolver(srv),
+			Strategy: &srv.opts.Strategy,
+
+			MultipathTCP: srv.opts.MultipathTCPOutbound,
+			TCP:          &srv.opts.TargetTCP,
+			Dialer:       srv.opts.Dialer,
+		}
+		if srv.opts.FastOpen {
+			d.Early, d.FastOpen = s.early, true
+		}
+		return d
+	}
+	return ob
+}
+
+// route matches the target against the server rules, returns the matched
+// action along with the egress, which is nil if rejected.
+func (s *session) route(srv *Server, network, host string, port uint16) (string, outbound.Outbound) {
+	if srv.opts.Router == nil {
+		return "", s.outbound(srv)
+	}
+	action := srv.opts.Router.Match(s.metadata(srv, network, host, port))
+	switch action {
+	case "":
+		return action, s.outbound(srv)
+	case rules.ActionReject:
+		return action, nil
+	case rules.ActionDirect:
+		return action, s.withDefaults(srv, nil)
+	}
+	ob, ok := srv.opts.Upstreams[action]
+	if !ok {
+		log.Warningf("Rule action %s for %s:%d is not an upstream, rejected\n", action, host, port)
+		return rules.ActionReject, nil
+	}
+	log.V(1).Infof("Routing %s %s via %s\n", network, net.JoinHostPort(host, strconv.Itoa(int(port))), action)
+	return action, s.withDefaults(srv, ob)
+}
+
+// rewrite maps the target according to the server rewrite rules.
+func (s *session) rewrite(srv *Server, network, host string, port uint16) (string, uint16) {
+	if srv.opts.Rewriter == nil {
+		return host, port
+	}
+	newHost, newPort, ok := srv.opts.Rewriter.Rewrite(s.metadata(srv, network, host, port))
+	if ok {
+		log.V(1).Infof("Rewriting %s %s to %s\n", network,
+			net.JoinHostPort(host, strconv.Itoa(int(port))), net.JoinHostPort(newHost, strconv.Itoa(int(newPort))))
+	}
+	return newHost, newPort
+}
+
+func (s *session) metadata(srv *Server, network, host string, port uint16) *rules.Metadata {
+	meta := &rules.Metadata{
+		Network: network,
+		Host:    host,
+		Port:    port,
+		Resolve: func() net.IP {
+			ctx, cancel := context.WithTimeout(s.ctx, dialTimeout)
+			defer cancel()
+			ips, err := s.resolver(srv).LookupIP(ctx, srv.opts.Strategy.LookupNetwork(), host)
+			if ips = srv.opts.Strategy.Order(ips); err != nil || len(ips) == 0 {
+				return nil
+			}
+			return ips[0]
+		},
+	}
+	if s.user != nil {
+		meta.User = s.user.Name
+	}
+	meta.Protocol, meta.Domain = s.sniffed.Protocol, s.sniffed.Domain
+	return meta
+}
+
+func (s *session) resolver(srv *Server) outbound.Resolver {
+	if s.user != nil && s.user.Resolver != nil {
+		return s.user.Resolver
+	}
+	return srv.opts.Resolver
+}
+
+// bindKey is the key used to derive hashed source addresses, falls back
+// to the client address for anonymous sessions.
+func (s *session) bindKey() string {
+	if s.user != nil {
+		return s.user.Name
+	}
+	/* Shadowsocks UDP associations have no connection */
+	addr := s.req.RemoteAddr
+	if s.conn != nil {
+		addr = s.conn.RemoteAddr()
+	}
+	host, _, _ := net.SplitHostPort(addr.String())
+	return host
+}
+
+// readEarlyData takes the payload already decrypted along with the
+// handshake, without blocking on the connection.
+func (s *session) readEarlyData() error {
+	b, ok := s.conn.(interface{ Buffered() int })
+	if !ok || b.Buffered() == 0 {
+		return nil
+	}
+	s.early = make([]byte, b.Buffered())
+	_, err := io.ReadFull(s.conn, s.early)
+	return err
+}
+
+func (s *Server) lookupUser(id string) *User {
+	if id == "" {
+		return nil
+	}
+	return s.users[id]
+}
+
+// authenticated reports whether the client proved to be the session user,
+// every path admitting a user with a password checked it.
+func (s *session) authenticated() bool {
+	return s.user != nil && s.user.Password != ""
+}
+
+const (
+	// proofSize is the length of the password proof following a client id
+	proofSize = 16
+	// maxClientIDSize leaves room for the separator and the proof
+	maxClientIDSize = 255 - 1 - proofSize
+)
+
+var errAuthFailed = fmt.Errorf("%w: authentication failed", ErrDenied)
+
+// passwordProof binds the knowledge of password to a connection with an
+// HMAC over salt, which starts its client stream.
+func passwordProof(salt []byte, id, password string) []byte {
+	h := hmac.New(sha256.New, []byte(password))
+	h.Write([]byte("snell client id"))
+	h.Write(salt)
+	h.Write([]byte(id))
+	return h.Sum(nil)[:proofSize]
+}
+
+// credential returns the client id to send in requests on c, followed by
+// a NUL and the password proof if password is set.
+func credential(c net.Conn, id, password string) (string, error) {
+	if password == "" {
+		return id, nil
+	}
+	sc, ok := c.(interface{ Salt() ([]byte, error) })
+	if !ok {
+		return "", errors.New("connection can not carry a password proof")
+	}
+	salt, err := sc.Salt()
+	if err != nil {
+		return "", err
+	}
+	return id + "\x00" + string(passwordProof(salt, id, password)), nil
+}
+
+// authenticate looks up the user named by the client id sent on c. A user
+// with a password is only returned along with a valid proof, otherwise
+// errAuthFailed is.
+func (s *Server) authenticate(c net.Conn, id string) (string, *User, error) {
+	id, proof, _ := strings.Cut(id, "\x00")
+	user := s.lookupUser(id)
+	if user == nil || user.Password == "" {
+		return id, user, nil
+	}
+	sc, ok := c.(interface{ PeerSalt() []byte })
+	if !ok || sc.PeerSalt() == nil || !hmac.Equal([]byte(proof), passwordProof(sc.PeerSalt(), id, user.Password)) {
+		return id, nil, errAuthFailed
+	}
+	return id, user, nil
+}
@@ -0,0 +1,35 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sniff
+
+import "bytes"
+
+var bittorrentHandshake = []byte("\x13BitTorrent protocol")
+
+// BitTorrent reports whether b starts with a peer wire handshake.
+func BitTorrent(b []byte) bool {
+	return bytes.HasPrefix(b, bittorrentHandshake)
+}
+
+// BitTorrentPacket reports whether b is a DHT message or a uTP connection
+// request, blocking the latter is enough to prevent uTP transfers.
+func BitTorrentPacket(b []byte) bool {
+	// DHT messages are bencoded dictionaries with a "y" key
+	if bytes.HasPrefix(b, []byte("d1:")) && bytes.HasSuffix(b, []byte("e")) && bytes.Contains(b, []byte("1:y1:")) {
+		return true
+	}
+	// uTP (BEP 29) ST_SYN of version 1, a bare 20 bytes header
+	return len(b) == 20 && b[0] == 0x41 && b[1] == 0
+}
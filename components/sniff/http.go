@@ -0,0 +1,58 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sniff
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+var httpMethods = []string{
+	"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE ",
+}
+
+// HTTP returns the Host header of an HTTP/1.x request, ok is true if b
+// starts with a request line.
+func HTTP(b []byte) (string, bool) {
+	isRequest := false
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(b, []byte(m)) {
+			isRequest = true
+			break
+		}
+	}
+	if !isRequest {
+		return "", false
+	}
+
+	lines := bytes.Split(b, []byte("\r\n"))
+	// the last line may be truncated
+	for _, line := range lines[1 : len(lines)-1] {
+		if len(line) == 0 {
+			break
+		}
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok || !strings.EqualFold(string(name), "host") {
+			continue
+		}
+		host := strings.TrimSpace(string(value))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.ToLower(host), true
+	}
+	return "", true
+}
@@ -0,0 +1,186 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sniff
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+)
+
+const quicVersion1 = 0x00000001
+
+// initial salt of QUIC version 1, RFC 9001 section 5.2
+var quicInitialSalt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+// QUIC returns the SNI of a client Initial packet of QUIC version 1, ok is
+// true if the packet could be decrypted. The SNI is only found if it is
+// carried by this datagram, ClientHellos spanning several packets may miss.
+func QUIC(b []byte) (string, bool) {
+	// long header, fixed bit, packet type Initial
+	if len(b) < 7 || b[0]&0xf0 != 0xc0 || binary.BigEndian.Uint32(b[1:5]) != quicVersion1 {
+		return "", false
+	}
+	p := reader(b[5:])
+	dcid, ok := p.vector(1)
+	if !ok || len(dcid) > 20 || !p.skipVector(1) || !p.skipVector(1) {
+		return "", false
+	}
+	tokenLen, ok := p.varint()
+	if !ok || !p.skip(int(tokenLen)) {
+		return "", false
+	}
+	length, ok := p.varint()
+	if !ok || uint64(len(p)) < length {
+		return "", false
+	}
+	pnOffset := len(b) - len(p)
+	end := pnOffset + int(length)
+
+	key, iv, hp := quicClientKeys(dcid)
+
+	// remove header protection, the sample starts 4 bytes after the
+	// packet number
+	if end < pnOffset+4+aes.BlockSize {
+		return "", false
+	}
+	block, _ := aes.NewCipher(hp)
+	mask := make([]byte, aes.BlockSize)
+	block.Encrypt(mask, b[pnOffset+4:pnOffset+4+aes.BlockSize])
+
+	header := make([]byte, pnOffset+4)
+	copy(header, b)
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	header = header[:pnOffset+pnLen]
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+
+	block, _ = aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	nonce := make([]byte, len(iv))
+	copy(nonce, iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	payload, err := aead.Open(nil, nonce, b[pnOffset+pnLen:end], header)
+	if err != nil {
+		return "", false
+	}
+
+	crypto, ok := quicCryptoData(payload)
+	if !ok {
+		return "", true
+	}
+	return clientHelloSNI(crypto), true
+}
+
+func quicClientKeys(dcid []byte) (key, iv, hp []byte) {
+	initial, _ := hkdf.Extract(sha256.New, dcid, quicInitialSalt)
+	client := expandLabel(initial, "client in", sha256.Size)
+	return expandLabel(client, "quic key", 16), expandLabel(client, "quic iv", 12), expandLabel(client, "quic hp", 16)
+}
+
+// expandLabel is HKDF-Expand-Label of TLS 1.3 with an empty context.
+func expandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(label))}
+	info = append(info, label...)
+	info = append(info, 0)
+	out, _ := hkdf.Expand(sha256.New, secret, string(info), length)
+	return out
+}
+
+// quicCryptoData reassembles the CRYPTO frames of a decrypted Initial
+// payload, returns the contiguous data from offset 0.
+func quicCryptoData(payload []byte) ([]byte, bool) {
+	type fragment struct {
+		offset uint64
+		data   []byte
+	}
+	var frags []fragment
+	p := reader(payload)
+	for len(p) > 0 {
+		typ, _ := p.varint()
+		switch typ {
+		case 0x00, 0x01: // PADDING, PING
+		case 0x02, 0x03: // ACK
+			// largest, delay, range count, first range, then the ranges
+			// and ECN counts
+			var fields uint64 = 4
+			for i := uint64(0); i < fields; i++ {
+				v, ok := p.varint()
+				if !ok {
+					return nil, false
+				}
+				if i == 2 {
+					fields += 2 * v
+					if typ == 0x03 {
+						fields += 3
+					}
+				}
+			}
+		case 0x06: // CRYPTO
+			offset, ok1 := p.varint()
+			length, ok2 := p.varint()
+			if !ok1 || !ok2 || uint64(len(p)) < length {
+				return nil, false
+			}
+			frags = append(frags, fragment{offset, p[:length]})
+			p = p[length:]
+		default:
+			// other frames are not allowed before the ClientHello is done
+			p = nil
+		}
+	}
+
+	sort.Slice(frags, func(i, j int) bool { return frags[i].offset < frags[j].offset })
+	var data []byte
+	for _, f := range frags {
+		if f.offset > uint64(len(data)) {
+			break
+		}
+		if end := f.offset + uint64(len(f.data)); end > uint64(len(data)) {
+			data = append(data, f.data[uint64(len(data))-f.offset:]...)
+		}
+	}
+	return data, len(data) > 0
+}
+
+// varint reads a QUIC variable-length integer.
+func (r *reader) varint() (uint64, bool) {
+	if len(*r) == 0 {
+		return 0, false
+	}
+	n := 1 << ((*r)[0] >> 6)
+	if len(*r) < n {
+		return 0, false
+	}
+	v := uint64((*r)[0] & 0x3f)
+	for _, c := range (*r)[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	*r = (*r)[n:]
+	return v, true
+}
@@ -0,0 +1,56 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package sniff detects the application protocol and the requested domain
+// from the first bytes of a connection or a datagram.
+package sniff
+
+const (
+	ProtocolTLS        = "tls"
+	ProtocolHTTP       = "http"
+	ProtocolQUIC       = "quic"
+	ProtocolBitTorrent = "bittorrent"
+)
+
+// Result is what was learned from the payload, Domain may be empty even if
+// Protocol is known.
+type Result struct {
+	Protocol string
+	Domain   string
+}
+
+// Stream sniffs the first payload of a TCP connection.
+func Stream(b []byte) Result {
+	if domain, ok := TLS(b); ok {
+		return Result{ProtocolTLS, domain}
+	}
+	if domain, ok := HTTP(b); ok {
+		return Result{ProtocolHTTP, domain}
+	}
+	if BitTorrent(b) {
+		return Result{Protocol: ProtocolBitTorrent}
+	}
+	return Result{}
+}
+
+// Packet sniffs a UDP datagram.
+func Packet(b []byte) Result {
+	if domain, ok := QUIC(b); ok {
+		return Result{ProtocolQUIC, domain}
+	}
+	if BitTorrentPacket(b) {
+		return Result{Protocol: ProtocolBitTorrent}
+	}
+	return Result{}
+}
@@ -0,0 +1,122 @@
+package sniff
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// clientHello captures the first record sent by a crypto/tls client.
+func clientHello(t *testing.T, serverName string) []byte {
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		tls.Client(c, &tls.Config{ServerName: serverName}).Handshake()
+		c.Close()
+	}()
+	buf := make([]byte, 4096)
+	n, err := s.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read ClientHello: %v", err)
+	}
+	return buf[:n]
+}
+
+func TestStream(t *testing.T) {
+	hello := clientHello(t, "www.Example.com")
+	cases := []struct {
+		payload []byte
+		want    Result
+	}{
+		{hello, Result{ProtocolTLS, "www.example.com"}},
+		{hello[:len(hello)-10], Result{ProtocolTLS, "www.example.com"}},
+		{[]byte("GET / HTTP/1.1\r\nUser-Agent: x\r\nhost: example.org:8080\r\n\r\n"), Result{ProtocolHTTP, "example.org"}},
+		{[]byte("POST / HTTP/1.1\r\nHost: exam"), Result{ProtocolHTTP, ""}},
+		{append(append([]byte{}, bittorrentHandshake...), make([]byte, 48)...), Result{Protocol: ProtocolBitTorrent}},
+		{[]byte("SSH-2.0-OpenSSH_9.6\r\n"), Result{}},
+	}
+	for _, c := range cases {
+		if got := Stream(c.payload); got != c.want {
+			t.Errorf("Stream(%q) = %+v, want %+v", c.payload[:8], got, c.want)
+		}
+	}
+}
+
+func TestQUICClientKeys(t *testing.T) {
+	// RFC 9001 appendix A.1
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	key, iv, hp := quicClientKeys(dcid)
+	for _, c := range []struct{ got, want string }{
+		{hex.EncodeToString(key), "1f369613dd76d5467730efcbe3b1a22d"},
+		{hex.EncodeToString(iv), "fa044b2f42a3fd3b46fb255c"},
+		{hex.EncodeToString(hp), "9f50449e04a0e810283a1e9933adedd2"},
+	} {
+		if c.got != c.want {
+			t.Errorf("got %s, want %s", c.got, c.want)
+		}
+	}
+}
+
+// sealInitial builds a protected client Initial packet carrying the
+// ClientHello in two out of order CRYPTO frames.
+func sealInitial(hello []byte) []byte {
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	key, iv, hp := quicClientKeys(dcid)
+
+	half := len(hello) / 2
+	var payload []byte
+	payload = append(payload, 0x06, 0x40|byte(half>>8), byte(half), 0x40|byte((len(hello)-half)>>8), byte(len(hello)-half))
+	payload = append(payload, hello[half:]...)
+	payload = append(payload, 0x01, 0x06, 0x00, 0x40|byte(half>>8), byte(half))
+	payload = append(payload, hello[:half]...)
+	if len(payload) < 1100 {
+		payload = append(payload, make([]byte, 1100-len(payload))...)
+	}
+
+	pn := []byte{0, 0}
+	length := len(pn) + len(payload) + 16
+	header := []byte{0xc1, 0, 0, 0, 1, byte(len(dcid))}
+	header = append(header, dcid...)
+	header = append(header, 0, 0, 0x40|byte(length>>8), byte(length))
+	pnOffset := len(header)
+	header = append(header, pn...)
+
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	packet := aead.Seal(append([]byte{}, header...), iv, payload, header)
+
+	block, _ = aes.NewCipher(hp)
+	mask := make([]byte, aes.BlockSize)
+	block.Encrypt(mask, packet[pnOffset+4:])
+	packet[0] ^= mask[0] & 0x0f
+	packet[pnOffset] ^= mask[1]
+	packet[pnOffset+1] ^= mask[2]
+	return packet
+}
+
+func TestPacket(t *testing.T) {
+	record := clientHello(t, "quic.example.com")
+	initial := sealInitial(record[5:])
+	corrupted := bytes.Clone(initial)
+	corrupted[len(corrupted)-1] ^= 1
+
+	cases := []struct {
+		payload []byte
+		want    Result
+	}{
+		{initial, Result{ProtocolQUIC, "quic.example.com"}},
+		{corrupted, Result{}},
+		{[]byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"), Result{Protocol: ProtocolBitTorrent}},
+		{append([]byte{0x41, 0}, make([]byte, 18)...), Result{Protocol: ProtocolBitTorrent}},
+		{[]byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01}, Result{}},
+	}
+	for _, c := range cases {
+		if got := Packet(c.payload); got != c.want {
+			t.Errorf("Packet(%x) = %+v, want %+v", c.payload[:6], got, c.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sniff
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// TLS returns the SNI of a TLS ClientHello record, ok is true if b starts
+// with a handshake record even if the SNI is absent or truncated.
+func TLS(b []byte) (string, bool) {
+	// ContentType handshake, legacy record version 3.x
+	if len(b) < 5 || b[0] != 0x16 || b[1] != 0x03 {
+		return "", false
+	}
+	length := int(binary.BigEndian.Uint16(b[3:5]))
+	b = b[5:]
+	if len(b) > length {
+		b = b[:length]
+	}
+	if len(b) < 1 || b[0] != 0x01 {
+		return "", false
+	}
+	return clientHelloSNI(b), true
+}
+
+// clientHelloSNI parses a handshake message holding a ClientHello, it
+// returns the server name found before b ends.
+func clientHelloSNI(b []byte) string {
+	if len(b) < 4 || b[0] != 0x01 {
+		return ""
+	}
+	// msg type, length, legacy version, random
+	p := reader(b[4:])
+	if !p.skip(2+32) || !p.skipVector(1) || !p.skipVector(2) || !p.skipVector(1) {
+		return ""
+	}
+	exts, ok := p.vector(2)
+	if !ok {
+		// the extensions are truncated, scan what we have
+		if len(p) < 2 {
+			return ""
+		}
+		exts = p[2:]
+	}
+	for len(exts) >= 4 {
+		typ := binary.BigEndian.Uint16(exts)
+		data, ok := exts[2:].vector(2)
+		if !ok {
+			return ""
+		}
+		exts = exts[4+len(data):]
+		if typ != 0 {
+			continue
+		}
+		// server_name_list
+		list, ok := data.vector(2)
+		for ok && len(list) >= 3 {
+			nameType := list[0]
+			var name reader
+			if name, ok = list[1:].vector(2); !ok {
+				break
+			}
+			if nameType == 0 {
+				return strings.ToLower(string(name))
+			}
+			list = list[3+len(name):]
+		}
+		return ""
+	}
+	return ""
+}
+
+type reader []byte
+
+func (r *reader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+// vector returns the content of a vector with a size prefix of n bytes.
+func (r reader) vector(n int) (reader, bool) {
+	if len(r) < n {
+		return nil, false
+	}
+	size := 0
+	for _, c := range r[:n] {
+		size = size<<8 | int(c)
+	}
+	if len(r) < n+size {
+		return nil, false
+	}
+	return r[n : n+size], true
+}
+
+func (r *reader) skipVector(n int) bool {
+	v, ok := r.vector(n)
+	if !ok {
+		return false
+	}
+	*r = (*r)[n+len(v):]
+	return true
+}
@@ -60,6 +60,10 @@ func (a Addr) String() string {
 	return net.JoinHostPort(host, port)
 }
 
+// Network returns "udp", so that an Addr, including a domain name, can be
+// the destination of packets.
+func (a Addr) Network() string { return "udp" }
+
 // UDPAddr converts a socks5.Addr to *net.UDPAddr
 func (a Addr) UDPAddr() *net.UDPAddr {
 	if len(a) == 0 {
@@ -93,6 +97,37 @@ const (
 
 // ServerHandshake fast-tracks SOCKS initialization to get target address to connect on server side.
 func ServerHandshake(rw net.Conn) (addr Addr, command Command, err error) {
+	if addr, command, err = ReadRequest(rw); err != nil {
+		return
+	}
+
+	switch command {
+	case CmdConnect, CmdUDPAssociate:
+		err = WriteReply(rw, nil)
+	case CmdBind:
+		fallthrough
+	default:
+		err = ErrCommandNotSupported
+	}
+
+	return
+}
+
+// ErrAuthFailed is returned by ReadRequestWithAuth if the client does not
+// authenticate.
+var ErrAuthFailed = errors.New("SOCKS authentication failed")
+
+// ReadRequest negotiates the authentication method and reads the request,
+// which must be answered with WriteReply.
+func ReadRequest(rw net.Conn) (addr Addr, command Command, err error) {
+	addr, command, _, err = ReadRequestWithAuth(rw, nil)
+	return
+}
+
+// ReadRequestWithAuth is ReadRequest requiring RFC 1929 username/password
+// authentication if auth is not nil, the user is accepted if auth returns
+// true.
+func ReadRequestWithAuth(rw net.Conn, auth func(*User) bool) (addr Addr, command Command, user *User, err error) {
 	// Read RFC 1928 for request and reply structure and sizes.
 	buf := make([]byte, MaxAddrLen)
 	// read VER, NMETHODS, METHODS
@@ -104,7 +139,15 @@ func ServerHandshake(rw net.Conn) (addr Addr, command Command, err error) {
 		return
 	}
 
-	if _, err = rw.Write([]byte{5, 0}); err != nil {
+	if auth == nil {
+		_, err = rw.Write([]byte{5, 0})
+	} else if bytes.IndexByte(buf[:nmethods], 2) < 0 {
+		rw.Write([]byte{5, 0xff}) // no acceptable methods
+		err = ErrAuthFailed
+	} else if _, err = rw.Write([]byte{5, 2}); err == nil {
+		user, err = readAuth(rw, buf, auth)
+	}
+	if err != nil {
 		return
 	}
 
@@ -115,36 +158,84 @@ func ServerHandshake(rw net.Conn) (addr Addr, command Command, err error) {
 
 	command = buf[1]
 	addr, err = ReadAddr(rw, buf)
-	if err != nil {
-		return
+	return
+}
+
+// readAuth reads the RFC 1929 username/password request and replies with
+// the result of auth.
+func readAuth(rw io.ReadWriter, buf []byte, auth func(*User) bool) (*User, error) {
+	// read VER, ULEN, UNAME, PLEN, PASSWD
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return nil, err
+	}
+	if buf[0] != 1 {
+		return nil, errors.New("SOCKS auth version error")
+	}
+	user := &User{}
+	ulen := int(buf[1])
+	if _, err := io.ReadFull(rw, buf[:ulen+1]); err != nil {
+		return nil, err
+	}
+	user.Username = string(buf[:ulen])
+	plen := int(buf[ulen])
+	if _, err := io.ReadFull(rw, buf[:plen]); err != nil {
+		return nil, err
 	}
+	user.Password = string(buf[:plen])
 
-	switch command {
-	case CmdConnect, CmdUDPAssociate:
-		// Acquire server listened address info
-		localAddr := ParseAddr(rw.LocalAddr().String())
-		if localAddr == nil {
-			err = ErrAddressNotSupported
-		} else {
-			// write VER REP RSV ATYP BND.ADDR BND.PORT
-			_, err = rw.Write(bytes.Join([][]byte{{5, 0, 0}, localAddr}, []byte{}))
+	if !auth(user) {
+		rw.Write([]byte{1, 1})
+		return nil, ErrAuthFailed
+	}
+	if _, err := rw.Write([]byte{1, 0}); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// WriteReply answers a request read by ReadRequest, a nil rep reports
+// success along with the server listened address.
+func WriteReply(rw net.Conn, rep error) error {
+	// Acquire server listened address info
+	localAddr := ParseAddr(rw.LocalAddr().String())
+	if localAddr == nil {
+		return ErrAddressNotSupported
+	}
+	return WriteReplyAddr(rw, rep, localAddr)
+}
+
+// WriteReplyAddr is WriteReply reporting bnd as the bound address, e.g.
+// the relay of a UDP associate request.
+func WriteReplyAddr(w io.Writer, rep error, bnd Addr) error {
+	code := byte(0)
+	if rep != nil {
+		code = byte(ErrGeneralFailure)
+		if e, ok := rep.(Error); ok {
+			code = byte(e)
 		}
-	case CmdBind:
-		fallthrough
-	default:
-		err = ErrCommandNotSupported
 	}
+	// write VER REP RSV ATYP BND.ADDR BND.PORT
+	_, err := w.Write(bytes.Join([][]byte{{5, code, 0}, bnd}, []byte{}))
+	return err
+}
 
-	return
+// User is the username/password pair used by RFC 1929 authentication.
+type User struct {
+	Username string
+	Password string
 }
 
 // ClientHandshake fast-tracks SOCKS initialization to get target address to connect on client side.
-func ClientHandshake(rw io.ReadWriter, addr Addr, command Command) (Addr, error) {
+func ClientHandshake(rw io.ReadWriter, addr Addr, command Command, user *User) (Addr, error) {
 	buf := make([]byte, MaxAddrLen)
 	var err error
 
 	// VER, NMETHODS, METHODS
-	_, err = rw.Write([]byte{5, 1, 0})
+	if user != nil {
+		_, err = rw.Write([]byte{5, 1, 2})
+	} else {
+		_, err = rw.Write([]byte{5, 1, 0})
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -158,7 +249,31 @@ func ClientHandshake(rw io.ReadWriter, addr Addr, command Command) (Addr, error)
 		return nil, errors.New("SOCKS version error")
 	}
 
-	if buf[1] != 0 {
+	if buf[1] == 2 {
+		if user == nil {
+			return nil, errors.New("SOCKS need auth")
+		}
+
+		// VER, ULEN, UNAME, PLEN, PASSWD as defined in RFC 1929
+		authMsg := &bytes.Buffer{}
+		authMsg.WriteByte(1)
+		authMsg.WriteByte(uint8(len(user.Username)))
+		authMsg.WriteString(user.Username)
+		authMsg.WriteByte(uint8(len(user.Password)))
+		authMsg.WriteString(user.Password)
+
+		if _, err := rw.Write(authMsg.Bytes()); err != nil {
+			return nil, err
+		}
+
+		if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+			return nil, err
+		}
+
+		if buf[1] != 0 {
+			return nil, errors.New("SOCKS authentication failed")
+		}
+	} else if buf[1] != 0 {
 		return nil, errors.New("SOCKS need auth")
 	}
 
@@ -172,6 +287,10 @@ func ClientHandshake(rw io.ReadWriter, addr Addr, command Command) (Addr, error)
 		return nil, err
 	}
 
+	if buf[1] != 0 {
+		return nil, Error(buf[1])
+	}
+
 	return ReadAddr(rw, buf)
 }
 
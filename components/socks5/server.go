@@ -15,29 +15,46 @@
 package socks5
 
 import (
+	"errors"
 	"io"
 	"io/ioutil"
 	"net"
+	"sync/atomic"
 
 	log "github.com/golang/glog"
 )
 
+// SocksCallback handles a CONNECT request, it must answer the request
+// with WriteReply before relaying.
 type SocksCallback func(net.Conn, Addr)
 
+// SocksUDPCallback opens the packet conn relaying the packets of a UDP
+// associate request, it is closed along with the association.
+type SocksUDPCallback func() (net.PacketConn, error)
+
 type SockListener struct {
 	net.Listener
 	address  string
 	closed   bool
 	callback SocksCallback
+	udp      SocksUDPCallback
 }
 
+// NewSocksProxy serves CONNECT requests with cb, UDP associate requests
+// are not supported.
 func NewSocksProxy(addr string, cb SocksCallback) (*SockListener, error) {
+	return NewSocksProxyWithUDP(addr, cb, nil)
+}
+
+// NewSocksProxyWithUDP is NewSocksProxy also relaying the packets of UDP
+// associate requests through the packet conns opened by udp.
+func NewSocksProxyWithUDP(addr string, cb SocksCallback, udp SocksUDPCallback) (*SockListener, error) {
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
 
-	sl := &SockListener{l, addr, false, cb}
+	sl := &SockListener{l, addr, false, cb, udp}
 	go func() {
 		log.Infof("SOCKS proxy listening at: %s\n", addr)
 		for {
@@ -48,7 +65,7 @@ func NewSocksProxy(addr string, cb SocksCallback) (*SockListener, error) {
 				}
 				continue
 			}
-			go handleSocks(c, sl.callback)
+			go handleSocks(c, sl.callback, sl.udp)
 		}
 	}()
 
@@ -64,8 +81,8 @@ func (l *SockListener) Address() string {
 	return l.address
 }
 
-func handleSocks(conn net.Conn, cb SocksCallback) {
-	target, command, err := ServerHandshake(conn)
+func handleSocks(conn net.Conn, cb SocksCallback, udp SocksUDPCallback) {
+	target, command, err := ReadRequest(conn)
 	if err != nil {
 		conn.Close()
 		return
@@ -74,10 +91,101 @@ func handleSocks(conn net.Conn, cb SocksCallback) {
 	if c, ok := conn.(*net.TCPConn); ok {
 		c.SetKeepAlive(true)
 	}
-	if command == CmdUDPAssociate {
-		defer conn.Close()
-		io.Copy(ioutil.Discard, conn)
+	switch command {
+	case CmdConnect:
+		cb(conn, target)
+	case CmdUDPAssociate:
+		if udp == nil {
+			WriteReply(conn, ErrCommandNotSupported)
+			conn.Close()
+			return
+		}
+		handleUDP(conn, udp)
+	default:
+		WriteReply(conn, ErrCommandNotSupported)
+		conn.Close()
+	}
+}
+
+// handleUDP relays the packets of a UDP association until its control
+// connection is closed. Packets are accepted from the IP address of the
+// control connection only.
+func handleUDP(conn net.Conn, open SocksUDPCallback) {
+	defer conn.Close()
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		log.Errorf("Failed to listen UDP for %s: %v\n", conn.RemoteAddr().String(), err)
+		WriteReply(conn, ErrGeneralFailure)
 		return
 	}
-	cb(conn, target)
+	defer pc.Close()
+	remote, err := open()
+	if err != nil {
+		log.Warningf("Failed to open UDP association for %s: %v\n", conn.RemoteAddr().String(), err)
+		WriteReply(conn, ErrGeneralFailure)
+		return
+	}
+	defer remote.Close()
+	if err := WriteReplyAddr(conn, nil, ParseAddrToSocksAddr(pc.LocalAddr())); err != nil {
+		return
+	}
+	log.V(1).Infof("New UDP association from %s at %s\n", conn.RemoteAddr().String(), pc.LocalAddr().String())
+
+	/* the association ends along with the control connection */
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		pc.Close()
+		remote.Close()
+	}()
+
+	var client atomic.Pointer[net.UDPAddr]
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, from, err := remote.ReadFrom(buf)
+			if err != nil {
+				pc.Close()
+				return
+			}
+			to := client.Load()
+			src := ParseAddrToSocksAddr(from)
+			if to == nil || src == nil {
+				continue
+			}
+			pkt, _ := EncodeUDPPacket(src, buf[:n])
+			pc.WriteTo(pkt, to)
+		}
+	}()
+
+	var allowed net.IP
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		allowed = addr.IP
+	}
+	buf := make([]byte, 64*1024)
+	for {
+		n, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Errorf("Failed to read UDP of %s: %v\n", conn.RemoteAddr().String(), err)
+			}
+			return
+		}
+		usrc := src.(*net.UDPAddr)
+		if allowed != nil && !allowed.Equal(usrc.IP) {
+			log.V(1).Infof("UDP packet from unexpected %s dropped\n", src.String())
+			continue
+		}
+		addr, payload, err := DecodeUDPPacket(buf[:n])
+		if err != nil {
+			log.V(1).Infof("UDP packet from %s dropped: %v\n", src.String(), err)
+			continue
+		}
+		if client.Load() == nil {
+			client.Store(usrc)
+		}
+		if _, err := remote.WriteTo(payload, addr); err != nil {
+			log.V(1).Infof("UDP packet from %s to %s dropped: %v\n", src.String(), addr.String(), err)
+		}
+	}
 }
@@ -23,21 +23,33 @@ import (
 )
 
 func Relay(left, right net.Conn) (el, er error) {
-	ch := make(chan error, 2)
+	_, _, el, er = RelayCount(left, right)
+	return
+}
+
+// RelayCount is Relay also returning the bytes copied from left to right
+// and from right to left.
+func RelayCount(left, right net.Conn) (sent, received int64, el, er error) {
+	type result struct {
+		n   int64
+		err error
+	}
+	ch := make(chan result, 2)
 
 	go func() {
 		buf := p.Get(p.RelayBufferSize)
-		_, err := io.CopyBuffer(left, right, buf)
+		n, err := io.CopyBuffer(left, right, buf)
 		p.Put(buf)
 		left.SetReadDeadline(time.Now())
-		ch <- err
+		ch <- result{n, err}
 	}()
 
 	buf := p.Get(p.RelayBufferSize)
-	_, el = io.CopyBuffer(right, left, buf)
+	sent, el = io.CopyBuffer(right, left, buf)
 	p.Put(buf)
 	right.SetReadDeadline(time.Now())
-	er = <-ch
+	r := <-ch
+	received, er = r.n, r.err
 
 	if err, ok := el.(net.Error); ok && err.Timeout() {
 		el = nil
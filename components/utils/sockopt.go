@@ -0,0 +1,141 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// TCPOptions tunes a TCP socket, zero values keep the system defaults.
+// Congestion, NotSentLowat and UserTimeout are only applied on Linux.
+// SendBuffer and RecvBuffer are set by Control before connect or listen,
+// so that the window scale negotiated in the handshake accounts for them.
+type TCPOptions struct {
+	// Congestion is the congestion control algorithm, e.g. "bbr"
+	Congestion string
+	SendBuffer int
+	RecvBuffer int
+	// NoDelay overrides TCP_NODELAY when set, Go enables it by default
+	NoDelay      *bool
+	NotSentLowat int
+	UserTimeout  time.Duration
+
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+}
+
+func (o *TCPOptions) IsZero() bool {
+	return o == nil || *o == TCPOptions{}
+}
+
+// KeepAliveConfig returns the keepalive settings, unset fields keep the
+// Go defaults.
+func (o *TCPOptions) KeepAliveConfig() net.KeepAliveConfig {
+	cfg := net.KeepAliveConfig{Enable: true}
+	if o != nil {
+		cfg.Idle = o.KeepAliveIdle
+		cfg.Interval = o.KeepAliveInterval
+		cfg.Count = o.KeepAliveCount
+	}
+	return cfg
+}
+
+// Control returns a net.Dialer or net.ListenConfig Control hook setting
+// the socket buffers of TCP sockets before running ctrl, if any.
+func (o *TCPOptions) Control(ctrl func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	if o == nil || (o.SendBuffer <= 0 && o.RecvBuffer <= 0) {
+		return ctrl
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if strings.HasPrefix(network, "tcp") {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = setBuffers(fd, o.SendBuffer, o.RecvBuffer)
+			}); cerr != nil {
+				return cerr
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if ctrl != nil {
+			return ctrl(network, address, c)
+		}
+		return nil
+	}
+}
+
+// Apply tunes an established connection, non TCP connections are left
+// untouched. The socket buffers are left to Control.
+func (o *TCPOptions) Apply(c net.Conn) error {
+	tc, ok := c.(*net.TCPConn)
+	if !ok || o.IsZero() {
+		return nil
+	}
+	if err := tc.SetKeepAliveConfig(o.KeepAliveConfig()); err != nil {
+		return err
+	}
+	if o.NoDelay != nil {
+		if err := tc.SetNoDelay(*o.NoDelay); err != nil {
+			return err
+		}
+	}
+
+	sysconn, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var setErr error
+	ctrlErr := sysconn.Control(func(fd uintptr) {
+		setErr = o.applyFD(fd)
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	return setErr
+}
+
+// ParseTCPOptions loads socket tuning from the section name of cfg, a
+// missing section yields the system defaults.
+func ParseTCPOptions(cfg *ini.File, name string) (TCPOptions, error) {
+	var o TCPOptions
+	sec, err := cfg.GetSection(name)
+	if err != nil {
+		return o, nil
+	}
+	o.Congestion = sec.Key("congestion").String()
+	o.SendBuffer = sec.Key("send-buffer").MustInt(0)
+	o.RecvBuffer = sec.Key("recv-buffer").MustInt(0)
+	if sec.HasKey("no-delay") {
+		nodelay, err := sec.Key("no-delay").Bool()
+		if err != nil {
+			return o, fmt.Errorf("%s: invalid no-delay, %v", name, err)
+		}
+		o.NoDelay = &nodelay
+	}
+	o.NotSentLowat = sec.Key("notsent-lowat").MustInt(0)
+	o.UserTimeout = sec.Key("user-timeout").MustDuration(0)
+	o.KeepAliveIdle = sec.Key("keepalive-idle").MustDuration(0)
+	o.KeepAliveInterval = sec.Key("keepalive-interval").MustDuration(0)
+	o.KeepAliveCount = sec.Key("keepalive-count").MustInt(0)
+	return o, nil
+}
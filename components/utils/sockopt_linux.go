@@ -0,0 +1,44 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"syscall"
+)
+
+const (
+	tcpUserTimeout  = 18 // TCP_USER_TIMEOUT on Linux
+	tcpNotSentLowat = 25 // TCP_NOTSENT_LOWAT on Linux
+)
+
+func (o *TCPOptions) applyFD(fd uintptr) error {
+	s := int(fd)
+	if o.Congestion != "" {
+		if err := syscall.SetsockoptString(s, syscall.SOL_TCP, syscall.TCP_CONGESTION, o.Congestion); err != nil {
+			return err
+		}
+	}
+	if o.NotSentLowat > 0 {
+		if err := syscall.SetsockoptInt(s, syscall.SOL_TCP, tcpNotSentLowat, o.NotSentLowat); err != nil {
+			return err
+		}
+	}
+	if o.UserTimeout > 0 {
+		if err := syscall.SetsockoptInt(s, syscall.SOL_TCP, tcpUserTimeout, int(o.UserTimeout.Milliseconds())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
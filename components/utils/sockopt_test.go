@@ -0,0 +1,104 @@
+//go:build !windows
+
+package utils
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+func TestParseTCPOptions(t *testing.T) {
+	cfg, err := ini.Load([]byte(`
+[tcp.client]
+congestion = bbr
+send-buffer = 65536
+no-delay = false
+user-timeout = 30s
+keepalive-count = 3
+
+[tcp.bad]
+no-delay = maybe
+`))
+	if err != nil {
+		t.Fatalf("ini.Load failed: %v", err)
+	}
+	o, err := ParseTCPOptions(cfg, "tcp.client")
+	if err != nil {
+		t.Fatalf("ParseTCPOptions failed: %v", err)
+	}
+	if o.Congestion != "bbr" || o.SendBuffer != 65536 || o.NoDelay == nil || *o.NoDelay || o.UserTimeout != 30*time.Second || o.KeepAliveCount != 3 {
+		t.Errorf("parsed %+v", o)
+	}
+	if o, err := ParseTCPOptions(cfg, "tcp.missing"); err != nil || !o.IsZero() {
+		t.Errorf("missing section = %+v, %v", o, err)
+	}
+	if _, err := ParseTCPOptions(cfg, "tcp.bad"); err == nil {
+		t.Error("invalid no-delay accepted")
+	}
+}
+
+func sockBuffer(t *testing.T, c net.Conn, opt int) int {
+	raw, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn failed: %v", err)
+	}
+	var n int
+	raw.Control(func(fd uintptr) {
+		n, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	})
+	if err != nil {
+		t.Fatalf("getsockopt failed: %v", err)
+	}
+	return n
+}
+
+func TestTCPOptions_Control(t *testing.T) {
+	/* below the default net.core.[rw]mem_max, above the TCP defaults */
+	const size = 150000
+	o := &TCPOptions{SendBuffer: size, RecvBuffer: size}
+	var chained []string
+	lc := &net.ListenConfig{Control: o.Control(func(network, address string, c syscall.RawConn) error {
+		chained = append(chained, network)
+		return nil
+	})}
+	l, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	if len(chained) != 1 {
+		t.Errorf("chained control ran %d times", len(chained))
+	}
+
+	d := &net.Dialer{Control: o.Control(nil)}
+	c, err := d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	sc, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer sc.Close()
+
+	/* accepted sockets inherit the buffers of the listener, Linux reports
+	 * twice the requested size */
+	for _, conn := range []net.Conn{c, sc} {
+		if n := sockBuffer(t, conn, syscall.SO_RCVBUF); n < size {
+			t.Errorf("SO_RCVBUF = %d, want at least %d", n, size)
+		}
+		if n := sockBuffer(t, conn, syscall.SO_SNDBUF); n < size {
+			t.Errorf("SO_SNDBUF = %d, want at least %d", n, size)
+		}
+	}
+
+	if (&TCPOptions{}).Control(nil) != nil {
+		t.Error("zero options installed a control hook")
+	}
+}
@@ -0,0 +1,43 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+const tcpiOptSynData = 32 // TCPI_OPT_SYN_DATA on Linux
+
+// TCPFastOpenUsed reports whether data carried in the SYN of c was
+// acknowledged, for both active and passive opens.
+func TCPFastOpenUsed(c net.Conn) bool {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return false
+	}
+	sysconn, err := tc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var used bool
+	sysconn.Control(func(fd uintptr) {
+		info, err := unix.GetsockoptTCPInfo(int(fd), unix.SOL_TCP, unix.TCP_INFO)
+		used = err == nil && info.Options&tcpiOptSynData != 0
+	})
+	return used
+}
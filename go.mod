@@ -6,10 +6,8 @@ require (
 	github.com/golang/glog v1.2.5
 	github.com/hashicorp/golang-lru v1.0.2
 	golang.org/x/crypto v0.46.0
+	golang.org/x/sys v0.39.0
 	gopkg.in/ini.v1 v1.67.0
 )
 
-require (
-	github.com/stretchr/testify v1.11.1 // indirect
-	golang.org/x/sys v0.39.0 // indirect
-)
+require github.com/stretchr/testify v1.11.1 // indirect